@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/open-policy-agent/opa/profiler"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/structpb"
+	"sigs.k8s.io/yaml"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+
+	fnv1beta1 "github.com/crossplane/function-sdk-go/proto/v1beta1"
+)
+
+// benchCmd benchmarks a policy against a set of request fixtures.
+type benchCmd struct {
+	Input     string   `help:"Input to benchmark, in YAML or JSON. Overrides the input of the request fixtures." type:"existingfile" required:""`
+	Requests  []string `arg:"" help:"RunFunctionRequest fixtures, in YAML or JSON." type:"existingfile"`
+	PolicyDir string   `help:"Directory containing a library of Rego policies, like the serve command's --policy-dir."`
+
+	Iterations      int    `help:"Number of times to run each request fixture." default:"100"`
+	Parallelism     int    `help:"Number of requests to run concurrently." default:"1"`
+	ResourceWorkers int    `help:"Maximum number of composed resources each request evaluates concurrently, like the serve command's --resource-workers." default:"4"`
+	Output          string `help:"Output format, either table or json." enum:"table,json" default:"table"`
+
+	Profile       bool   `help:"Profile the policy, evaluating each request fixture once more after the benchmark, and report the expressions that took the most time."`
+	ProfileTop    int    `help:"Number of expressions to report when profiling." default:"10"`
+	ProfileOutput string `help:"File to which to write the profile in pprof format, e.g. to inspect it using go tool pprof."`
+
+	Baseline    string  `help:"Report, in JSON, of a previous run. Fail if the p95 latency got more than --max-slowdown times slower." type:"existingfile"`
+	MaxSlowdown float64 `help:"Maximum p95 latency slowdown compared to --baseline." default:"2"`
+}
+
+// A benchReport reports how the Function performed. Durations are in
+// nanoseconds.
+type benchReport struct {
+	Requests    int            `json:"requests"`
+	Parallelism int            `json:"parallelism"`
+	Latency     benchLatency   `json:"latency"`
+	AllocsPerOp uint64         `json:"allocsPerOp"`
+	BytesPerOp  uint64         `json:"bytesPerOp"`
+	Stages      []benchLatency `json:"stages"`
+	Profile     []benchExpr    `json:"profile,omitempty"`
+}
+
+// benchLatency reports latency percentiles.
+type benchLatency struct {
+	Name string        `json:"name,omitempty"`
+	P50  time.Duration `json:"p50"`
+	P95  time.Duration `json:"p95"`
+	P99  time.Duration `json:"p99"`
+}
+
+// benchExpr reports a profiled expression.
+type benchExpr struct {
+	Location   string        `json:"location"`
+	Expression string        `json:"expression"`
+	Time       time.Duration `json:"time"`
+	Evals      int           `json:"evals"`
+	Redos      int           `json:"redos"`
+}
+
+// Run the benchmark.
+func (c *benchCmd) Run() error {
+	in, err := readStruct(c.Input)
+	if err != nil {
+		return errors.Wrapf(err, "cannot read input %q", c.Input)
+	}
+	reqs := make([]*fnv1beta1.RunFunctionRequest, len(c.Requests))
+	for i, path := range c.Requests {
+		if reqs[i], err = readRequest(path); err != nil {
+			return errors.Wrapf(err, "cannot read request fixture %q", path)
+		}
+		reqs[i].Input = in
+	}
+
+	f := &Function{log: logging.NewNopLogger(), policies: newPolicyCache(len(reqs)), resourceWorkers: c.ResourceWorkers}
+	if c.PolicyDir != "" {
+		lib, err := loadLibrary(c.PolicyDir)
+		if err != nil {
+			return err
+		}
+		f.library.Store(lib)
+	}
+
+	r, err := bench(context.Background(), f, reqs, c.Iterations, c.Parallelism)
+	if err != nil {
+		return err
+	}
+
+	if c.Profile || c.ProfileOutput != "" {
+		stats, err := profileRequests(context.Background(), f, reqs)
+		if err != nil {
+			return err
+		}
+		for i, s := range stats {
+			if i == c.ProfileTop {
+				break
+			}
+			r.Profile = append(r.Profile, benchExpr{Location: exprLocation(s), Expression: exprText(s), Time: time.Duration(s.ExprTimeNs), Evals: s.NumEval, Redos: s.NumRedo})
+		}
+		if c.ProfileOutput != "" {
+			if err := writePprofFile(c.ProfileOutput, stats); err != nil {
+				return err
+			}
+		}
+	}
+
+	switch c.Output {
+	case "json":
+		err = writeJSON(os.Stdout, r)
+	default:
+		err = writeTable(os.Stdout, r)
+	}
+	if err != nil {
+		return errors.Wrap(err, "cannot write report")
+	}
+
+	if c.Baseline == "" {
+		return nil
+	}
+	data, err := os.ReadFile(c.Baseline)
+	if err != nil {
+		return errors.Wrapf(err, "cannot read baseline %q", c.Baseline)
+	}
+	base := &benchReport{}
+	if err := json.Unmarshal(data, base); err != nil {
+		return errors.Wrapf(err, "cannot parse baseline %q", c.Baseline)
+	}
+	return compareBaseline(base, r, c.MaxSlowdown)
+}
+
+// bench runs each of the supplied requests the supplied number of times, with
+// the supplied parallelism. Each request is run once before measuring, e.g. to
+// compile its policy.
+func bench(ctx context.Context, f *Function, reqs []*fnv1beta1.RunFunctionRequest, iterations, parallelism int) (*benchReport, error) {
+	if len(reqs) == 0 || iterations < 1 || parallelism < 1 {
+		return nil, errors.New("at least one request fixture, iteration and parallel request are required")
+	}
+
+	for _, req := range reqs {
+		if err := runRequest(ctx, f, req); err != nil {
+			return nil, err
+		}
+	}
+
+	// Stage latencies are recorded using the spans of the Function.
+	st := &stageTimer{}
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(st))
+	defer tp.Shutdown(ctx) //nolint:errcheck // Nothing to do if we can't shut it down.
+	f.tracer = tp.Tracer(tracerName)
+
+	n := len(reqs) * iterations
+	work := make(chan *fnv1beta1.RunFunctionRequest, n)
+	for i := 0; i < iterations; i++ {
+		for _, req := range reqs {
+			work <- req
+		}
+	}
+	close(work)
+
+	var (
+		mu        sync.Mutex
+		latencies = make([]time.Duration, 0, n)
+		errs      = make([]error, parallelism)
+		wg        sync.WaitGroup
+	)
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	for w := 0; w < parallelism; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for req := range work {
+				start := time.Now()
+				rsp, err := f.RunFunction(ctx, req)
+				d := time.Since(start)
+				if err == nil {
+					err = benchResult(rsp)
+				}
+				if err != nil {
+					errs[w] = err
+					return
+				}
+				mu.Lock()
+				latencies = append(latencies, d)
+				mu.Unlock()
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	runtime.ReadMemStats(&after)
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	r := &benchReport{
+		Requests:    n,
+		Parallelism: parallelism,
+		Latency:     percentiles(latencies),
+		AllocsPerOp: (after.Mallocs - before.Mallocs) / uint64(n),
+		BytesPerOp:  (after.TotalAlloc - before.TotalAlloc) / uint64(n),
+	}
+	for _, name := range st.names {
+		l := percentiles(st.durations[name])
+		l.Name = name
+		r.Stages = append(r.Stages, l)
+	}
+	return r, nil
+}
+
+// profileRequests evaluates each of the supplied requests once, returning the profiled
+// expressions ordered by time.
+func profileRequests(ctx context.Context, f *Function, reqs []*fnv1beta1.RunFunctionRequest) ([]profiler.ExprStats, error) {
+	f.profiler = profiler.New()
+	defer func() { f.profiler = nil }()
+
+	for _, req := range reqs {
+		if err := runRequest(ctx, f, req); err != nil {
+			return nil, err
+		}
+	}
+	return f.profiler.ReportTopNResults(0, profileCriteria), nil
+}
+
+// runRequest runs the supplied request, returning an error if it fails or
+// returns a fatal result.
+func runRequest(ctx context.Context, f *Function, req *fnv1beta1.RunFunctionRequest) error {
+	rsp, err := f.RunFunction(ctx, req)
+	if err != nil {
+		return errors.Wrap(err, "cannot run Function")
+	}
+	return benchResult(rsp)
+}
+
+// benchResult returns an error reporting the first fatal result of the supplied
+// response, if any. Benchmarking a request that fails, e.g. because its policy
+// can't be compiled, would be meaningless.
+func benchResult(rsp *fnv1beta1.RunFunctionResponse) error {
+	return errors.Wrapf(fatalResult(rsp), "Function returned a fatal result for request %q", rsp.GetMeta().GetTag())
+}
+
+func writePprofFile(path string, stats []profiler.ExprStats) error {
+	out, err := os.Create(filepath.Clean(path))
+	if err != nil {
+		return errors.Wrapf(err, "cannot create profile %q", path)
+	}
+	if err := writePprof(out, stats); err != nil {
+		_ = out.Close()
+		return errors.Wrapf(err, "cannot write profile %q", path)
+	}
+	return errors.Wrapf(out.Close(), "cannot write profile %q", path)
+}
+
+// percentiles returns the 50th, 95th and 99th percentiles of the supplied
+// durations, using the nearest rank method. The durations are sorted.
+func percentiles(d []time.Duration) benchLatency {
+	if len(d) == 0 {
+		return benchLatency{}
+	}
+	sort.Slice(d, func(i, j int) bool { return d[i] < d[j] })
+	rank := func(p int) time.Duration {
+		i := (p*len(d) + 99) / 100
+		return d[i-1]
+	}
+	return benchLatency{P50: rank(50), P95: rank(95), P99: rank(99)}
+}
+
+// compareBaseline returns an error if the p95 latency of the supplied report
+// is more than maxSlowdown times the one of the supplied baseline.
+func compareBaseline(base, r *benchReport, maxSlowdown float64) error {
+	if base.Latency.P95 <= 0 {
+		return errors.New("baseline has no p95 latency")
+	}
+	slowdown := float64(r.Latency.P95) / float64(base.Latency.P95)
+	if slowdown > maxSlowdown {
+		return errors.Errorf("p95 latency %s is %.2f times the baseline p95 latency %s, more than the maximum of %.2f", r.Latency.P95, slowdown, base.Latency.P95, maxSlowdown)
+	}
+	return nil
+}
+
+func writeJSON(w io.Writer, r *benchReport) error {
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	return e.Encode(r)
+}
+
+func writeTable(w io.Writer, r *benchReport) error {
+	fmt.Fprintf(w, "%d requests, %d in parallel, %d allocs/op, %d B/op\n\n", r.Requests, r.Parallelism, r.AllocsPerOp, r.BytesPerOp)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "STAGE\tP50\tP95\tP99")
+	for _, l := range append(r.Stages, benchLatency{Name: "Total", P50: r.Latency.P50, P95: r.Latency.P95, P99: r.Latency.P99}) {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", l.Name, l.P50, l.P95, l.P99)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	if len(r.Profile) == 0 {
+		return nil
+	}
+	fmt.Fprintln(w)
+	tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "LOCATION\tTIME\tEVALS\tREDOS\tEXPRESSION")
+	for _, e := range r.Profile {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%s\n", e.Location, e.Time, e.Evals, e.Redos, e.Expression)
+	}
+	return tw.Flush()
+}
+
+// readStruct reads a YAML or JSON object.
+func readStruct(path string) (*structpb.Struct, error) {
+	data, err := os.ReadFile(path) //nolint:gosec // Reading user supplied files is intended.
+	if err != nil {
+		return nil, err
+	}
+	j, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return nil, err
+	}
+	s := &structpb.Struct{}
+	return s, protojson.Unmarshal(j, s)
+}
+
+// readRequest reads a RunFunctionRequest in YAML or JSON.
+func readRequest(path string) (*fnv1beta1.RunFunctionRequest, error) {
+	data, err := os.ReadFile(path) //nolint:gosec // Reading user supplied files is intended.
+	if err != nil {
+		return nil, err
+	}
+	j, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return nil, err
+	}
+	req := &fnv1beta1.RunFunctionRequest{}
+	return req, protojson.Unmarshal(j, req)
+}
+
+// A stageTimer is a span processor recording the durations of spans by name,
+// in the order they were first seen.
+type stageTimer struct {
+	mu        sync.Mutex
+	names     []string
+	durations map[string][]time.Duration
+}
+
+func (t *stageTimer) OnStart(context.Context, sdktrace.ReadWriteSpan) {}
+
+func (t *stageTimer) OnEnd(s sdktrace.ReadOnlySpan) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.durations == nil {
+		t.durations = map[string][]time.Duration{}
+	}
+	if _, ok := t.durations[s.Name()]; !ok {
+		t.names = append(t.names, s.Name())
+	}
+	t.durations[s.Name()] = append(t.durations[s.Name()], s.EndTime().Sub(s.StartTime()))
+}
+
+func (t *stageTimer) Shutdown(context.Context) error   { return nil }
+func (t *stageTimer) ForceFlush(context.Context) error { return nil }
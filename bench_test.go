@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+
+	fnv1beta1 "github.com/crossplane/function-sdk-go/proto/v1beta1"
+	"github.com/crossplane/function-sdk-go/resource"
+
+	"github.com/crossplane/function-rego/input/v1beta1"
+)
+
+func TestBench(t *testing.T) {
+	in := resource.MustStructObject(&v1beta1.Input{
+		TypeMeta: inputTypeMeta,
+		Spec:     v1beta1.InputSpec{Scripts: map[string]string{"policy.rego": "package crossplane\n\nwarn[\"careful\"] { true }\n"}},
+	})
+	reqs := []*fnv1beta1.RunFunctionRequest{
+		{Meta: &fnv1beta1.RequestMeta{Tag: "a"}, Input: in},
+		{Meta: &fnv1beta1.RequestMeta{Tag: "b"}, Input: in},
+	}
+	f := &Function{log: logging.NewNopLogger(), policies: newPolicyCache(1)}
+
+	r, err := bench(context.Background(), f, reqs, 5, 2)
+	if err != nil {
+		t.Fatalf("bench(...): %v", err)
+	}
+
+	names := make([]string, 0, len(r.Stages))
+	for _, s := range r.Stages {
+		names = append(names, s.Name)
+	}
+	want := []string{"DecodeInput", "LoadPolicies", "ValidateInput", "Compile", "Evaluate", "ConvertOutput", "RunFunction"}
+	if diff := cmp.Diff(want, names, cmpopts.SortSlices(func(a, b string) bool { return a < b })); diff != "" {
+		t.Errorf("bench(...): -want stages, +got stages:\n%s", diff)
+	}
+	if diff := cmp.Diff(10, r.Requests); diff != "" {
+		t.Errorf("bench(...): -want requests, +got requests:\n%s", diff)
+	}
+	if r.Latency.P50 <= 0 || r.Latency.P50 > r.Latency.P95 || r.Latency.P95 > r.Latency.P99 {
+		t.Errorf("bench(...): want 0 < p50 <= p95 <= p99, got %+v", r.Latency)
+	}
+}
+
+func TestBenchFatalResult(t *testing.T) {
+	cases := map[string]struct {
+		reason string
+		script string
+		run    func(context.Context, *Function, []*fnv1beta1.RunFunctionRequest) error
+	}{
+		"Bench": {
+			reason: "Benchmarks should fail if a request returns a fatal result",
+			script: "package crossplane\n\ndeny[\"no\"] { true }\n",
+			run: func(ctx context.Context, f *Function, reqs []*fnv1beta1.RunFunctionRequest) error {
+				_, err := bench(ctx, f, reqs, 5, 2)
+				return err
+			},
+		},
+		"Profile": {
+			reason: "Profiling should fail if a request returns a fatal result",
+			script: "package crossplane\n\ndeny[\"no\"] { true }\n",
+			run: func(ctx context.Context, f *Function, reqs []*fnv1beta1.RunFunctionRequest) error {
+				_, err := profileRequests(ctx, f, reqs)
+				return err
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			in := resource.MustStructObject(&v1beta1.Input{
+				TypeMeta: inputTypeMeta,
+				Spec:     v1beta1.InputSpec{Scripts: map[string]string{"policy.rego": tc.script}},
+			})
+			reqs := []*fnv1beta1.RunFunctionRequest{{Meta: &fnv1beta1.RequestMeta{Tag: "a"}, Input: in}}
+			f := &Function{log: logging.NewNopLogger(), policies: newPolicyCache(1)}
+
+			want := `Function returned a fatal result for request "a": no`
+			if err := tc.run(context.Background(), f, reqs); err == nil || err.Error() != want {
+				t.Errorf("%s\nwant error %q, got %v", tc.reason, want, err)
+			}
+		})
+	}
+}
+
+func TestPercentiles(t *testing.T) {
+	d := make([]time.Duration, 0, 100)
+	for i := 100; i > 0; i-- {
+		d = append(d, time.Duration(i))
+	}
+	want := benchLatency{P50: 50, P95: 95, P99: 99}
+	if diff := cmp.Diff(want, percentiles(d)); diff != "" {
+		t.Errorf("percentiles(...): -want, +got:\n%s", diff)
+	}
+}
+
+func TestCompareBaseline(t *testing.T) {
+	report := func(p95 time.Duration) *benchReport { return &benchReport{Latency: benchLatency{P95: p95}} }
+
+	type args struct {
+		base *benchReport
+		r    *benchReport
+	}
+
+	cases := map[string]struct {
+		reason string
+		args   args
+		want   bool
+	}{
+		"Faster": {
+			reason: "Reports faster than the baseline should pass",
+			args:   args{base: report(100), r: report(50)},
+		},
+		"SlowerWithinLimit": {
+			reason: "Reports up to twice as slow as the baseline should pass",
+			args:   args{base: report(100), r: report(200)},
+		},
+		"TooSlow": {
+			reason: "Reports more than twice as slow as the baseline should fail",
+			args:   args{base: report(100), r: report(201)},
+			want:   true,
+		},
+		"EmptyBaseline": {
+			reason: "Baselines without a p95 latency should fail",
+			args:   args{base: report(0), r: report(50)},
+			want:   true,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			err := compareBaseline(tc.args.base, tc.args.r, 2)
+			if diff := cmp.Diff(tc.want, err != nil); diff != "" {
+				t.Errorf("%s\ncompareBaseline(...): -want error, +got error:\n%s\nerror: %v", tc.reason, diff, err)
+			}
+		})
+	}
+}
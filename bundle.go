@@ -0,0 +1,153 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/bundle"
+	"github.com/open-policy-agent/opa/keys"
+	"github.com/open-policy-agent/opa/loader"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+)
+
+// A verificationError indicates that a policy bundle could be loaded, but not
+// verified.
+type verificationError struct {
+	err error
+}
+
+func (e *verificationError) Error() string {
+	return e.err.Error()
+}
+
+func (e *verificationError) Unwrap() error {
+	return e.err
+}
+
+// loadBundle loads the OPA bundle at the supplied path, either a gzipped
+// tarball or a directory, as a policy library. If the supplied verification
+// config is not nil the bundle must be signed by one of its keys, and each of
+// its files must match its signature. A *verificationError is returned if it
+// doesn't.
+func loadBundle(path string, vc *bundle.VerificationConfig) (*library, error) {
+	l := loader.NewFileLoader().WithProcessAnnotation(true)
+	if vc != nil {
+		l = l.WithBundleVerificationConfig(vc)
+	}
+	b, err := l.AsBundle(path)
+	if err != nil && vc != nil {
+		// OPA doesn't tell verification errors from others, so we
+		// check whether the bundle loads without being verified.
+		if _, uerr := loader.NewFileLoader().WithSkipBundleVerification(true).AsBundle(path); uerr == nil {
+			err = &verificationError{err: err}
+		}
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot load policy bundle %q", path)
+	}
+	return libraryFromBundle(b, path)
+}
+
+// libraryFromBundle compiles the supplied bundle into a policy library. Module
+// names are made relative to the supplied base directory, if any. The revision
+// of the library is the one declared by the bundle manifest, or derived from
+// its content if none is.
+func libraryFromBundle(b *bundle.Bundle, base string) (*library, error) {
+	mods := make(map[string]*ast.Module, len(b.Modules))
+	raw := make(map[string][]byte, len(b.Modules))
+	for _, mf := range b.Modules {
+		name := mf.Path
+		if rel, err := filepath.Rel(base, name); err == nil && !strings.HasPrefix(rel, "..") {
+			name = rel
+		}
+		name = strings.TrimPrefix(filepath.ToSlash(name), "/")
+		mods[name] = mf.Parsed
+		raw[name] = mf.Raw
+	}
+
+	lib, err := newLibrary(mods, b.Data)
+	if err != nil {
+		return nil, err
+	}
+	lib.revision = b.Manifest.Revision
+	if lib.revision == "" {
+		if lib.revision, err = revision(raw, b.Data); err != nil {
+			return nil, err
+		}
+	}
+	return lib, nil
+}
+
+// A bundleVerification configures how bundle signatures are verified.
+type bundleVerification struct {
+	KeyDir    string `help:"Directory containing the keys used to verify policy bundle signatures, named after their key ID. Signatures are required if any key is configured." type:"path"`
+	Key       string `help:"Key used to verify policy bundle signatures, identified by --bundle-verification-key-id." env:"BUNDLE_VERIFICATION_KEY"`
+	KeyID     string `help:"ID of the key used to verify policy bundle signatures that don't specify one. Defaults to the only key if there's exactly one."`
+	Algorithm string `help:"Algorithm of the keys used to verify policy bundle signatures, e.g. RS256, ES256 or HS256." default:"RS256"`
+	Scope     string `help:"Scope policy bundle signatures must have, if any."`
+}
+
+// config returns the OPA verification config, or nil if no keys are configured.
+func (bv bundleVerification) config() (*bundle.VerificationConfig, error) {
+	ks := map[string]*bundle.KeyConfig{}
+	if bv.KeyDir != "" {
+		entries, err := os.ReadDir(bv.KeyDir)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot read bundle verification key directory %q", bv.KeyDir)
+		}
+		for _, e := range entries {
+			// Skip hidden files, such as the ..data directory of Secret
+			// volumes.
+			if e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+				continue
+			}
+			k, err := os.ReadFile(filepath.Join(bv.KeyDir, e.Name()))
+			if err != nil {
+				return nil, errors.Wrapf(err, "cannot read bundle verification key %q", e.Name())
+			}
+			id := strings.TrimSuffix(e.Name(), filepath.Ext(e.Name()))
+			if ks[id], err = bv.keyConfig(string(k)); err != nil {
+				return nil, errors.Wrapf(err, "invalid bundle verification key %q", e.Name())
+			}
+		}
+	}
+	if bv.Key != "" {
+		if bv.KeyID == "" {
+			return nil, errors.New("a key ID is required to use a bundle verification key")
+		}
+		k, err := bv.keyConfig(bv.Key)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid bundle verification key")
+		}
+		ks[bv.KeyID] = k
+	}
+	if len(ks) == 0 {
+		return nil, nil
+	}
+
+	id := bv.KeyID
+	if id == "" && len(ks) == 1 {
+		for k := range ks {
+			id = k
+		}
+	}
+	if _, ok := ks[id]; !ok {
+		return nil, errors.Errorf("unknown bundle verification key ID %q", id)
+	}
+
+	return bundle.NewVerificationConfig(ks, id, bv.Scope, nil), nil
+}
+
+func (bv bundleVerification) keyConfig(key string) (*bundle.KeyConfig, error) {
+	alg := bv.Algorithm
+	if alg == "" {
+		alg = "RS256"
+	}
+	if !keys.IsSupportedAlgorithm(alg) {
+		return nil, errors.Errorf("unsupported algorithm %q", alg)
+	}
+	return &bundle.KeyConfig{Key: key, Algorithm: alg, Scope: bv.Scope}, nil
+}
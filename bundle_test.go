@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/bundle"
+	"google.golang.org/protobuf/testing/protocmp"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+
+	"github.com/crossplane/function-sdk-go"
+	fnv1beta1 "github.com/crossplane/function-sdk-go/proto/v1beta1"
+	"github.com/crossplane/function-sdk-go/resource"
+
+	"github.com/crossplane/function-rego/input/v1beta1"
+)
+
+const testBundleModule = `package crossplane
+
+deny["bundle says no"] { true }
+`
+
+// writeTestBundle writes a bundle containing the supplied module to a tarball,
+// signing it with the supplied HMAC secret if any. The module is replaced with
+// tampered after signing, if supplied.
+func writeTestBundle(t *testing.T, module, secret, tampered string) string {
+	t.Helper()
+
+	b := bundle.Bundle{
+		Manifest: bundle.Manifest{Revision: "v1"},
+		Data:     map[string]any{},
+		Modules: []bundle.ModuleFile{{
+			URL:    "/policy.rego",
+			Path:   "/policy.rego",
+			Raw:    []byte(module),
+			Parsed: ast.MustParseModule(module),
+		}},
+	}
+	if secret != "" {
+		if err := b.GenerateSignature(bundle.NewSigningConfig(secret, "HS256", ""), "ci", false); err != nil {
+			t.Fatalf("b.GenerateSignature(...): %v", err)
+		}
+	}
+	if tampered != "" {
+		b.Modules[0].Raw = []byte(tampered)
+		b.Modules[0].Parsed = ast.MustParseModule(tampered)
+	}
+
+	path := filepath.Join(t.TempDir(), "bundle.tar.gz")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close() //nolint:errcheck // Only used in tests.
+	if err := bundle.NewWriter(f).DisableFormat(true).Write(b); err != nil {
+		t.Fatalf("bundle.NewWriter(...).Write(...): %v", err)
+	}
+	return path
+}
+
+func TestLoadBundle(t *testing.T) {
+	keyDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(keyDir, "ci.key"), []byte("s3cr3t"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	vc, err := bundleVerification{KeyDir: keyDir, Algorithm: "HS256"}.config()
+	if err != nil {
+		t.Fatalf("config(): %v", err)
+	}
+
+	type args struct {
+		path string
+		vc   *bundle.VerificationConfig
+	}
+	type want struct {
+		revision     string
+		err          string
+		verification bool
+	}
+
+	cases := map[string]struct {
+		reason string
+		args   args
+		want   want
+	}{
+		"Unverified": {
+			reason: "Bundles should be loaded without verification if no keys are configured",
+			args:   args{path: writeTestBundle(t, testBundleModule, "", "")},
+			want:   want{revision: "v1"},
+		},
+		"Signed": {
+			reason: "Bundles signed with a configured key should be loaded",
+			args:   args{path: writeTestBundle(t, testBundleModule, "s3cr3t", ""), vc: vc},
+			want:   want{revision: "v1"},
+		},
+		"Unsigned": {
+			reason: "Unsigned bundles should be refused if keys are configured",
+			args:   args{path: writeTestBundle(t, testBundleModule, "", ""), vc: vc},
+			want:   want{err: "bundle missing .signatures.json file", verification: true},
+		},
+		"SignedWithAnotherKey": {
+			reason: "Bundles signed with an unknown key should be refused",
+			args:   args{path: writeTestBundle(t, testBundleModule, "0th3r", ""), vc: vc},
+			want:   want{err: "failed to match hmac signature", verification: true},
+		},
+		"Missing": {
+			reason: "Bundles that can't be loaded at all should not be reported as failing verification",
+			args:   args{path: filepath.Join(t.TempDir(), "missing.tar.gz"), vc: vc},
+			want:   want{err: "no such file or directory"},
+		},
+		"Tampered": {
+			reason: "Bundles modified after being signed should be refused",
+			args:   args{path: writeTestBundle(t, testBundleModule, "s3cr3t", "package crossplane\n"), vc: vc},
+			want:   want{err: "digest mismatch", verification: true},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			lib, err := loadBundle(tc.args.path, tc.args.vc)
+			if tc.want.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.want.err) {
+					t.Errorf("%s\nloadBundle(...): want error containing %q, got %v", tc.reason, tc.want.err, err)
+				}
+				var ve *verificationError
+				if got := errors.As(err, &ve); got != tc.want.verification {
+					t.Errorf("%s\nloadBundle(...): want verification error %t, got %t", tc.reason, tc.want.verification, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("%s\nloadBundle(...): unexpected error: %v", tc.reason, err)
+			}
+			if diff := cmp.Diff(tc.want.revision, lib.revision); diff != "" {
+				t.Errorf("%s\nloadBundle(...): -want revision, +got revision:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestRunFunctionWithUnverifiedBundle(t *testing.T) {
+	log, err := function.NewLogger(true)
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+
+	vc, err := bundleVerification{Key: "s3cr3t", KeyID: "ci", Algorithm: "HS256"}.config()
+	if err != nil {
+		t.Fatalf("config(): %v", err)
+	}
+	_, err = loadBundle(writeTestBundle(t, testBundleModule, "s3cr3t", "package crossplane\n"), vc)
+	if err == nil {
+		t.Fatal("loadBundle(...): want error loading a tampered bundle")
+	}
+
+	f := &Function{log: log}
+	f.libraryFailed(err)
+
+	rsp, _ := f.RunFunction(context.Background(), &fnv1beta1.RunFunctionRequest{
+		Input: resource.MustStructObject(&v1beta1.Input{TypeMeta: inputTypeMeta}),
+	})
+	want := []*fnv1beta1.Result{{
+		Severity: fnv1beta1.Severity_SEVERITY_FATAL,
+		Message:  errors.Wrap(err, "cannot activate policy library").Error(),
+	}}
+	if diff := cmp.Diff(want, rsp.GetResults(), protocmp.Transform()); diff != "" {
+		t.Errorf("f.RunFunction(...): -want results, +got results:\n%s", diff)
+	}
+}
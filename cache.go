@@ -0,0 +1,137 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"sort"
+	"sync"
+)
+
+// A policyCache caches policies compiled from the scripts of Compositions, so
+// that they're only compiled once per policy library. The least recently used
+// policy is evicted once the cache is full.
+type policyCache struct {
+	size int
+
+	mu       sync.Mutex
+	policies *lru[policyKey, *policy]
+}
+
+// A policyKey identifies a compiled policy by the library it was compiled
+// with, if any, and the hash of its scripts.
+type policyKey struct {
+	lib     *library
+	scripts [sha256.Size]byte
+}
+
+func newPolicyCache(size int) *policyCache {
+	return &policyCache{size: size, policies: newLRU[policyKey, *policy](size)}
+}
+
+// compile the supplied scripts together with the supplied library, if any,
+// unless they were already. Reports whether the policy was already compiled.
+// Policies are not cached if the cache is nil.
+func (c *policyCache) compile(lib *library, scripts map[string]string) (*policy, bool, error) {
+	if lib != nil && len(scripts) == 0 {
+		// The library is compiled when it's loaded.
+		return lib.policy, true, nil
+	}
+	if c == nil || c.size <= 0 {
+		p, err := lib.compile(scripts)
+		return p, false, err
+	}
+
+	k := policyKey{lib: lib, scripts: hashScripts(scripts)}
+	c.mu.Lock()
+	if p, ok := c.policies.get(k); ok {
+		c.mu.Unlock()
+		return p, true, nil
+	}
+	c.mu.Unlock()
+
+	// Compile without holding the lock, since it can take a while. Concurrent
+	// misses compile the same policy more than once, which is harmless.
+	p, err := lib.compile(scripts)
+	if err != nil {
+		return nil, false, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cached, ok := c.policies.get(k); ok {
+		return cached, false, nil
+	}
+	c.policies.add(k, p)
+	return p, false, nil
+}
+
+// hashScripts returns a hash of the supplied scripts and their names.
+func hashScripts(scripts map[string]string) [sha256.Size]byte {
+	names := make([]string, 0, len(scripts))
+	for n := range scripts {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	h := sha256.New()
+	for _, n := range names {
+		// Separate names and scripts so that they can't be confused.
+		_, _ = h.Write([]byte(n))
+		_, _ = h.Write([]byte{0})
+		_, _ = h.Write([]byte(scripts[n]))
+		_, _ = h.Write([]byte{0})
+	}
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+// An lru maps keys to values, evicting the least recently used value once it
+// holds more than its size. An lru whose size isn't positive is unbounded. It
+// is not safe for concurrent use.
+type lru[K comparable, V any] struct {
+	size    int
+	order   *list.List
+	entries map[K]*list.Element
+}
+
+type lruEntry[K comparable, V any] struct {
+	key   K
+	value V
+}
+
+func newLRU[K comparable, V any](size int) *lru[K, V] {
+	return &lru[K, V]{size: size, order: list.New(), entries: map[K]*list.Element{}}
+}
+
+// get the value of the supplied key, marking it as the most recently used.
+func (c *lru[K, V]) get(k K) (V, bool) {
+	e, ok := c.entries[k]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*lruEntry[K, V]).value, true //nolint:forcetypeassert // Only entries are stored.
+}
+
+// add the supplied value under the supplied key, replacing any existing one,
+// and evict the least recently used values if the lru is full.
+func (c *lru[K, V]) add(k K, v V) {
+	if e, ok := c.entries[k]; ok {
+		e.Value.(*lruEntry[K, V]).value = v //nolint:forcetypeassert // Only entries are stored.
+		c.order.MoveToFront(e)
+		return
+	}
+	c.entries[k] = c.order.PushFront(&lruEntry[K, V]{key: k, value: v})
+	for c.size > 0 && c.order.Len() > c.size {
+		e := c.order.Back()
+		c.order.Remove(e)
+		delete(c.entries, e.Value.(*lruEntry[K, V]).key) //nolint:forcetypeassert // Only entries are stored.
+	}
+}
+
+// len returns the number of values in the lru.
+func (c *lru[K, V]) len() int {
+	return c.order.Len()
+}
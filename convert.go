@@ -0,0 +1,425 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"math"
+	"strconv"
+
+	"github.com/open-policy-agent/opa/ast"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+)
+
+// Converting protobuf messages to Rego values and back directly is much faster
+// than round-tripping them through JSON. Values are encoded like encoding/json
+// encodes the generated structs, which policies have always been evaluated
+// against, i.e. fields are named after their protobuf name, enums and 64-bit
+// integers are numbers, and structs are encoded like protojson does.
+
+// protoValue returns the supplied message as a Rego value.
+func protoValue(m protoreflect.Message) ast.Value {
+	switch m.Descriptor().FullName() {
+	case "google.protobuf.Struct":
+		return structValue(m.Interface().(*structpb.Struct)) //nolint:forcetypeassert // Known by its descriptor.
+	case "google.protobuf.Value":
+		return jsonValue(m.Interface().(*structpb.Value)) //nolint:forcetypeassert // Known by its descriptor.
+	case "google.protobuf.ListValue":
+		return listValue(m.Interface().(*structpb.ListValue)) //nolint:forcetypeassert // Known by its descriptor.
+	}
+	if m.Descriptor().ParentFile().Package() == "google.protobuf" {
+		// Other well-known types, e.g. durations, are rare enough not to
+		// bother.
+		return wellKnownValue(m)
+	}
+
+	obj := ast.NewObject()
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		obj.Insert(ast.StringTerm(fd.TextName()), ast.NewTerm(fieldValue(fd, v)))
+		return true
+	})
+	return obj
+}
+
+func wellKnownValue(m protoreflect.Message) ast.Value {
+	v, err := ast.InterfaceToValue(m.Interface())
+	if err != nil {
+		return ast.Null{}
+	}
+	return v
+}
+
+func fieldValue(fd protoreflect.FieldDescriptor, v protoreflect.Value) ast.Value {
+	switch {
+	case fd.IsList():
+		l := v.List()
+		terms := make([]*ast.Term, l.Len())
+		for i := range terms {
+			terms[i] = ast.NewTerm(singularValue(fd, l.Get(i)))
+		}
+		return ast.NewArray(terms...)
+	case fd.IsMap():
+		obj := ast.NewObject()
+		v.Map().Range(func(k protoreflect.MapKey, v protoreflect.Value) bool {
+			obj.Insert(ast.StringTerm(k.String()), ast.NewTerm(singularValue(fd.MapValue(), v)))
+			return true
+		})
+		return obj
+	}
+	return singularValue(fd, v)
+}
+
+func singularValue(fd protoreflect.FieldDescriptor, v protoreflect.Value) ast.Value {
+	switch fd.Kind() {
+	case protoreflect.BoolKind:
+		return ast.Boolean(v.Bool())
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		return ast.Number(strconv.FormatInt(v.Int(), 10))
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		return ast.Number(strconv.FormatUint(v.Uint(), 10))
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		return ast.Number(strconv.FormatInt(v.Int(), 10))
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		return ast.Number(strconv.FormatUint(v.Uint(), 10))
+	case protoreflect.FloatKind, protoreflect.DoubleKind:
+		return floatValue(v.Float())
+	case protoreflect.StringKind:
+		return ast.String(v.String())
+	case protoreflect.BytesKind:
+		return ast.String(base64.StdEncoding.EncodeToString(v.Bytes()))
+	case protoreflect.EnumKind:
+		return ast.Number(strconv.FormatInt(int64(v.Enum()), 10))
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		return protoValue(v.Message())
+	}
+	return ast.Null{}
+}
+
+func structValue(s *structpb.Struct) ast.Value {
+	obj := ast.NewObject()
+	for k, v := range s.GetFields() {
+		obj.Insert(ast.StringTerm(k), ast.NewTerm(jsonValue(v)))
+	}
+	return obj
+}
+
+func listValue(l *structpb.ListValue) ast.Value {
+	terms := make([]*ast.Term, len(l.GetValues()))
+	for i, v := range l.GetValues() {
+		terms[i] = ast.NewTerm(jsonValue(v))
+	}
+	return ast.NewArray(terms...)
+}
+
+func jsonValue(v *structpb.Value) ast.Value {
+	switch k := v.GetKind().(type) {
+	case *structpb.Value_BoolValue:
+		return ast.Boolean(k.BoolValue)
+	case *structpb.Value_NumberValue:
+		return floatValue(k.NumberValue)
+	case *structpb.Value_StringValue:
+		return ast.String(k.StringValue)
+	case *structpb.Value_StructValue:
+		return structValue(k.StructValue)
+	case *structpb.Value_ListValue:
+		return listValue(k.ListValue)
+	}
+	return ast.Null{}
+}
+
+// floatValue formats floats like protojson and encoding/json do.
+func floatValue(f float64) ast.Value {
+	switch {
+	case math.IsNaN(f):
+		return ast.String("NaN")
+	case math.IsInf(f, 1):
+		return ast.String("Infinity")
+	case math.IsInf(f, -1):
+		return ast.String("-Infinity")
+	}
+	format := byte('f')
+	if abs := math.Abs(f); abs != 0 && (abs < 1e-6 || abs >= 1e21) {
+		format = 'e'
+	}
+	return ast.Number(strconv.FormatFloat(f, format, -1, 64))
+}
+
+// setProto resets the supplied message, then sets it from the supplied value
+// of a Rego result binding, i.e. a value decoded from JSON with numbers as
+// json.Number, like protojson.Unmarshal does. Fields can be named after either
+// their JSON or their protobuf name.
+func setProto(m protoreflect.Message, v any) error {
+	proto.Reset(m.Interface())
+	return mergeProto(m, v)
+}
+
+func mergeProto(m protoreflect.Message, v any) error {
+	switch m.Descriptor().FullName() {
+	case "google.protobuf.Struct", "google.protobuf.Value", "google.protobuf.ListValue":
+		sv, err := structValueOf(v)
+		if err != nil {
+			return err
+		}
+		switch t := m.Interface().(type) {
+		case *structpb.Struct:
+			if sv.GetStructValue() == nil {
+				return errors.Errorf("expected an object, got %T", v)
+			}
+			t.Fields = sv.GetStructValue().GetFields()
+		case *structpb.ListValue:
+			if sv.GetListValue() == nil {
+				return errors.Errorf("expected an array, got %T", v)
+			}
+			t.Values = sv.GetListValue().GetValues()
+		case *structpb.Value:
+			t.Kind = sv.GetKind()
+		}
+		return nil
+	}
+	if m.Descriptor().ParentFile().Package() == "google.protobuf" {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		return protojson.Unmarshal(data, m.Interface())
+	}
+
+	obj, ok := v.(map[string]any)
+	if !ok {
+		return errors.Errorf("expected an object for %s, got %T", m.Descriptor().FullName(), v)
+	}
+	fields := m.Descriptor().Fields()
+	for name, fv := range obj {
+		fd := fields.ByJSONName(name)
+		if fd == nil {
+			fd = fields.ByTextName(name)
+		}
+		if fd == nil {
+			return errors.Errorf("unknown field %q of %s", name, m.Descriptor().FullName())
+		}
+		if fv == nil && (fd.IsList() || fd.IsMap() || fd.Message() == nil || fd.Message().FullName() != "google.protobuf.Value") {
+			// Like protojson, null means unset, except for values.
+			continue
+		}
+		if err := setField(m, fd, fv); err != nil {
+			return errors.Wrapf(err, "invalid field %q of %s", name, m.Descriptor().FullName())
+		}
+	}
+	return nil
+}
+
+func setField(m protoreflect.Message, fd protoreflect.FieldDescriptor, v any) error {
+	switch {
+	case fd.IsList():
+		items, ok := v.([]any)
+		if !ok {
+			return errors.Errorf("expected an array, got %T", v)
+		}
+		l := m.Mutable(fd).List()
+		for _, item := range items {
+			if fd.Message() != nil {
+				e := l.NewElement()
+				if err := mergeProto(e.Message(), item); err != nil {
+					return err
+				}
+				l.Append(e)
+				continue
+			}
+			pv, err := scalarValue(fd, item)
+			if err != nil {
+				return err
+			}
+			l.Append(pv)
+		}
+		return nil
+	case fd.IsMap():
+		entries, ok := v.(map[string]any)
+		if !ok {
+			return errors.Errorf("expected an object, got %T", v)
+		}
+		mp := m.Mutable(fd).Map()
+		for k, item := range entries {
+			key, err := scalarValue(fd.MapKey(), k)
+			if err != nil {
+				return errors.Wrapf(err, "invalid key %q", k)
+			}
+			if fd.MapValue().Message() != nil {
+				e := mp.NewValue()
+				if err := mergeProto(e.Message(), item); err != nil {
+					return errors.Wrapf(err, "invalid value of key %q", k)
+				}
+				mp.Set(key.MapKey(), e)
+				continue
+			}
+			pv, err := scalarValue(fd.MapValue(), item)
+			if err != nil {
+				return errors.Wrapf(err, "invalid value of key %q", k)
+			}
+			mp.Set(key.MapKey(), pv)
+		}
+		return nil
+	case fd.Message() != nil:
+		return mergeProto(m.Mutable(fd).Message(), v)
+	}
+	pv, err := scalarValue(fd, v)
+	if err != nil {
+		return err
+	}
+	m.Set(fd, pv)
+	return nil
+}
+
+func scalarValue(fd protoreflect.FieldDescriptor, v any) (protoreflect.Value, error) { //nolint:gocyclo // A switch over all kinds.
+	switch fd.Kind() {
+	case protoreflect.BoolKind:
+		switch b := v.(type) {
+		case bool:
+			return protoreflect.ValueOfBool(b), nil
+		case string:
+			// Map keys are always strings.
+			pb, err := strconv.ParseBool(b)
+			return protoreflect.ValueOfBool(pb), err
+		}
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		i, err := parseInt(v, 32)
+		return protoreflect.ValueOfInt32(int32(i)), err
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		i, err := parseInt(v, 64)
+		return protoreflect.ValueOfInt64(i), err
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		u, err := parseUint(v, 32)
+		return protoreflect.ValueOfUint32(uint32(u)), err
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		u, err := parseUint(v, 64)
+		return protoreflect.ValueOfUint64(u), err
+	case protoreflect.FloatKind:
+		f, err := parseFloat(v, 32)
+		return protoreflect.ValueOfFloat32(float32(f)), err
+	case protoreflect.DoubleKind:
+		f, err := parseFloat(v, 64)
+		return protoreflect.ValueOfFloat64(f), err
+	case protoreflect.StringKind:
+		if s, ok := v.(string); ok {
+			return protoreflect.ValueOfString(s), nil
+		}
+	case protoreflect.BytesKind:
+		if s, ok := v.(string); ok {
+			b, err := base64.StdEncoding.DecodeString(s)
+			if err != nil {
+				b, err = base64.URLEncoding.DecodeString(s)
+			}
+			return protoreflect.ValueOfBytes(b), err
+		}
+	case protoreflect.EnumKind:
+		if s, ok := v.(string); ok {
+			ev := fd.Enum().Values().ByName(protoreflect.Name(s))
+			if ev == nil {
+				return protoreflect.Value{}, errors.Errorf("unknown enum value %q of %s", s, fd.Enum().FullName())
+			}
+			return protoreflect.ValueOfEnum(ev.Number()), nil
+		}
+		i, err := parseInt(v, 32)
+		return protoreflect.ValueOfEnum(protoreflect.EnumNumber(i)), err
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+	}
+	return protoreflect.Value{}, errors.Errorf("unexpected %T for %s field", v, fd.Kind())
+}
+
+// numberString returns the supplied number, or quoted number, as a string.
+func numberString(v any) (string, error) {
+	switch n := v.(type) {
+	case json.Number:
+		return n.String(), nil
+	case string:
+		return n, nil
+	case float64:
+		return strconv.FormatFloat(n, 'f', -1, 64), nil
+	case int:
+		return strconv.Itoa(n), nil
+	}
+	return "", errors.Errorf("expected a number, got %T", v)
+}
+
+func parseInt(v any, bits int) (int64, error) {
+	s, err := numberString(v)
+	if err != nil {
+		return 0, err
+	}
+	i, err := strconv.ParseInt(s, 10, bits)
+	if err != nil {
+		// Integers can be in exponent notation, e.g. 1e3.
+		f, ferr := strconv.ParseFloat(s, 64)
+		if ferr != nil || f != math.Trunc(f) {
+			return 0, err
+		}
+		return strconv.ParseInt(strconv.FormatFloat(f, 'f', -1, 64), 10, bits)
+	}
+	return i, nil
+}
+
+func parseUint(v any, bits int) (uint64, error) {
+	s, err := numberString(v)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(s, 10, bits)
+}
+
+func parseFloat(v any, bits int) (float64, error) {
+	s, err := numberString(v)
+	if err != nil {
+		return 0, err
+	}
+	switch s {
+	case "NaN":
+		return math.NaN(), nil
+	case "Infinity":
+		return math.Inf(1), nil
+	case "-Infinity":
+		return math.Inf(-1), nil
+	}
+	return strconv.ParseFloat(s, bits)
+}
+
+// structValueOf returns the supplied value decoded from JSON as a
+// structpb.Value.
+func structValueOf(v any) (*structpb.Value, error) {
+	switch t := v.(type) {
+	case nil:
+		return structpb.NewNullValue(), nil
+	case bool:
+		return structpb.NewBoolValue(t), nil
+	case string:
+		return structpb.NewStringValue(t), nil
+	case json.Number:
+		f, err := t.Float64()
+		return structpb.NewNumberValue(f), err
+	case float64:
+		return structpb.NewNumberValue(t), nil
+	case map[string]any:
+		fields := make(map[string]*structpb.Value, len(t))
+		for k, v := range t {
+			sv, err := structValueOf(v)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid value of key %q", k)
+			}
+			fields[k] = sv
+		}
+		return structpb.NewStructValue(&structpb.Struct{Fields: fields}), nil
+	case []any:
+		values := make([]*structpb.Value, len(t))
+		for i, v := range t {
+			sv, err := structValueOf(v)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid value at index %d", i)
+			}
+			values[i] = sv
+		}
+		return structpb.NewListValue(&structpb.ListValue{Values: values}), nil
+	}
+	return nil, errors.Errorf("unexpected %T", v)
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/open-policy-agent/opa/ast"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/testing/protocmp"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	fnv1beta1 "github.com/crossplane/function-sdk-go/proto/v1beta1"
+	"github.com/crossplane/function-sdk-go/resource"
+)
+
+// testRequest returns a request with the supplied number of composed
+// resources.
+func testRequest(resources int) *fnv1beta1.RunFunctionRequest {
+	req := &fnv1beta1.RunFunctionRequest{
+		Meta: &fnv1beta1.RequestMeta{Tag: "hello"},
+		Observed: &fnv1beta1.State{
+			Composite: &fnv1beta1.Resource{
+				Resource:          resource.MustStructJSON(`{"apiVersion": "example.org/v1", "kind": "XR", "metadata": {"name": "xr"}, "spec": {"replicas": 3, "ratio": 0.5, "huge": 1e22, "tiny": 1e-7, "enabled": true, "nothing": null}}`),
+				ConnectionDetails: map[string][]byte{"password": []byte("s3cr3t")},
+			},
+			Resources: map[string]*fnv1beta1.Resource{},
+		},
+		Desired: &fnv1beta1.State{Resources: map[string]*fnv1beta1.Resource{}},
+	}
+	for i := 0; i < resources; i++ {
+		name := fmt.Sprintf("resource-%d", i)
+		r := resource.MustStructJSON(fmt.Sprintf(`{
+			"apiVersion": "s3.aws.upbound.io/v1beta1",
+			"kind": "Bucket",
+			"metadata": {"name": %q, "labels": {"owner": "team-a"}, "annotations": {"crossplane.io/composition-resource-name": %q}},
+			"spec": {"forProvider": {"region": "eu-west-1", "tags": [{"key": "env", "value": "prod"}], "versioning": {"enabled": true}, "retention": %d}}
+		}`, name, name, i))
+		req.Observed.Resources[name] = &fnv1beta1.Resource{Resource: r, ConnectionDetails: map[string][]byte{"endpoint": []byte(name)}}
+		req.Desired.Resources[name] = &fnv1beta1.Resource{Resource: r, Ready: fnv1beta1.Ready_READY_TRUE}
+	}
+	return req
+}
+
+func testResponse() *fnv1beta1.RunFunctionResponse {
+	return &fnv1beta1.RunFunctionResponse{
+		Meta: &fnv1beta1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(90 * time.Second)},
+		Desired: &fnv1beta1.State{
+			Composite: &fnv1beta1.Resource{Resource: resource.MustStructJSON(`{"status": {"ready": true, "count": 2}}`)},
+			Resources: map[string]*fnv1beta1.Resource{
+				"bucket": {Resource: resource.MustStructJSON(`{"spec": {"forProvider": {"region": "eu-west-1"}}}`), Ready: fnv1beta1.Ready_READY_FALSE},
+			},
+		},
+		Results: []*fnv1beta1.Result{
+			{Severity: fnv1beta1.Severity_SEVERITY_WARNING, Message: "careful"},
+			{Severity: fnv1beta1.Severity_SEVERITY_FATAL, Message: "stop"},
+		},
+	}
+}
+
+func TestProtoValue(t *testing.T) {
+	cases := map[string]struct {
+		reason string
+		m      proto.Message
+	}{
+		"Request": {
+			reason: "Requests should be encoded like encoding/json encodes them",
+			m:      testRequest(3),
+		},
+		"Response": {
+			reason: "Responses should be encoded like encoding/json encodes them",
+			m:      testResponse(),
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			// Policies were evaluated against inputs converted by OPA,
+			// using encoding/json.
+			want, err := ast.InterfaceToValue(tc.m)
+			if err != nil {
+				t.Fatalf("ast.InterfaceToValue(...): %v", err)
+			}
+			got := protoValue(tc.m.ProtoReflect())
+			if want.Compare(got) != 0 {
+				t.Errorf("%s\nprotoValue(...): want %s, got %s", tc.reason, want, got)
+			}
+		})
+	}
+}
+
+func TestProtoValueFieldNames(t *testing.T) {
+	req := &fnv1beta1.RunFunctionRequest{
+		Observed: &fnv1beta1.State{
+			Composite: &fnv1beta1.Resource{ConnectionDetails: map[string][]byte{"password": []byte("s3cr3t")}},
+		},
+		Desired: &fnv1beta1.State{
+			Resources: map[string]*fnv1beta1.Resource{"bucket": {Ready: fnv1beta1.Ready_READY_TRUE}},
+		},
+	}
+	want := ast.MustParseTerm(`{
+		"observed": {"composite": {"connection_details": {"password": "czNjcjN0"}}},
+		"desired": {"resources": {"bucket": {"ready": 1}}}
+	}`).Value
+	got := protoValue(req.ProtoReflect())
+	if want.Compare(got) != 0 {
+		t.Errorf("Fields should be named after their protobuf name, and enums encoded as numbers\nprotoValue(...): want %s, got %s", want, got)
+	}
+}
+
+func TestSetProto(t *testing.T) {
+	decode := func(s string) any {
+		d := json.NewDecoder(bytes.NewReader([]byte(s)))
+		d.UseNumber()
+		var v any
+		if err := d.Decode(&v); err != nil {
+			t.Fatalf("Decode(...): %v", err)
+		}
+		return v
+	}
+	protojsonData, err := protojson.Marshal(testResponse())
+	if err != nil {
+		t.Fatalf("protojson.Marshal(...): %v", err)
+	}
+
+	type want struct {
+		rsp *fnv1beta1.RunFunctionResponse
+		err bool
+	}
+
+	cases := map[string]struct {
+		reason string
+		v      any
+		want   want
+	}{
+		"ProtoJSON": {
+			reason: "Values encoded like protojson encodes them should be decoded",
+			v:      decode(string(protojsonData)),
+			want:   want{rsp: testResponse()},
+		},
+		"ProtoNames": {
+			reason: "Fields should also be decoded by their protobuf name, and enums by their number, like protojson does",
+			v:      decode(`{"meta": {"tag": "hello", "ttl": "60s"}, "results": [{"severity": 2, "message": "careful"}], "desired": {"resources": {"bucket": {"resource": {"a": 1}, "connection_details": {"password": "czNjcjN0"}}}}}`),
+			want: want{rsp: &fnv1beta1.RunFunctionResponse{
+				Meta:    &fnv1beta1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(time.Minute)},
+				Results: []*fnv1beta1.Result{{Severity: fnv1beta1.Severity_SEVERITY_WARNING, Message: "careful"}},
+				Desired: &fnv1beta1.State{Resources: map[string]*fnv1beta1.Resource{
+					"bucket": {Resource: resource.MustStructJSON(`{"a": 1}`), ConnectionDetails: map[string][]byte{"password": []byte("s3cr3t")}},
+				}},
+			}},
+		},
+		"Null": {
+			reason: "Null fields should be left unset",
+			v:      decode(`{"meta": null, "results": [{"message": "hi"}]}`),
+			want:   want{rsp: &fnv1beta1.RunFunctionResponse{Results: []*fnv1beta1.Result{{Message: "hi"}}}},
+		},
+		"UnknownField": {
+			reason: "Unknown fields should return an error",
+			v:      decode(`{"outcome": "fatal"}`),
+			want:   want{rsp: &fnv1beta1.RunFunctionResponse{}, err: true},
+		},
+		"UnknownEnum": {
+			reason: "Unknown enum values should return an error",
+			v:      decode(`{"results": [{"severity": "SEVERITY_CATASTROPHIC"}]}`),
+			want:   want{err: true},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			rsp := &fnv1beta1.RunFunctionResponse{Meta: &fnv1beta1.ResponseMeta{Tag: "previous"}}
+			err := setProto(rsp.ProtoReflect(), tc.v)
+			if diff := cmp.Diff(tc.want.err, err != nil); diff != "" {
+				t.Errorf("%s\nsetProto(...): -want error, +got error:\n%s\nerror: %v", tc.reason, diff, err)
+			}
+			if tc.want.rsp == nil {
+				return
+			}
+			if diff := cmp.Diff(tc.want.rsp, rsp, protocmp.Transform()); diff != "" {
+				t.Errorf("%s\nsetProto(...): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+// BenchmarkQueryInput compares converting the input of a query to a Rego value
+// directly to letting rego.EvalInput convert it, round-tripping it through
+// encoding/json.
+func BenchmarkQueryInput(b *testing.B) {
+	qi := queryInput{Request: testRequest(200), Response: testResponse()}
+
+	b.Run("RoundTrip", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := ast.InterfaceToValue(qi); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("Direct", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_ = qi.value()
+		}
+	})
+}
+
+// BenchmarkResponse compares setting a response from a Rego result binding
+// directly to round-tripping it through JSON.
+func BenchmarkResponse(b *testing.B) {
+	rsp := testRequest(200)
+	data, err := protojson.Marshal(&fnv1beta1.RunFunctionResponse{Desired: rsp.GetDesired(), Results: testResponse().GetResults()})
+	if err != nil {
+		b.Fatal(err)
+	}
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	var binding any
+	if err := d.Decode(&binding); err != nil {
+		b.Fatal(err)
+	}
+
+	b.Run("RoundTrip", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			out, err := json.Marshal(binding)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if err := protojson.Unmarshal(out, &fnv1beta1.RunFunctionResponse{}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("Direct", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if err := setProto((&fnv1beta1.RunFunctionResponse{}).ProtoReflect(), binding); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/structpb"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	kjson "sigs.k8s.io/json"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+
+	"github.com/crossplane/function-rego/input/v1beta1"
+)
+
+// An inputDecoder decodes a version of the Function's input, and converts it
+// to the version the Function uses.
+type inputDecoder func(data []byte) (*v1beta1.Input, error)
+
+// inputDecoders decode the supported versions of the Function's input, by
+// version. Support a newer version by adding a decoder for it, and converting
+// the older versions to it.
+type inputDecoders map[string]inputDecoder
+
+// supportedInputs are the versions of the Function's input it supports.
+var supportedInputs = inputDecoders{
+	v1beta1.Version: convertInput(func(in *v1beta1.Input) (*v1beta1.Input, error) { return in, nil }),
+}
+
+// convertInput returns a decoder that strictly decodes input of type T, and
+// converts it using the supplied function.
+func convertInput[T any](convert func(in *T) (*v1beta1.Input, error)) inputDecoder {
+	return func(data []byte) (*v1beta1.Input, error) {
+		in := new(T)
+		if err := decodeStrict(data, in); err != nil {
+			return nil, err
+		}
+		return convert(in)
+	}
+}
+
+// decode the supplied input. Input is optional, but if supplied it must be
+// one of the supported versions of the Function's input, and must not contain
+// unknown or duplicate fields.
+func (d inputDecoders) decode(s *structpb.Struct) (*v1beta1.Input, error) {
+	if s == nil {
+		return &v1beta1.Input{}, nil
+	}
+	data, err := protojson.Marshal(s)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot marshal input to JSON")
+	}
+
+	tm := &struct {
+		APIVersion string `json:"apiVersion"`
+		Kind       string `json:"kind"`
+	}{}
+	if err := kjson.UnmarshalCaseSensitivePreserveInts(data, tm); err != nil {
+		return nil, errors.Wrap(err, "cannot decode input type metadata")
+	}
+	gv, err := schema.ParseGroupVersion(tm.APIVersion)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid input apiVersion %q", tm.APIVersion)
+	}
+	if gv.Group != v1beta1.Group {
+		return nil, errors.Errorf("unsupported input apiVersion %q: group must be %q", tm.APIVersion, v1beta1.Group)
+	}
+	if tm.Kind != v1beta1.InputKind {
+		return nil, errors.Errorf("unsupported input kind %q: kind must be %q", tm.Kind, v1beta1.InputKind)
+	}
+	decode, ok := d[gv.Version]
+	if !ok {
+		return nil, errors.Errorf("unsupported input apiVersion %q: version must be one of %s", tm.APIVersion, strings.Join(d.versions(), ", "))
+	}
+	in, err := decode(data)
+	return in, errors.Wrapf(err, "cannot decode input %s", tm.APIVersion)
+}
+
+func (d inputDecoders) versions() []string {
+	v := make([]string, 0, len(d))
+	for version := range d {
+		v = append(v, version)
+	}
+	sort.Strings(v)
+	return v
+}
+
+// decodeStrict decodes the supplied JSON data into the supplied object,
+// returning an error naming the path of any unknown or duplicate field.
+func decodeStrict(data []byte, into any) error {
+	strict, err := kjson.UnmarshalStrict(data, into)
+	if err != nil {
+		return err
+	}
+	if len(strict) == 0 {
+		return nil
+	}
+	msgs := make([]string, len(strict))
+	for i, err := range strict {
+		msgs[i] = err.Error()
+	}
+	return errors.New(strings.Join(msgs, ", "))
+}
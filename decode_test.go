@@ -0,0 +1,146 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"google.golang.org/protobuf/types/known/structpb"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/crossplane/function-sdk-go/resource"
+
+	"github.com/crossplane/function-rego/input/v1beta1"
+)
+
+// inputTypeMeta is the type metadata of v1beta1 input.
+var inputTypeMeta = metav1.TypeMeta{APIVersion: v1beta1.GroupVersion.String(), Kind: v1beta1.InputKind}
+
+// A legacyInput is an older version of the Function's input, used to test
+// conversion.
+type legacyInput struct {
+	metav1.TypeMeta `json:",inline"`
+
+	Spec struct {
+		Policy string `json:"policy"`
+	} `json:"spec"`
+}
+
+func TestDecodeInput(t *testing.T) {
+	decoders := inputDecoders{
+		v1beta1.Version: supportedInputs[v1beta1.Version],
+		"v1alpha1": convertInput(func(in *legacyInput) (*v1beta1.Input, error) {
+			return &v1beta1.Input{
+				TypeMeta: inputTypeMeta,
+				Spec:     v1beta1.InputSpec{Scripts: map[string]string{"policy.rego": in.Spec.Policy}},
+			}, nil
+		}),
+	}
+
+	type want struct {
+		in  *v1beta1.Input
+		err string
+	}
+
+	cases := map[string]struct {
+		reason string
+		s      *structpb.Struct
+		want   want
+	}{
+		"NoInput": {
+			reason: "Input is optional",
+			want:   want{in: &v1beta1.Input{}},
+		},
+		"Valid": {
+			reason: "Known fields of a supported version should be decoded",
+			s: resource.MustStructJSON(`{
+				"apiVersion": "rego.fn.crossplane.io/v1beta1",
+				"kind": "Input",
+				"spec": {"scripts": {"policy.rego": "package crossplane"}}
+			}`),
+			want: want{in: &v1beta1.Input{
+				TypeMeta: inputTypeMeta,
+				Spec:     v1beta1.InputSpec{Scripts: map[string]string{"policy.rego": "package crossplane"}},
+			}},
+		},
+		"UnknownField": {
+			reason: "Unknown fields should be reported with their path",
+			s: resource.MustStructJSON(`{
+				"apiVersion": "rego.fn.crossplane.io/v1beta1",
+				"kind": "Input",
+				"spec": {"policy": "package crossplane"}
+			}`),
+			want: want{err: `cannot decode input rego.fn.crossplane.io/v1beta1: unknown field "spec.policy"`},
+		},
+		"NestedUnknownField": {
+			reason: "Unknown fields of nested objects should be reported with their path",
+			s: resource.MustStructJSON(`{
+				"apiVersion": "rego.fn.crossplane.io/v1beta1",
+				"kind": "Input",
+				"spec": {"source": {"git": {"repo": "https://example.org/policies.git", "ref": "main", "branch": "main"}}}
+			}`),
+			want: want{err: `cannot decode input rego.fn.crossplane.io/v1beta1: unknown field "spec.source.git.branch"`},
+		},
+		"WrongGroup": {
+			reason: "Input of another API group should be rejected",
+			s: resource.MustStructJSON(`{
+				"apiVersion": "template.fn.crossplane.io/v1beta1",
+				"kind": "Input"
+			}`),
+			want: want{err: `unsupported input apiVersion "template.fn.crossplane.io/v1beta1": group must be "rego.fn.crossplane.io"`},
+		},
+		"WrongKind": {
+			reason: "Input of another kind should be rejected",
+			s: resource.MustStructJSON(`{
+				"apiVersion": "rego.fn.crossplane.io/v1beta1",
+				"kind": "Policy"
+			}`),
+			want: want{err: `unsupported input kind "Policy": kind must be "Input"`},
+		},
+		"UnsupportedVersion": {
+			reason: "Input of an unsupported version should be rejected",
+			s: resource.MustStructJSON(`{
+				"apiVersion": "rego.fn.crossplane.io/v2",
+				"kind": "Input"
+			}`),
+			want: want{err: `unsupported input apiVersion "rego.fn.crossplane.io/v2": version must be one of v1alpha1, v1beta1`},
+		},
+		"ConvertedVersion": {
+			reason: "Input of an older version should be converted",
+			s: resource.MustStructJSON(`{
+				"apiVersion": "rego.fn.crossplane.io/v1alpha1",
+				"kind": "Input",
+				"spec": {"policy": "package crossplane"}
+			}`),
+			want: want{in: &v1beta1.Input{
+				TypeMeta: inputTypeMeta,
+				Spec:     v1beta1.InputSpec{Scripts: map[string]string{"policy.rego": "package crossplane"}},
+			}},
+		},
+		"ConvertedVersionUnknownField": {
+			reason: "Unknown fields of older versions should be reported too",
+			s: resource.MustStructJSON(`{
+				"apiVersion": "rego.fn.crossplane.io/v1alpha1",
+				"kind": "Input",
+				"spec": {"scripts": {"policy.rego": "package crossplane"}}
+			}`),
+			want: want{err: `cannot decode input rego.fn.crossplane.io/v1alpha1: unknown field "spec.scripts"`},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			in, err := decoders.decode(tc.s)
+			if diff := cmp.Diff(tc.want.in, in, cmpopts.EquateEmpty()); diff != "" {
+				t.Errorf("%s\ndecode(...): -want, +got:\n%s", tc.reason, diff)
+			}
+			got := ""
+			if err != nil {
+				got = err.Error()
+			}
+			if diff := cmp.Diff(tc.want.err, got); diff != "" {
+				t.Errorf("%s\ndecode(...): -want error, +got error:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	"github.com/crossplane/crossplane-runtime/pkg/fieldpath"
+
+	fnv1beta1 "github.com/crossplane/function-sdk-go/proto/v1beta1"
+)
+
+// maxSummaryPaths is the maximum number of changed field paths of a resource a
+// change summary lists.
+const maxSummaryPaths = 5
+
+// A stateDiff describes how a desired state differs from another.
+type stateDiff struct {
+	// Composite lists the changed field paths of the composite resource.
+	Composite []string
+
+	// Added, Removed and Modified list the names of the composed resources
+	// that were added, removed or modified, in order.
+	Added    []string
+	Removed  []string
+	Modified []string
+
+	// Paths lists the changed field paths of each modified composed
+	// resource, by name.
+	Paths map[string][]string
+}
+
+// diffState returns how the desired state that is differs from the one that was.
+func diffState(was, is *fnv1beta1.State) stateDiff {
+	d := stateDiff{
+		Composite: changedPaths(was.GetComposite(), is.GetComposite()),
+		Paths:     map[string][]string{},
+	}
+
+	wr, ir := was.GetResources(), is.GetResources()
+	for name, r := range ir {
+		w, ok := wr[name]
+		if !ok {
+			d.Added = append(d.Added, name)
+			continue
+		}
+		if p := changedPaths(w, r); len(p) > 0 {
+			d.Modified = append(d.Modified, name)
+			d.Paths[name] = p
+		}
+	}
+	for name := range wr {
+		if _, ok := ir[name]; !ok {
+			d.Removed = append(d.Removed, name)
+		}
+	}
+	sort.Strings(d.Added)
+	sort.Strings(d.Removed)
+	sort.Strings(d.Modified)
+	return d
+}
+
+// empty returns true if nothing changed.
+func (d stateDiff) empty() bool {
+	return len(d.Composite) == 0 && len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Modified) == 0
+}
+
+// String returns a concise summary of the changes, e.g. "composite resource:
+// status.ready; added: bucket; modified: db (spec.forProvider.size)".
+func (d stateDiff) String() string {
+	var parts []string
+	if len(d.Composite) > 0 {
+		parts = append(parts, "composite resource: "+summarizePaths(d.Composite))
+	}
+	if len(d.Added) > 0 {
+		parts = append(parts, "added: "+strings.Join(d.Added, ", "))
+	}
+	if len(d.Removed) > 0 {
+		parts = append(parts, "removed: "+strings.Join(d.Removed, ", "))
+	}
+	if len(d.Modified) > 0 {
+		m := make([]string, len(d.Modified))
+		for i, name := range d.Modified {
+			m[i] = fmt.Sprintf("%s (%s)", name, summarizePaths(d.Paths[name]))
+		}
+		parts = append(parts, "modified: "+strings.Join(m, ", "))
+	}
+	return strings.Join(parts, "; ")
+}
+
+func summarizePaths(paths []string) string {
+	if len(paths) <= maxSummaryPaths {
+		return strings.Join(paths, ", ")
+	}
+	return fmt.Sprintf("%s and %d more", strings.Join(paths[:maxSummaryPaths], ", "), len(paths)-maxSummaryPaths)
+}
+
+// changedPaths returns the sorted field paths at which the supplied resources
+// differ. Changes to the readiness and connection details of the resources are
+// reported as the (ready) and (connectionDetails) paths.
+func changedPaths(was, is *fnv1beta1.Resource) []string {
+	var paths []string
+	walkChanges(nil, objectValue(was.GetResource()), objectValue(is.GetResource()), func(p fieldpath.Segments) {
+		paths = append(paths, p.String())
+	})
+	if was.GetReady() != is.GetReady() {
+		paths = append(paths, "(ready)")
+	}
+	if len(changedFields(bytesValues(was.GetConnectionDetails()), bytesValues(is.GetConnectionDetails()))) > 0 {
+		paths = append(paths, "(connectionDetails)")
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// walkChanges calls the supplied function with the path of each leaf at which
+// the supplied values differ. Objects are compared field by field, and lists
+// of the same length element by element.
+func walkChanges(path fieldpath.Segments, was, is *structpb.Value, changed func(fieldpath.Segments)) {
+	wasObj, isObj := was.GetStructValue(), is.GetStructValue()
+	if wasObj != nil && isObj != nil {
+		for _, k := range changedFields(wasObj.GetFields(), isObj.GetFields()) {
+			walkChanges(append(path[:len(path):len(path)], fieldpath.Field(k)), wasObj.GetFields()[k], isObj.GetFields()[k], changed)
+		}
+		return
+	}
+	wasList, isList := was.GetListValue(), is.GetListValue()
+	if wasList != nil && isList != nil && len(wasList.GetValues()) == len(isList.GetValues()) {
+		for i := range isList.GetValues() {
+			walkChanges(append(path[:len(path):len(path)], fieldpath.Segment{Type: fieldpath.SegmentIndex, Index: uint(i)}), wasList.GetValues()[i], isList.GetValues()[i], changed)
+		}
+		return
+	}
+	if !proto.Equal(was, is) {
+		changed(path)
+	}
+}
+
+// objectValue returns the supplied object as a value, treating a nil object as
+// an empty one.
+func objectValue(s *structpb.Struct) *structpb.Value {
+	if s == nil {
+		s = &structpb.Struct{}
+	}
+	return structpb.NewStructValue(s)
+}
+
+// bytesValues returns the supplied connection details as proto values, so
+// they can be compared using changedFields.
+func bytesValues(cd map[string][]byte) map[string]*structpb.Value {
+	out := make(map[string]*structpb.Value, len(cd))
+	for k, v := range cd {
+		out[k] = structpb.NewStringValue(string(v))
+	}
+	return out
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	fnv1beta1 "github.com/crossplane/function-sdk-go/proto/v1beta1"
+	"github.com/crossplane/function-sdk-go/resource"
+)
+
+func TestDiffState(t *testing.T) {
+	state := func(composite string, resources map[string]string) *fnv1beta1.State {
+		s := &fnv1beta1.State{Resources: map[string]*fnv1beta1.Resource{}}
+		if composite != "" {
+			s.Composite = &fnv1beta1.Resource{Resource: resource.MustStructJSON(composite)}
+		}
+		for name, r := range resources {
+			s.Resources[name] = &fnv1beta1.Resource{Resource: resource.MustStructJSON(r)}
+		}
+		return s
+	}
+
+	cases := map[string]struct {
+		reason string
+		was    *fnv1beta1.State
+		is     *fnv1beta1.State
+		want   string
+	}{
+		"Unchanged": {
+			reason: "Identical states should not differ",
+			was:    state(`{"status": {"ready": true}}`, map[string]string{"bucket": `{"spec": {"region": "eu-west-1"}}`}),
+			is:     state(`{"status": {"ready": true}}`, map[string]string{"bucket": `{"spec": {"region": "eu-west-1"}}`}),
+		},
+		"Changed": {
+			reason: "Added, removed and modified composed resources should be listed with the changed paths of the composite and modified resources",
+			was: state("", map[string]string{
+				"bucket": `{"metadata": {"labels": {"owner": "a"}}, "spec": {"tags": [{"key": "env", "value": "dev"}], "region": "eu-west-1"}}`,
+				"db":     `{"spec": {"size": 10}}`,
+			}),
+			is: state(`{"status": {"ready": true}}`, map[string]string{
+				"bucket": `{"metadata": {"annotations": {"example.org/team": "b"}, "labels": {"owner": "b"}}, "spec": {"tags": [{"key": "env", "value": "prod"}]}}`,
+				"queue":  `{"spec": {}}`,
+			}),
+			want: "composite resource: status; added: queue; removed: db; modified: bucket (metadata.annotations, metadata.labels.owner, spec.region, spec.tags[0].value)",
+		},
+		"ManyPaths": {
+			reason: "Only the first changed paths of a resource should be listed",
+			was:    state("", map[string]string{"bucket": `{"spec": {"a": 1, "b": 1, "c": 1, "d": 1, "e": 1, "f": 1, "g": 1}}`}),
+			is:     state("", map[string]string{"bucket": `{"spec": {"a": 2, "b": 2, "c": 2, "d": 2, "e": 2, "f": 2, "g": 2}}`}),
+			want:   "modified: bucket (spec.a, spec.b, spec.c, spec.d, spec.e and 2 more)",
+		},
+		"Readiness": {
+			reason: "Changes to the readiness of composed resources should be listed",
+			was:    state("", map[string]string{"bucket": `{}`}),
+			is: &fnv1beta1.State{Resources: map[string]*fnv1beta1.Resource{
+				"bucket": {Resource: resource.MustStructJSON(`{}`), Ready: fnv1beta1.Ready_READY_TRUE},
+			}},
+			want: "modified: bucket ((ready))",
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			got := diffState(tc.was, tc.is).String()
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("%s\ndiffState(...): -want, +got:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
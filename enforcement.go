@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+
+	fnv1beta1 "github.com/crossplane/function-sdk-go/proto/v1beta1"
+	"github.com/crossplane/function-sdk-go/request"
+
+	"github.com/crossplane/function-rego/input/v1beta1"
+)
+
+// AnnotationKeyEnforcementAction is the annotation composite resources can use
+// to override the enforcement action, if allowed by the Composition.
+const AnnotationKeyEnforcementAction = "rego.fn.crossplane.io/enforcement-action"
+
+// enforcementAction returns the enforcement action to apply to the supplied
+// request, taking into account the override annotation of the observed
+// composite resource if the input allows it.
+func enforcementAction(req *fnv1beta1.RunFunctionRequest, in *v1beta1.InputSpec) (v1beta1.EnforcementAction, error) {
+	ea := in.EnforcementAction
+	if ea == "" {
+		ea = v1beta1.EnforcementActionDeny
+	}
+	if err := validEnforcementAction(ea); err != nil {
+		return "", err
+	}
+	if !in.AllowEnforcementActionOverride || req.GetObserved().GetComposite() == nil {
+		return ea, nil
+	}
+
+	xr, err := request.GetObservedCompositeResource(req)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot get observed composite resource")
+	}
+	o, ok := xr.Resource.GetAnnotations()[AnnotationKeyEnforcementAction]
+	if !ok {
+		return ea, nil
+	}
+	if err := validEnforcementAction(v1beta1.EnforcementAction(o)); err != nil {
+		return "", errors.Wrapf(err, "invalid %s annotation", AnnotationKeyEnforcementAction)
+	}
+	return v1beta1.EnforcementAction(o), nil
+}
+
+func validEnforcementAction(ea v1beta1.EnforcementAction) error {
+	switch ea {
+	case v1beta1.EnforcementActionDeny, v1beta1.EnforcementActionWarn, v1beta1.EnforcementActionDryRun:
+		return nil
+	}
+	return errors.Errorf("unknown enforcement action %q", ea)
+}
+
+// enforce applies the supplied enforcement action to the fatal results of the
+// response. Fatal results are downgraded to warnings by the warn action, and
+// only logged by the dryrun action. Either way the message is tagged with the
+// original severity.
+func (f *Function) enforce(rsp *fnv1beta1.RunFunctionResponse, ea v1beta1.EnforcementAction) {
+	if ea == v1beta1.EnforcementActionDeny {
+		return
+	}
+	results := make([]*fnv1beta1.Result, 0, len(rsp.GetResults()))
+	for _, r := range rsp.GetResults() {
+		if r.GetSeverity() != fnv1beta1.Severity_SEVERITY_FATAL {
+			results = append(results, r)
+			continue
+		}
+		msg := fmt.Sprintf("[%s, originally %s] %s", ea, r.GetSeverity(), r.GetMessage())
+		if ea == v1beta1.EnforcementActionDryRun {
+			f.log.Info("Dropping fatal result", "enforcementAction", ea, "message", msg)
+			continue
+		}
+		results = append(results, &fnv1beta1.Result{Severity: fnv1beta1.Severity_SEVERITY_WARNING, Message: msg})
+	}
+	rsp.Results = results
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/json"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+
+	fnv1beta1 "github.com/crossplane/function-sdk-go/proto/v1beta1"
+	"github.com/crossplane/function-sdk-go/request"
+
+	"github.com/crossplane/function-rego/input/v1beta1"
+)
+
+// AnnotationKeyExemptions is the annotation composite resources can use to
+// declare exemptions, as a JSON array of exemptions, if allowed by the
+// Composition.
+const AnnotationKeyExemptions = "rego.fn.crossplane.io/exemptions"
+
+// An exemption is a validated, unexpired v1beta1.Exemption.
+type exemption struct {
+	policyIDs     []string
+	justification string
+	expires       time.Time
+}
+
+// exempts returns true if the exemption applies to the supplied policy ID.
+func (e exemption) exempts(id string) bool {
+	for _, pid := range e.policyIDs {
+		if pid == id {
+			return true
+		}
+	}
+	return false
+}
+
+// exemptions returns the exemptions declared by the input and, if the input
+// allows it, by the observed composite resource that are active at the
+// supplied time. Exemptions that are malformed or expired are ignored. A fatal
+// result is returned for each malformed exemption, which is subject to the
+// enforcement action, and a warning for each expired one.
+func exemptions(req *fnv1beta1.RunFunctionRequest, in *v1beta1.InputSpec, now time.Time) ([]exemption, []*fnv1beta1.Result) {
+	var active []exemption
+	var problems []*fnv1beta1.Result
+	invalid := func(err error) {
+		problems = append(problems, &fnv1beta1.Result{Severity: fnv1beta1.Severity_SEVERITY_FATAL, Message: err.Error()})
+	}
+
+	add := func(source string, ex []v1beta1.Exemption) {
+		for i, e := range ex {
+			a, err := parseExemption(e)
+			if err != nil {
+				invalid(errors.Wrapf(err, "invalid exemption %d from %s", i, source))
+				continue
+			}
+			if !now.Before(a.expires) {
+				problems = append(problems, &fnv1beta1.Result{
+					Severity: fnv1beta1.Severity_SEVERITY_WARNING,
+					Message:  fmt.Sprintf("exemption %d from %s of %s expired at %s", i, source, strings.Join(a.policyIDs, ", "), e.Expires),
+				})
+				continue
+			}
+			active = append(active, a)
+		}
+	}
+
+	add("input", in.Exemptions)
+
+	if !in.AllowExemptionAnnotations || req.GetObserved().GetComposite() == nil {
+		return active, problems
+	}
+	xr, err := request.GetObservedCompositeResource(req)
+	if err != nil {
+		invalid(errors.Wrap(err, "cannot get observed composite resource"))
+		return active, problems
+	}
+	a, ok := xr.Resource.GetAnnotations()[AnnotationKeyExemptions]
+	if !ok {
+		return active, problems
+	}
+	ex := []v1beta1.Exemption{}
+	if err := json.Unmarshal([]byte(a), &ex); err != nil {
+		invalid(errors.Wrapf(err, "invalid %s annotation", AnnotationKeyExemptions))
+		return active, problems
+	}
+	add(fmt.Sprintf("annotation %s", AnnotationKeyExemptions), ex)
+
+	return active, problems
+}
+
+// parseExemption validates the supplied exemption, returning an error if it is
+// malformed.
+func parseExemption(e v1beta1.Exemption) (exemption, error) {
+	if len(e.PolicyIDs) == 0 {
+		return exemption{}, errors.New("no policy IDs supplied")
+	}
+	if e.Justification == "" {
+		return exemption{}, errors.New("no justification supplied")
+	}
+	exp, err := time.Parse(time.RFC3339, e.Expires)
+	if err != nil {
+		return exemption{}, errors.Wrap(err, "cannot parse expiry")
+	}
+	return exemption{policyIDs: e.PolicyIDs, justification: e.Justification, expires: exp}, nil
+}
+
+// exempt drops the results of exempted policies. It returns the remaining
+// results, and a warning noting each exemption that suppressed at least one of
+// them.
+func exempt(results []ruleResult, ex []exemption) ([]ruleResult, []*fnv1beta1.Result) {
+	if len(ex) == 0 {
+		return results, nil
+	}
+
+	suppressed := make([]map[string]bool, len(ex))
+	kept := make([]ruleResult, 0, len(results))
+	for _, r := range results {
+		i := exemptedBy(ex, r.policyID)
+		if i < 0 {
+			kept = append(kept, r)
+			continue
+		}
+		if suppressed[i] == nil {
+			suppressed[i] = map[string]bool{}
+		}
+		suppressed[i][r.policyID] = true
+	}
+
+	var notes []*fnv1beta1.Result
+	for i, s := range suppressed {
+		if s == nil {
+			continue
+		}
+		ids := make([]string, 0, len(s))
+		for id := range s {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		notes = append(notes, &fnv1beta1.Result{
+			Severity: fnv1beta1.Severity_SEVERITY_WARNING,
+			Message: fmt.Sprintf("results of policy %s suppressed by an exemption expiring at %s: %s",
+				strings.Join(ids, ", "), ex[i].expires.Format(time.RFC3339), ex[i].justification),
+		})
+	}
+	return kept, notes
+}
+
+// exemptedBy returns the index of the first exemption applying to the supplied
+// policy ID, or -1 if none does. Results without a policy ID are never exempted.
+func exemptedBy(ex []exemption, id string) int {
+	if id == "" {
+		return -1
+	}
+	for i, e := range ex {
+		if e.exempts(id) {
+			return i
+		}
+	}
+	return -1
+}
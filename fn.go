@@ -2,16 +2,21 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"reflect"
+	"sync/atomic"
+	"time"
 
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/profiler"
 	"github.com/open-policy-agent/opa/rego"
-	"google.golang.org/protobuf/encoding/protojson"
-	"k8s.io/apimachinery/pkg/util/json"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/protobuf/proto"
 
 	"github.com/crossplane/crossplane-runtime/pkg/errors"
 	"github.com/crossplane/crossplane-runtime/pkg/logging"
 
 	fnv1beta1 "github.com/crossplane/function-sdk-go/proto/v1beta1"
-	"github.com/crossplane/function-sdk-go/request"
 	"github.com/crossplane/function-sdk-go/response"
 
 	"github.com/crossplane/function-rego/input/v1beta1"
@@ -22,17 +27,108 @@ type Function struct {
 	fnv1beta1.UnimplementedFunctionRunnerServiceServer
 
 	log logging.Logger
+
+	// debug is true if debug logs are emitted.
+	debug bool
+
+	// library of Rego modules shared by all Compositions, if any.
+	library atomic.Pointer[library]
+
+	// libraryErr explains why the latest policy library could not be
+	// activated, if it couldn't.
+	libraryErr atomic.Pointer[error]
+
+	// libraryPending is true while the configured policy library is being
+	// loaded for the first time. Requests fail until it is loaded, rather
+	// than being evaluated without it.
+	libraryPending atomic.Bool
+
+	// oci loads the policy bundles of Compositions specifying an OCI source.
+	oci *ociSource
+
+	// git loads the policies of Compositions specifying a git source.
+	git *gitSource
+
+	// policies caches compiled policies, if not nil.
+	policies *policyCache
+
+	// tracer traces each run of the Function, if not nil.
+	tracer trace.Tracer
+
+	// profileTop is the number of expressions logged when an Input enables
+	// profiling.
+	profileTop int
+
+	// profiler profiles every evaluation, if not nil. It must not be used
+	// by concurrent evaluations.
+	profiler *profiler.Profiler
+
+	// resourceWorkers is the maximum number of composed resources a request
+	// evaluates concurrently, when evaluating the policy per resource.
+	resourceWorkers int
+
+	// minTTL and maxTTL bound the TTL policies can set. maxTTL is unbounded
+	// if zero.
+	minTTL time.Duration
+	maxTTL time.Duration
+
+	// schemas against which desired composed resources are validated, if
+	// not nil.
+	schemas *schemaIndex
 }
 
 type queryInput struct {
 	Request  *fnv1beta1.RunFunctionRequest  `json:"request"`
 	Response *fnv1beta1.RunFunctionResponse `json:"response"`
+	Source   *querySource                   `json:"source,omitempty"`
+	Meta     *queryMeta                     `json:"meta,omitempty"`
+}
+
+// value returns the query input as a Rego value.
+func (qi queryInput) value() ast.Value {
+	obj := ast.NewObject(
+		ast.Item(ast.StringTerm("request"), ast.NewTerm(protoValue(qi.Request.ProtoReflect()))),
+		ast.Item(ast.StringTerm("response"), ast.NewTerm(protoValue(qi.Response.ProtoReflect()))),
+	)
+	if qi.Source != nil {
+		obj.Insert(ast.StringTerm("source"), ast.NewTerm(qi.Source.value()))
+	}
+	if qi.Meta != nil {
+		obj.Insert(ast.StringTerm("meta"), ast.NewTerm(qi.Meta.value()))
+	}
+	return obj
+}
+
+// querySource describes the source the policy bundle was loaded from, if any.
+type querySource struct {
+	// Digest of the OCI artifact.
+	Digest string `json:"digest,omitempty"`
+
+	// Commit of the git repository.
+	Commit string `json:"commit,omitempty"`
+}
+
+// value returns the query source as a Rego value.
+func (s *querySource) value() ast.Value {
+	obj := ast.NewObject()
+	if s.Digest != "" {
+		obj.Insert(ast.StringTerm("digest"), ast.StringTerm(s.Digest))
+	}
+	if s.Commit != "" {
+		obj.Insert(ast.StringTerm("commit"), ast.StringTerm(s.Commit))
+	}
+	return obj
 }
 
 // RunFunction runs the Function.
 func (f *Function) RunFunction(ctx context.Context, req *fnv1beta1.RunFunctionRequest) (*fnv1beta1.RunFunctionResponse, error) {
 	f.log.Info("Running Function", "tag", req.GetMeta().GetTag())
 
+	tracer := f.tracer
+	if tracer == nil {
+		tracer = trace.NewNoopTracerProvider().Tracer(tracerName)
+	}
+
 	// This creates a new response to the supplied request. Note that Functions
 	// are run in a pipeline! Other Functions may have run before this one. If
 	// they did, response.To will copy their desired state from req to rsp. Be
@@ -43,56 +139,439 @@ func (f *Function) RunFunction(ctx context.Context, req *fnv1beta1.RunFunctionRe
 	rsp.Meta = nil
 	defer func() { rsp.Meta = meta }()
 
+	ctx, root := tracer.Start(ctx, "RunFunction", trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(attrTag.String(req.GetMeta().GetTag())))
+	defer func() { endSpan(root, fatalResult(rsp)) }()
+
 	// Input is supplied by the author of a Composition when they choose to run
 	// your Function. Input is arbitrary, except that it must be a KRM-like
 	// object. Supporting input is also optional - if you don't need to you can
 	// delete this, and delete the input directory.
-	in := &v1beta1.Input{}
-	if err := request.GetInput(req, in); err != nil {
+	_, span := tracer.Start(ctx, "DecodeInput")
+	in, err := supportedInputs.decode(req.GetInput())
+	endSpan(span, err)
+	if err != nil {
 		response.Fatal(rsp, errors.Wrapf(err, "cannot get Function input from %T", req))
 		return rsp, nil
 	}
 
-	if len(in.Spec.Scripts) == 0 {
+	lctx, span := tracer.Start(ctx, "LoadPolicies")
+	lib, err := f.policyLibrary(lctx, in.Spec.Source)
+	endSpan(span, err)
+	if err != nil {
+		response.Fatal(rsp, err)
+		return rsp, nil
+	}
+
+	if len(in.Spec.Scripts) == 0 && lib == nil && in.Spec.Gatekeeper == nil {
 		response.Fatal(rsp, errors.New("no scripts supplied"))
 		return rsp, nil
 	}
 
-	opts := []func(*rego.Rego){
-		rego.Query("response = data.crossplane.response"),
+	// Inputs evaluating Gatekeeper constraints don't require a policy, so a
+	// library of helper packages doesn't make them fail.
+	runPolicy := len(in.Spec.Scripts) > 0 || lib.definesPolicy() || (lib != nil && in.Spec.Gatekeeper == nil)
+
+	_, span = tracer.Start(ctx, "ValidateInput")
+	err = validateInput(&in.Spec, lib, runPolicy)
+	var ea v1beta1.EnforcementAction
+	if err == nil {
+		ea, err = enforcementAction(req, &in.Spec)
+		err = errors.Wrap(err, "cannot determine enforcement action")
+	}
+	ex, exProblems := exemptions(req, &in.Spec, time.Now())
+	endSpan(span, err)
+	if err != nil {
+		response.Fatal(rsp, err)
+		return rsp, nil
+	}
+
+	var results []ruleResult
+	if runPolicy {
+		r, err := f.runPolicy(ctx, tracer, lib, in, req, rsp, meta)
+		var ee *evaluationError
+		switch {
+		case errors.As(err, &ee) && in.Spec.FailurePolicy == v1beta1.FailurePolicyIgnore:
+			// The policy may have modified the response, or its TTL, before
+			// failing. Drop its output, but run the rest of the pipeline.
+			f.log.Info("Ignoring policy evaluation error", "tag", req.GetMeta().GetTag(), "stage", ee.stage, "error", ee.err)
+			passed := response.To(req, response.DefaultTTL)
+			meta.Ttl = passed.GetMeta().GetTtl()
+			passed.Meta = nil
+			proto.Reset(rsp)
+			proto.Merge(rsp, passed)
+			response.Warning(rsp, errors.Wrap(err, "ignoring policy evaluation error"))
+		case err != nil:
+			response.Fatal(rsp, err)
+			return rsp, nil
+		default:
+			results = append(results, r...)
+		}
+	}
+
+	if in.Spec.Gatekeeper != nil {
+		gctx, span := tracer.Start(ctx, "EvaluateConstraints")
+		r, err := f.evaluateConstraints(gctx, in.Spec.Gatekeeper, req)
+		endSpan(span, err)
+		if err != nil {
+			response.Fatal(rsp, errors.Wrap(err, "cannot evaluate Gatekeeper constraints"))
+			return rsp, nil
+		}
+		results = append(results, r...)
+	}
+
+	results, notes := exempt(results, ex)
+	for _, r := range results {
+		rsp.Results = append(rsp.Results, r.result)
 	}
-	for n, s := range in.Spec.Scripts {
-		opts = append(opts, rego.Module(n, s))
+	rsp.Results = append(rsp.Results, exProblems...)
+	f.enforce(rsp, ea)
+
+	// Schema validation results aren't subject to the enforcement action of
+	// the policy, nor to exemptions.
+	if f.schemas != nil {
+		_, span := tracer.Start(ctx, "ValidateSchemas")
+		rsp.Results = append(rsp.Results, f.validateSchemas(rsp, in.Spec.SchemaValidationAction)...)
+		endSpan(span, nil)
+	}
+
+	// Diffing large desired states isn't free, so only do it if the change
+	// summary is going to be used.
+	if in.Spec.ChangeSummary || f.debug {
+		_, span := tracer.Start(ctx, "DiffDesiredState")
+		if d := diffState(req.GetDesired(), rsp.GetDesired()); !d.empty() {
+			changes := d.String()
+			f.log.Debug("Changed desired state", "tag", req.GetMeta().GetTag(), "changes", changes)
+			if in.Spec.ChangeSummary {
+				response.Normal(rsp, "changed desired state: "+changes)
+			}
+		}
+		span.End()
 	}
 
-	q, err := rego.New(opts...).PrepareForEval(ctx)
+	rsp.Results = append(rsp.Results, notes...)
+
+	return rsp, nil
+}
+
+// runPolicy compiles and evaluates the scripts of the supplied input together
+// with the supplied library, if any. The response returned by the policy, if
+// any, is merged into the supplied one, and the TTL it returns, if any, set in
+// the supplied response meta, while the results of its deny and warn rules are
+// returned.
+func (f *Function) runPolicy(ctx context.Context, tracer trace.Tracer, lib *library, in *v1beta1.Input, req *fnv1beta1.RunFunctionRequest, rsp *fnv1beta1.RunFunctionResponse, rspMeta *fnv1beta1.ResponseMeta) ([]ruleResult, error) {
+	_, span := tracer.Start(ctx, "Compile")
+	p, hit, err := f.policies.compile(lib, in.Spec.Scripts)
+	span.SetAttributes(attrCacheHit.Bool(hit))
+	endSpan(span, err)
 	if err != nil {
-		response.Fatal(rsp, errors.Wrap(err, "cannot prepare rego query"))
-		return rsp, nil
+		return nil, &evaluationError{stage: stagePrepare, err: errors.Wrap(err, "cannot compile rego policy")}
+	}
+
+	mode := in.Spec.Mode
+	if mode == "" {
+		mode = v1beta1.EvaluationModeRequest
 	}
 
-	rs, err := q.Eval(ctx, rego.EvalInput(queryInput{Request: req, Response: rsp}))
+	prof := f.profiler
+	if prof == nil && in.Spec.Profile {
+		prof = profiler.New()
+		defer f.logProfile(req.GetMeta().GetTag(), prof, f.profileTop)
+	}
 
+	var src *querySource
+	if lib != nil {
+		src = lib.source
+	}
+	meta := newQueryMeta(req, lib, time.Now())
+
+	ectx, span := tracer.Start(ctx, "Evaluate")
+	q, err := p.prepare(ectx, lib.options()...)
 	if err != nil {
-		response.Fatal(rsp, errors.Wrap(err, "cannot evaluate rego query"))
-		return rsp, nil
+		err = errors.Wrap(err, "cannot prepare rego query")
+		endSpan(span, err)
+		return nil, &evaluationError{stage: stagePrepare, err: err}
+	}
+	if mode != v1beta1.EvaluationModeRequest {
+		results, err := f.evaluateResources(ectx, q, p, resourceInputs(mode, req, src, meta), prof)
+		endSpan(span, err)
+		if err != nil {
+			return nil, &evaluationError{stage: stageEvaluate, err: err}
+		}
+		return results, nil
+	}
+	b, err := evaluate(ectx, q, queryInput{Request: req, Response: rsp, Source: src, Meta: meta}.value(), prof)
+	endSpan(span, err)
+	if err != nil {
+		return nil, &evaluationError{stage: stageEvaluate, err: err}
 	}
 
-	if len(rs) != 1 {
-		response.Fatal(rsp, errors.Errorf("expected a single result from rego query, got %d", len(rs)))
-		return rsp, nil
+	_, span = tracer.Start(ctx, "ConvertOutput")
+	defer span.End()
+
+	results := p.results(b)
+	discarded := false
+	if p.hasResponse {
+		r, d, err := f.convertResponse(in, req, rsp, b[responseRule])
+		if err != nil {
+			return nil, &evaluationError{stage: stageConvert, err: err}
+		}
+		results = append(results, r...)
+		discarded = d
+	}
+	// The TTL is part of the response, so it's discarded with it.
+	if p.hasTTL && !discarded {
+		r, err := f.setTTL(rspMeta, b[ttlRule])
+		if err != nil {
+			return nil, &evaluationError{stage: stageConvert, err: err}
+		}
+		results = append(results, r...)
+	}
+
+	return results, nil
+}
+
+// validateInput returns an error if the supplied input is invalid, e.g. if it
+// uses an unknown enum value, or if runPolicy is true and the policy defined by
+// the input's scripts and the supplied library, if any, defines no rule the
+// Function uses. It doesn't compile the policy, so that inputs are validated
+// whether or not it compiles.
+func validateInput(in *v1beta1.InputSpec, lib *library, runPolicy bool) error {
+	switch in.Mode {
+	case "", v1beta1.EvaluationModeRequest, v1beta1.EvaluationModeDesiredResources, v1beta1.EvaluationModeObservedResources:
+	default:
+		return errors.Errorf("unknown evaluation mode %q", in.Mode)
+	}
+	switch in.OutputValidation {
+	case "", v1beta1.OutputValidationStrict, v1beta1.OutputValidationLenient:
+	default:
+		return errors.Errorf("unknown output validation %q", in.OutputValidation)
+	}
+	switch in.OnUndefined {
+	case "", v1beta1.UndefinedActionPassThrough, v1beta1.UndefinedActionFatal, v1beta1.UndefinedActionWarn:
+	default:
+		return errors.Errorf("unknown undefined action %q", in.OnUndefined)
+	}
+	switch in.OnMultipleResults {
+	case "", v1beta1.MultipleResultsFail, v1beta1.MultipleResultsMerge, v1beta1.MultipleResultsFirst:
+	default:
+		return errors.Errorf("unknown multiple results strategy %q", in.OnMultipleResults)
 	}
+	switch in.FailurePolicy {
+	case "", v1beta1.FailurePolicyFail, v1beta1.FailurePolicyIgnore:
+	default:
+		return errors.Errorf("unknown failure policy %q", in.FailurePolicy)
+	}
+	if sva := in.SchemaValidationAction; sva != "" {
+		if err := validEnforcementAction(sva); err != nil {
+			return errors.Wrap(err, "invalid schema validation action")
+		}
+	}
+
+	if !runPolicy {
+		return nil
+	}
+	rules, ok := policyRules(lib, in.Scripts)
+	if !ok {
+		// Compiling the policy reports why its scripts can't be parsed.
+		return nil
+	}
+	if !rules[responseRule] && !rules[denyRule] && !rules[warnRule] && !rules[ttlRule] {
+		return errors.Errorf("policy must define at least one of the %s, %s, %s or %s rules in package %s", responseRule, denyRule, warnRule, ttlRule, policyPackage)
+	}
+	if in.Mode == v1beta1.EvaluationModeDesiredResources || in.Mode == v1beta1.EvaluationModeObservedResources {
+		for _, r := range []string{responseRule, ttlRule} {
+			if rules[r] {
+				return errors.Errorf("the %s rule is not supported in the %s mode", r, in.Mode)
+			}
+		}
+	}
+	return nil
+}
 
-	resp := rs[0].Bindings["response"]
-	out, err := json.Marshal(resp)
+// policyRules returns the names of the rules the supplied library and scripts
+// define in the policy package. It returns false if a script can't be parsed.
+func policyRules(lib *library, scripts map[string]string) (map[string]bool, bool) {
+	rules := map[string]bool{}
+	add := func(m *ast.Module) {
+		if !m.Package.Path.Equal(policyPackagePath()) {
+			return
+		}
+		for _, r := range m.Rules {
+			if ref := r.Head.Ref(); len(ref) == 1 {
+				rules[ref[0].String()] = true
+			}
+		}
+	}
+	if lib != nil {
+		for _, m := range lib.modules {
+			add(m)
+		}
+	}
+	for n, src := range scripts {
+		m, err := ast.ParseModule(n, src)
+		if err != nil || m == nil {
+			return nil, false
+		}
+		add(m)
+	}
+	return rules, true
+}
+
+// convertResponse merges the supplied value of the response rule into the
+// supplied response, returning a result for each problem with it, and whether
+// strict output validation discarded it.
+func (f *Function) convertResponse(in *v1beta1.Input, req *fnv1beta1.RunFunctionRequest, rsp *fnv1beta1.RunFunctionResponse, binding any) ([]ruleResult, bool, error) {
+	// The response rule is bound to an array holding its value, if defined,
+	// or to the set of its values if it's a partial set rule.
+	values, _ := binding.([]any)
+	if len(values) == 0 {
+		msg := fmt.Sprintf("the %s rule is undefined", responseRule)
+		switch in.Spec.OnUndefined {
+		case v1beta1.UndefinedActionFatal:
+			return []ruleResult{{result: &fnv1beta1.Result{Severity: fnv1beta1.Severity_SEVERITY_FATAL, Message: msg}}}, false, nil
+		case v1beta1.UndefinedActionWarn:
+			return []ruleResult{{result: &fnv1beta1.Result{Severity: fnv1beta1.Severity_SEVERITY_WARNING, Message: msg + ", passing the response through"}}}, false, nil
+		default:
+			f.log.Debug("Passing the response through", "tag", req.GetMeta().GetTag(), "reason", msg)
+			return nil, false, nil
+		}
+	}
+	value := values[0]
+	switch in.Spec.OnMultipleResults {
+	case v1beta1.MultipleResultsFirst:
+	case v1beta1.MultipleResultsMerge:
+		for _, v := range values[1:] {
+			var err error
+			if value, err = mergeValues(value, v); err != nil {
+				return nil, false, errors.Wrapf(err, "cannot merge values of the %s rule", responseRule)
+			}
+		}
+	default:
+		if len(values) > 1 {
+			return nil, false, errors.Errorf("the %s rule has %d values, expected one", responseRule, len(values))
+		}
+	}
+
+	original := proto.Clone(rsp).(*fnv1beta1.RunFunctionResponse)
+	if err := setProto(rsp.ProtoReflect(), value); err != nil {
+		return nil, false, errors.Wrap(err, "cannot convert rego result into RunFunctionResponse")
+	}
+	problems := validateOutput(original, rsp)
+	severity := fnv1beta1.Severity_SEVERITY_WARNING
+	discarded := len(problems) > 0 && in.Spec.OutputValidation == v1beta1.OutputValidationStrict
+	if discarded {
+		// Strict validation discards the whole response.
+		proto.Reset(rsp)
+		proto.Merge(rsp, original)
+		severity = fnv1beta1.Severity_SEVERITY_FATAL
+	}
+	results := make([]ruleResult, len(problems))
+	for i, problem := range problems {
+		results[i] = ruleResult{result: &fnv1beta1.Result{Severity: severity, Message: "invalid response: " + problem}}
+	}
+	return results, discarded, nil
+}
+
+// Stages of the evaluation of a policy that may fail.
+const (
+	stagePrepare  = "prepare"
+	stageEvaluate = "evaluate"
+	stageConvert  = "convert output"
+)
+
+// An evaluationError is an error evaluating a policy, as opposed to an error in
+// its configuration.
+type evaluationError struct {
+	stage string
+	err   error
+}
+
+func (e *evaluationError) Error() string {
+	return fmt.Sprintf("%s stage failed: %s", e.stage, e.err)
+}
+
+func (e *evaluationError) Unwrap() error {
+	return e.err
+}
+
+// evaluate the supplied prepared query against the supplied input, returning
+// the bindings of its result. The query binds every rule it evaluates to a
+// value, so it's expected to return a single result. The evaluation is
+// profiled using the supplied profiler, if any.
+func evaluate(ctx context.Context, q rego.PreparedEvalQuery, input ast.Value, prof *profiler.Profiler) (rego.Vars, error) {
+	opts := []rego.EvalOption{rego.EvalParsedInput(input)}
+	if prof != nil {
+		opts = append(opts, rego.EvalQueryTracer(prof))
+	}
+	rs, err := q.Eval(ctx, opts...)
 	if err != nil {
-		response.Fatal(rsp, errors.Wrap(err, "cannot marshal rego result"))
-		return rsp, nil
+		return nil, errors.Wrap(err, "cannot evaluate rego query")
 	}
-	if err := protojson.Unmarshal(out, rsp); err != nil {
-		response.Fatal(rsp, errors.Wrapf(err, "cannot unmarshal rego result into RunFunctionResponse: %s", out))
-		return rsp, nil
+	if len(rs) != 1 {
+		return nil, errors.Errorf("expected a single result from rego query, got %d", len(rs))
 	}
+	return rs[0].Bindings, nil
+}
 
-	return rsp, nil
+// mergeValues merges the supplied JSON values. Arrays, including sets, are
+// concatenated and objects merged recursively. Other values must be equal.
+func mergeValues(a, b any) (any, error) {
+	if a == nil {
+		return b, nil
+	}
+	switch at := a.(type) {
+	case []any:
+		if bt, ok := b.([]any); ok {
+			return append(at[:len(at):len(at)], bt...), nil
+		}
+	case map[string]any:
+		if bt, ok := b.(map[string]any); ok {
+			out := make(map[string]any, len(at)+len(bt))
+			for k, v := range at {
+				out[k] = v
+			}
+			for k, v := range bt {
+				m, err := mergeValues(out[k], v)
+				if err != nil {
+					return nil, errors.Wrapf(err, "field %q", k)
+				}
+				out[k] = m
+			}
+			return out, nil
+		}
+	}
+	if !reflect.DeepEqual(a, b) {
+		return nil, errors.Errorf("conflicting values %v and %v", a, b)
+	}
+	return a, nil
+}
+
+// policyLibrary returns the policy library loaded from the supplied source, or
+// the Function's policy library, if any, if no source is supplied.
+func (f *Function) policyLibrary(ctx context.Context, src *v1beta1.Source) (*library, error) {
+	switch {
+	case src == nil || (src.OCI == nil && src.Git == nil):
+		if f.libraryPending.Load() {
+			return nil, errors.New("policy library is not loaded yet")
+		}
+		lib := f.library.Load()
+		if err := f.libraryErr.Load(); lib == nil && err != nil {
+			return nil, errors.Wrap(*err, "cannot activate policy library")
+		}
+		return lib, nil
+	case src.OCI != nil && src.Git != nil:
+		return nil, errors.New("only one of the oci or git sources can be specified")
+	case src.OCI != nil:
+		if f.oci == nil {
+			return nil, errors.New("OCI policy sources are not enabled")
+		}
+		lib, err := f.oci.library(ctx, src.OCI)
+		return lib, errors.Wrap(err, "cannot load policy bundle from OCI source")
+	default:
+		if f.git == nil {
+			return nil, errors.New("git policy sources are not enabled")
+		}
+		lib, err := f.git.library(ctx, src.Git)
+		return lib, errors.Wrap(err, "cannot load policies from git source")
+	}
 }
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"testing"
 
 	"github.com/crossplane/function-rego/input/v1beta1"
@@ -10,6 +11,9 @@ import (
 	"github.com/google/go-cmp/cmp/cmpopts"
 	"google.golang.org/protobuf/testing/protocmp"
 	"google.golang.org/protobuf/types/known/durationpb"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
 
 	fnv1beta1 "github.com/crossplane/function-sdk-go/proto/v1beta1"
 	"github.com/crossplane/function-sdk-go/resource"
@@ -43,7 +47,7 @@ func TestRunFunction(t *testing.T) {
 				req: &fnv1beta1.RunFunctionRequest{
 					Meta: &fnv1beta1.RequestMeta{Tag: "hello"},
 					Input: resource.MustStructJSON(`{
-						"apiVersion": "dummy.fn.crossplane.io",
+						"apiVersion": "rego.fn.crossplane.io/v1beta1",
 						"kind": "Input"
 					}`),
 				},
@@ -68,6 +72,7 @@ func TestRunFunction(t *testing.T) {
 					Meta: &fnv1beta1.RequestMeta{Tag: "hello"},
 					Input: resource.MustStructObject(
 						&v1beta1.Input{
+							TypeMeta: inputTypeMeta,
 							Spec: v1beta1.InputSpec{
 								Scripts: map[string]string{
 									"hello.rego": `
@@ -115,6 +120,7 @@ response = object.union(input.response, {"results": results})
 					},
 					Input: resource.MustStructObject(
 						&v1beta1.Input{
+							TypeMeta: inputTypeMeta,
 							Spec: v1beta1.InputSpec{
 								Scripts: map[string]string{
 									"hello.rego": `
@@ -192,6 +198,7 @@ response = object.union(input.response, {"results": results})
 					},
 					Input: resource.MustStructObject(
 						&v1beta1.Input{
+							TypeMeta: inputTypeMeta,
 							Spec: v1beta1.InputSpec{
 								Scripts: map[string]string{
 									"hello.rego": `
@@ -275,6 +282,7 @@ response = object.union(input.response, {"results": results})
 					},
 					Input: resource.MustStructObject(
 						&v1beta1.Input{
+							TypeMeta: inputTypeMeta,
 							Spec: v1beta1.InputSpec{
 								Scripts: map[string]string{
 									"hello.rego": `
@@ -367,6 +375,7 @@ response = object.union(input.response, {"results": results})
 					},
 					Input: resource.MustStructObject(
 						&v1beta1.Input{
+							TypeMeta: inputTypeMeta,
 							Spec: v1beta1.InputSpec{
 								Scripts: map[string]string{
 									"hello.rego": `
@@ -473,6 +482,7 @@ response = object.union(input.response, {"results": results})
 					},
 					Input: resource.MustStructObject(
 						&v1beta1.Input{
+							TypeMeta: inputTypeMeta,
 							Spec: v1beta1.InputSpec{
 								Scripts: map[string]string{
 									"hello.rego": `
@@ -512,8 +522,14 @@ response := object.union(input.response, patch) if input.request.observed.compos
 			},
 			want: want{
 				rsp: &fnv1beta1.RunFunctionResponse{
-					Meta:    &fnv1beta1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
-					Results: []*fnv1beta1.Result{},
+					Meta: &fnv1beta1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1beta1.Result{
+						// Crossplane ignores writes to the composite
+						// resource's metadata, and needs apiVersion and kind.
+						{Severity: fnv1beta1.Severity_SEVERITY_WARNING, Message: "invalid response: desired composite resource: Crossplane ignores the metadata field, only the status can be written"},
+						{Severity: fnv1beta1.Severity_SEVERITY_WARNING, Message: `invalid response: desired composed resource "foo": apiVersion is required`},
+						{Severity: fnv1beta1.Severity_SEVERITY_WARNING, Message: `invalid response: desired composed resource "foo": kind is required`},
+					},
 					Desired: &fnv1beta1.State{
 						Composite: &fnv1beta1.Resource{
 							Resource: resource.MustStructJSON(`{
@@ -540,19 +556,1037 @@ response := object.union(input.response, patch) if input.request.observed.compos
 				},
 			},
 		},
-	}
+		"ResultsFromDenyAndWarnRuleMetadata": {
+			reason: "The Function should build results from deny and warn rules using their METADATA annotations",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1beta1.RunFunctionRequest{
+					Meta: &fnv1beta1.RequestMeta{Tag: "hello"},
+					Observed: &fnv1beta1.State{
+						Composite: &fnv1beta1.Resource{
+							Resource: resource.MustStructJSON(`{
+									"metadata": {
+										"annotations": {
+											"dummy.fn.crossplane.io/illegal": "true"
+										}
+									}
+								}`),
+						},
+					},
+					Input: resource.MustStructObject(
+						&v1beta1.Input{
+							TypeMeta: inputTypeMeta,
+							Spec: v1beta1.InputSpec{
+								Scripts: map[string]string{
+									"hello.rego": `
+package crossplane
 
-	for name, tc := range cases {
-		t.Run(name, func(t *testing.T) {
-			f := &Function{log: log}
-			rsp, err := f.RunFunction(tc.args.ctx, tc.args.req)
+# METADATA
+# title: Deny illegal composite resources
+# description: Composite resources with the annotation dummy.fn.crossplane.io/illegal set to true are not allowed
+# related_resources:
+# - ref: https://example.org/policies/illegal
+# custom:
+#  id: XP-001
+deny[msg] {
+	input.request.observed.composite.resource.metadata.annotations["dummy.fn.crossplane.io/illegal"] == "true"
+	msg := "composite resource is illegal"
+}
 
-			if diff := cmp.Diff(tc.want.rsp, rsp, protocmp.Transform()); diff != "" {
-				t.Errorf("%s\nf.RunFunction(...): -want rsp, +got rsp:\n%s", tc.reason, diff)
-			}
+# METADATA
+# title: Warn about illegal composite resources
+# description: Composite resources should not be annotated as illegal
+# custom:
+#  severity: SEVERITY_NORMAL
+warn[{"msg": ""}] {
+	input.request.observed.composite.resource.metadata.annotations["dummy.fn.crossplane.io/illegal"]
+}
 
-			if diff := cmp.Diff(tc.want.err, err, cmpopts.EquateErrors()); diff != "" {
-				t.Errorf("%s\nf.RunFunction(...): -want err, +got err:\n%s", tc.reason, diff)
+# METADATA
+# title: Not triggered
+deny["never"] {
+	false
+}
+`,
+								},
+							},
+						}),
+				},
+			},
+			want: want{
+				rsp: &fnv1beta1.RunFunctionResponse{
+					Meta: &fnv1beta1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1beta1.Result{
+						{
+							Severity: fnv1beta1.Severity_SEVERITY_FATAL,
+							Message:  "[XP-001] Deny illegal composite resources: composite resource is illegal (see https://example.org/policies/illegal)",
+						},
+						{
+							Severity: fnv1beta1.Severity_SEVERITY_NORMAL,
+							Message:  "Warn about illegal composite resources: Composite resources should not be annotated as illegal",
+						},
+					},
+				},
+			},
+		},
+		"ResultsFromDocumentScopedRuleMetadata": {
+			reason: "The Function should apply METADATA annotations scoped to the document to each body of a deny rule",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1beta1.RunFunctionRequest{
+					Meta: &fnv1beta1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructObject(
+						&v1beta1.Input{
+							TypeMeta: inputTypeMeta,
+							Spec: v1beta1.InputSpec{
+								Scripts: map[string]string{
+									"hello.rego": `
+package crossplane
+
+# METADATA
+# scope: document
+# title: Deny everything
+# custom:
+#  id: XP-002
+#  severity: warning
+deny["a"] {
+	true
+}
+
+deny["b"] {
+	true
+}
+`,
+								},
+							},
+						}),
+				},
+			},
+			want: want{
+				rsp: &fnv1beta1.RunFunctionResponse{
+					Meta: &fnv1beta1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1beta1.Result{
+						{
+							Severity: fnv1beta1.Severity_SEVERITY_WARNING,
+							Message:  "[XP-002] Deny everything: a",
+						},
+						{
+							Severity: fnv1beta1.Severity_SEVERITY_WARNING,
+							Message:  "[XP-002] Deny everything: b",
+						},
+					},
+				},
+			},
+		},
+		"FatalIfNoRulesDefined": {
+			reason: "The Function should return a fatal result if the policy defines neither response nor deny or warn rules",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1beta1.RunFunctionRequest{
+					Meta: &fnv1beta1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructObject(
+						&v1beta1.Input{
+							TypeMeta: inputTypeMeta,
+							Spec: v1beta1.InputSpec{
+								Scripts: map[string]string{
+									"hello.rego": `
+package crossplane
+
+allow = true
+`,
+								},
+							},
+						}),
+				},
+			},
+			want: want{
+				rsp: &fnv1beta1.RunFunctionResponse{
+					Meta: &fnv1beta1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1beta1.Result{
+						{
+							Severity: fnv1beta1.Severity_SEVERITY_FATAL,
+							Message:  "policy must define at least one of the response, deny, warn or ttl rules in package crossplane",
+						},
+					},
+				},
+			},
+		},
+		"EnforcementActionWarnDowngradesFatalResults": {
+			reason: "The Function should downgrade fatal results to warnings with the warn enforcement action",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1beta1.RunFunctionRequest{
+					Meta: &fnv1beta1.RequestMeta{Tag: "hello"},
+					Observed: &fnv1beta1.State{
+						Composite: &fnv1beta1.Resource{
+							Resource: resource.MustStructJSON(`{
+									"metadata": {
+										"annotations": {
+											"dummy.fn.crossplane.io/illegal": "true"
+										}
+									}
+								}`),
+						},
+					},
+					Input: resource.MustStructObject(
+						&v1beta1.Input{
+							TypeMeta: inputTypeMeta,
+							Spec: v1beta1.InputSpec{
+								EnforcementAction: v1beta1.EnforcementActionWarn,
+								Scripts: map[string]string{
+									"hello.rego": `
+package crossplane
+
+# METADATA
+# title: Deny illegal composite resources
+deny["composite resource is illegal"] {
+	input.request.observed.composite.resource.metadata.annotations["dummy.fn.crossplane.io/illegal"] == "true"
+}
+
+warn["composite resource is suspicious"] {
+	input.request.observed.composite.resource.metadata.annotations["dummy.fn.crossplane.io/illegal"] == "true"
+}
+`,
+								},
+							},
+						}),
+				},
+			},
+			want: want{
+				rsp: &fnv1beta1.RunFunctionResponse{
+					Meta: &fnv1beta1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1beta1.Result{
+						{
+							Severity: fnv1beta1.Severity_SEVERITY_WARNING,
+							Message:  "[warn, originally SEVERITY_FATAL] Deny illegal composite resources: composite resource is illegal",
+						},
+						{
+							Severity: fnv1beta1.Severity_SEVERITY_WARNING,
+							Message:  "composite resource is suspicious",
+						},
+					},
+				},
+			},
+		},
+		"EnforcementActionDryRunDropsFatalResults": {
+			reason: "The Function should only log fatal results with the dryrun enforcement action",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1beta1.RunFunctionRequest{
+					Meta: &fnv1beta1.RequestMeta{Tag: "hello"},
+					Observed: &fnv1beta1.State{
+						Composite: &fnv1beta1.Resource{
+							Resource: resource.MustStructJSON(`{
+									"metadata": {
+										"annotations": {
+											"dummy.fn.crossplane.io/illegal": "true"
+										}
+									}
+								}`),
+						},
+					},
+					Input: resource.MustStructObject(
+						&v1beta1.Input{
+							TypeMeta: inputTypeMeta,
+							Spec: v1beta1.InputSpec{
+								EnforcementAction: v1beta1.EnforcementActionDryRun,
+								Scripts: map[string]string{
+									"hello.rego": `
+package crossplane
+
+# METADATA
+# title: Deny illegal composite resources
+deny["composite resource is illegal"] {
+	input.request.observed.composite.resource.metadata.annotations["dummy.fn.crossplane.io/illegal"] == "true"
+}
+
+warn["composite resource is suspicious"] {
+	input.request.observed.composite.resource.metadata.annotations["dummy.fn.crossplane.io/illegal"] == "true"
+}
+`,
+								},
+							},
+						}),
+				},
+			},
+			want: want{
+				rsp: &fnv1beta1.RunFunctionResponse{
+					Meta: &fnv1beta1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1beta1.Result{
+						{
+							Severity: fnv1beta1.Severity_SEVERITY_WARNING,
+							Message:  "composite resource is suspicious",
+						},
+					},
+				},
+			},
+		},
+		"EnforcementActionOverrideAllowed": {
+			reason: "The Function should use the enforcement action annotation of the composite resource if allowed",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1beta1.RunFunctionRequest{
+					Meta: &fnv1beta1.RequestMeta{Tag: "hello"},
+					Observed: &fnv1beta1.State{
+						Composite: &fnv1beta1.Resource{
+							Resource: resource.MustStructJSON(`{
+									"metadata": {
+										"annotations": {
+											"dummy.fn.crossplane.io/illegal": "true",
+											"rego.fn.crossplane.io/enforcement-action": "dryrun"
+										}
+									}
+								}`),
+						},
+					},
+					Input: resource.MustStructObject(
+						&v1beta1.Input{
+							TypeMeta: inputTypeMeta,
+							Spec: v1beta1.InputSpec{
+								AllowEnforcementActionOverride: true,
+								Scripts: map[string]string{
+									"hello.rego": `
+package crossplane
+
+# METADATA
+# title: Deny illegal composite resources
+deny["composite resource is illegal"] {
+	input.request.observed.composite.resource.metadata.annotations["dummy.fn.crossplane.io/illegal"] == "true"
+}
+
+warn["composite resource is suspicious"] {
+	input.request.observed.composite.resource.metadata.annotations["dummy.fn.crossplane.io/illegal"] == "true"
+}
+`,
+								},
+							},
+						}),
+				},
+			},
+			want: want{
+				rsp: &fnv1beta1.RunFunctionResponse{
+					Meta: &fnv1beta1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1beta1.Result{
+						{
+							Severity: fnv1beta1.Severity_SEVERITY_WARNING,
+							Message:  "composite resource is suspicious",
+						},
+					},
+				},
+			},
+		},
+		"EnforcementActionOverrideNotAllowed": {
+			reason: "The Function should ignore the enforcement action annotation of the composite resource if not allowed",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1beta1.RunFunctionRequest{
+					Meta: &fnv1beta1.RequestMeta{Tag: "hello"},
+					Observed: &fnv1beta1.State{
+						Composite: &fnv1beta1.Resource{
+							Resource: resource.MustStructJSON(`{
+									"metadata": {
+										"annotations": {
+											"dummy.fn.crossplane.io/illegal": "true",
+											"rego.fn.crossplane.io/enforcement-action": "dryrun"
+										}
+									}
+								}`),
+						},
+					},
+					Input: resource.MustStructObject(
+						&v1beta1.Input{
+							TypeMeta: inputTypeMeta,
+							Spec: v1beta1.InputSpec{
+								Scripts: map[string]string{
+									"hello.rego": `
+package crossplane
+
+# METADATA
+# title: Deny illegal composite resources
+deny["composite resource is illegal"] {
+	input.request.observed.composite.resource.metadata.annotations["dummy.fn.crossplane.io/illegal"] == "true"
+}
+
+warn["composite resource is suspicious"] {
+	input.request.observed.composite.resource.metadata.annotations["dummy.fn.crossplane.io/illegal"] == "true"
+}
+`,
+								},
+							},
+						}),
+				},
+			},
+			want: want{
+				rsp: &fnv1beta1.RunFunctionResponse{
+					Meta: &fnv1beta1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1beta1.Result{
+						{
+							Severity: fnv1beta1.Severity_SEVERITY_FATAL,
+							Message:  "Deny illegal composite resources: composite resource is illegal",
+						},
+						{
+							Severity: fnv1beta1.Severity_SEVERITY_WARNING,
+							Message:  "composite resource is suspicious",
+						},
+					},
+				},
+			},
+		},
+		"FatalIfInvalidEnforcementActionOverride": {
+			reason: "The Function should return a fatal result if the enforcement action annotation is invalid",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1beta1.RunFunctionRequest{
+					Meta: &fnv1beta1.RequestMeta{Tag: "hello"},
+					Observed: &fnv1beta1.State{
+						Composite: &fnv1beta1.Resource{
+							Resource: resource.MustStructJSON(`{
+									"metadata": {
+										"annotations": {
+											"dummy.fn.crossplane.io/illegal": "true",
+											"rego.fn.crossplane.io/enforcement-action": "maybe"
+										}
+									}
+								}`),
+						},
+					},
+					Input: resource.MustStructObject(
+						&v1beta1.Input{
+							TypeMeta: inputTypeMeta,
+							Spec: v1beta1.InputSpec{
+								AllowEnforcementActionOverride: true,
+								Scripts: map[string]string{
+									"hello.rego": `
+package crossplane
+
+# METADATA
+# title: Deny illegal composite resources
+deny["composite resource is illegal"] {
+	input.request.observed.composite.resource.metadata.annotations["dummy.fn.crossplane.io/illegal"] == "true"
+}
+
+warn["composite resource is suspicious"] {
+	input.request.observed.composite.resource.metadata.annotations["dummy.fn.crossplane.io/illegal"] == "true"
+}
+`,
+								},
+							},
+						}),
+				},
+			},
+			want: want{
+				rsp: &fnv1beta1.RunFunctionResponse{
+					Meta: &fnv1beta1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1beta1.Result{
+						{
+							Severity: fnv1beta1.Severity_SEVERITY_FATAL,
+							Message:  "cannot determine enforcement action: invalid rego.fn.crossplane.io/enforcement-action annotation: unknown enforcement action \"maybe\"",
+						},
+					},
+				},
+			},
+		},
+		"ExemptionsSuppressResults": {
+			reason: "The Function should suppress results of exempted policies, fail on malformed exemptions and warn about expired ones",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1beta1.RunFunctionRequest{
+					Meta: &fnv1beta1.RequestMeta{Tag: "hello"},
+					Observed: &fnv1beta1.State{
+						Composite: &fnv1beta1.Resource{
+							Resource: resource.MustStructJSON(`{
+									"metadata": {
+										"annotations": {
+											"dummy.fn.crossplane.io/illegal": "true",
+											"rego.fn.crossplane.io/exemptions": "[{\"policyIDs\": [\"XP-002\"], \"justification\": \"legacy\", \"expires\": \"2000-01-01T00:00:00Z\"}, {\"policyIDs\": [\"XP-002\"], \"expires\": \"2999-01-01T00:00:00Z\"}]"
+										}
+									}
+								}`),
+						},
+					},
+					Input: resource.MustStructObject(
+						&v1beta1.Input{
+							TypeMeta: inputTypeMeta,
+							Spec: v1beta1.InputSpec{
+								AllowExemptionAnnotations: true,
+								Exemptions: []v1beta1.Exemption{
+									{
+										PolicyIDs:     []string{"XP-001"},
+										Justification: "migration in progress",
+										Expires:       "2999-01-01T00:00:00Z",
+									},
+									{
+										PolicyIDs:     []string{"XP-002"},
+										Justification: "never ending",
+										Expires:       "tomorrow",
+									},
+								},
+								Scripts: map[string]string{
+									"hello.rego": `
+package crossplane
+
+# METADATA
+# custom:
+#  id: XP-001
+deny["composite resource is illegal"] {
+	input.request.observed.composite.resource.metadata.annotations["dummy.fn.crossplane.io/illegal"] == "true"
+}
+
+# METADATA
+# custom:
+#  id: XP-002
+deny["composite resource is suspicious"] {
+	input.request.observed.composite.resource.metadata.annotations["dummy.fn.crossplane.io/illegal"] == "true"
+}
+`,
+								},
+							},
+						}),
+				},
+			},
+			want: want{
+				rsp: &fnv1beta1.RunFunctionResponse{
+					Meta: &fnv1beta1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1beta1.Result{
+						{
+							Severity: fnv1beta1.Severity_SEVERITY_FATAL,
+							Message:  "[XP-002] composite resource is suspicious",
+						},
+						{
+							Severity: fnv1beta1.Severity_SEVERITY_FATAL,
+							Message:  `invalid exemption 1 from input: cannot parse expiry: parsing time "tomorrow" as "2006-01-02T15:04:05Z07:00": cannot parse "tomorrow" as "2006"`,
+						},
+						{
+							Severity: fnv1beta1.Severity_SEVERITY_WARNING,
+							Message:  "exemption 0 from annotation rego.fn.crossplane.io/exemptions of XP-002 expired at 2000-01-01T00:00:00Z",
+						},
+						{
+							Severity: fnv1beta1.Severity_SEVERITY_FATAL,
+							Message:  "invalid exemption 1 from annotation rego.fn.crossplane.io/exemptions: no justification supplied",
+						},
+						{
+							Severity: fnv1beta1.Severity_SEVERITY_WARNING,
+							Message:  "results of policy XP-001 suppressed by an exemption expiring at 2999-01-01T00:00:00Z: migration in progress",
+						},
+					},
+				},
+			},
+		},
+		"UnknownFailurePolicyWithGatekeeper": {
+			reason: "The Function should return a fatal result if the failure policy is unknown, even if there is no policy to evaluate",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1beta1.RunFunctionRequest{
+					Meta: &fnv1beta1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructObject(
+						&v1beta1.Input{
+							TypeMeta: inputTypeMeta,
+							Spec: v1beta1.InputSpec{
+								FailurePolicy: "Ignroe",
+								Gatekeeper: &v1beta1.Gatekeeper{
+									ConstraintTemplates: []runtime.RawExtension{{Raw: []byte(requiredLabelsTemplate)}},
+								},
+							},
+						}),
+				},
+			},
+			want: want{
+				rsp: &fnv1beta1.RunFunctionResponse{
+					Meta: &fnv1beta1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1beta1.Result{
+						{
+							Severity: fnv1beta1.Severity_SEVERITY_FATAL,
+							Message:  `unknown failure policy "Ignroe"`,
+						},
+					},
+				},
+			},
+		},
+		"UnknownModeWithIgnoredCompileError": {
+			reason: "The Function should return a fatal result if the mode is unknown, even if the failure policy ignores the policy failing to compile",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1beta1.RunFunctionRequest{
+					Meta: &fnv1beta1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructObject(
+						&v1beta1.Input{
+							TypeMeta: inputTypeMeta,
+							Spec: v1beta1.InputSpec{
+								Mode:          "everything",
+								FailurePolicy: v1beta1.FailurePolicyIgnore,
+								Scripts: map[string]string{
+									"hello.rego": "package crossplane\n\ndeny[msg] { msg := undefined_function(1) }\n",
+								},
+							},
+						}),
+				},
+			},
+			want: want{
+				rsp: &fnv1beta1.RunFunctionResponse{
+					Meta: &fnv1beta1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1beta1.Result{
+						{
+							Severity: fnv1beta1.Severity_SEVERITY_FATAL,
+							Message:  `unknown evaluation mode "everything"`,
+						},
+					},
+				},
+			},
+		},
+		"CompleteDenyRule": {
+			reason: "The Function should return a fatal result naming the module and rule if a deny rule isn't a partial set rule",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1beta1.RunFunctionRequest{
+					Meta: &fnv1beta1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructObject(
+						&v1beta1.Input{
+							TypeMeta: inputTypeMeta,
+							Spec: v1beta1.InputSpec{
+								Scripts: map[string]string{
+									"hello.rego": "package crossplane\n\ndeny := {\"nope\"}\n",
+								},
+							},
+						}),
+				},
+			},
+			want: want{
+				rsp: &fnv1beta1.RunFunctionResponse{
+					Meta: &fnv1beta1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1beta1.Result{
+						{
+							Severity: fnv1beta1.Severity_SEVERITY_FATAL,
+							Message:  `prepare stage failed: cannot compile rego policy: cannot prepare module "hello.rego": deny rule on line 3 must be a partial set rule, e.g. deny[msg] { ... }`,
+						},
+					},
+				},
+			},
+		},
+		"InvalidExemptionEnforcementAction": {
+			reason: "The enforcement action should apply to the results of malformed exemptions",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1beta1.RunFunctionRequest{
+					Meta: &fnv1beta1.RequestMeta{Tag: "hello"},
+					Input: resource.MustStructObject(
+						&v1beta1.Input{
+							TypeMeta: inputTypeMeta,
+							Spec: v1beta1.InputSpec{
+								EnforcementAction: v1beta1.EnforcementActionWarn,
+								Exemptions: []v1beta1.Exemption{
+									{
+										PolicyIDs: []string{"XP-001"},
+										Expires:   "2999-01-01T00:00:00Z",
+									},
+								},
+								Scripts: map[string]string{
+									"hello.rego": "package crossplane\n\ndeny[\"nope\"] { false }\n",
+								},
+							},
+						}),
+				},
+			},
+			want: want{
+				rsp: &fnv1beta1.RunFunctionResponse{
+					Meta: &fnv1beta1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1beta1.Result{
+						{
+							Severity: fnv1beta1.Severity_SEVERITY_WARNING,
+							Message:  "[warn, originally SEVERITY_FATAL] invalid exemption 0 from input: no justification supplied",
+						},
+					},
+				},
+			},
+		},
+		"ExemptionAnnotationsNotAllowed": {
+			reason: "The Function should ignore exemptions declared by the composite resource unless the input allows them",
+			args: args{
+				ctx: context.Background(),
+				req: &fnv1beta1.RunFunctionRequest{
+					Meta: &fnv1beta1.RequestMeta{Tag: "hello"},
+					Observed: &fnv1beta1.State{
+						Composite: &fnv1beta1.Resource{
+							Resource: resource.MustStructJSON(`{
+									"metadata": {
+										"annotations": {
+											"dummy.fn.crossplane.io/illegal": "true",
+											"rego.fn.crossplane.io/exemptions": "[{\"policyIDs\": [\"XP-001\"], \"justification\": \"legacy\", \"expires\": \"2999-01-01T00:00:00Z\"}]"
+										}
+									}
+								}`),
+						},
+					},
+					Input: resource.MustStructObject(
+						&v1beta1.Input{
+							TypeMeta: inputTypeMeta,
+							Spec: v1beta1.InputSpec{
+								Scripts: map[string]string{
+									"hello.rego": `
+package crossplane
+
+# METADATA
+# custom:
+#  id: XP-001
+deny["composite resource is illegal"] {
+	input.request.observed.composite.resource.metadata.annotations["dummy.fn.crossplane.io/illegal"] == "true"
+}
+`,
+								},
+							},
+						}),
+				},
+			},
+			want: want{
+				rsp: &fnv1beta1.RunFunctionResponse{
+					Meta: &fnv1beta1.ResponseMeta{Tag: "hello", Ttl: durationpb.New(response.DefaultTTL)},
+					Results: []*fnv1beta1.Result{
+						{
+							Severity: fnv1beta1.Severity_SEVERITY_FATAL,
+							Message:  "[XP-001] composite resource is illegal",
+						},
+					},
+				},
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			f := &Function{log: log}
+			rsp, err := f.RunFunction(tc.args.ctx, tc.args.req)
+
+			if diff := cmp.Diff(tc.want.rsp, rsp, protocmp.Transform()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want rsp, +got rsp:\n%s", tc.reason, diff)
+			}
+
+			if diff := cmp.Diff(tc.want.err, err, cmpopts.EquateErrors()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want err, +got err:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestRunFunctionOnUndefined(t *testing.T) {
+	const guardedPolicy = `package crossplane
+
+response := object.union(input.response, {"results": [{"severity": "SEVERITY_NORMAL", "message": "guarded"}]}) {
+	input.request.observed.composite.resource.spec.enabled
+}
+
+warn[msg] {
+	msg := "always"
+}
+`
+	req := func(action v1beta1.UndefinedAction) *fnv1beta1.RunFunctionRequest {
+		return &fnv1beta1.RunFunctionRequest{
+			Input: resource.MustStructObject(&v1beta1.Input{
+				TypeMeta: inputTypeMeta,
+				Spec:     v1beta1.InputSpec{OnUndefined: action, Scripts: map[string]string{"policy.rego": guardedPolicy}},
+			}),
+			Observed: &fnv1beta1.State{
+				Composite: &fnv1beta1.Resource{Resource: resource.MustStructJSON(`{"spec": {"enabled": false}}`)},
+			},
+		}
+	}
+	always := &fnv1beta1.Result{Severity: fnv1beta1.Severity_SEVERITY_WARNING, Message: "always"}
+
+	cases := map[string]struct {
+		reason string
+		req    *fnv1beta1.RunFunctionRequest
+		want   []*fnv1beta1.Result
+	}{
+		"PassThrough": {
+			reason: "An undefined response rule should pass the response through by default, still returning the results of other rules",
+			req:    req(""),
+			want:   []*fnv1beta1.Result{always},
+		},
+		"Fatal": {
+			reason: "An undefined response rule should return a fatal result if the undefined action is fatal",
+			req:    req(v1beta1.UndefinedActionFatal),
+			want: []*fnv1beta1.Result{
+				always,
+				{Severity: fnv1beta1.Severity_SEVERITY_FATAL, Message: "the response rule is undefined"},
+			},
+		},
+		"Warn": {
+			reason: "An undefined response rule should return a warning if the undefined action is warn",
+			req:    req(v1beta1.UndefinedActionWarn),
+			want: []*fnv1beta1.Result{
+				always,
+				{Severity: fnv1beta1.Severity_SEVERITY_WARNING, Message: "the response rule is undefined, passing the response through"},
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			f := &Function{log: logging.NewNopLogger()}
+			rsp, err := f.RunFunction(context.Background(), tc.req)
+			if err != nil {
+				t.Fatalf("%s\nf.RunFunction(...): %v", tc.reason, err)
+			}
+			if diff := cmp.Diff(tc.want, rsp.GetResults(), protocmp.Transform()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want results, +got results:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestRunFunctionOnMultipleResults(t *testing.T) {
+	// Responses are returned by a partial set rule, so the policy may return
+	// several of them. Sets are ordered, so the first is the one saying one.
+	const multiPolicy = `package crossplane
+
+response[r] {
+	r := object.union(input.response, {
+		"desired": {"composite": {"ready": "READY_TRUE"}},
+		"results": [{"severity": "SEVERITY_NORMAL", "message": "one"}],
+	})
+}
+
+response[r] {
+	input.request.observed.composite.resource.spec.responses > 1
+	r := object.union(input.response, {"results": [{"severity": "SEVERITY_NORMAL", "message": "two"}]})
+}
+
+response[r] {
+	input.request.observed.composite.resource.spec.responses > 2
+	r := object.union(input.response, {"desired": {"composite": {"ready": "READY_FALSE"}}})
+}
+`
+	req := func(strategy v1beta1.MultipleResultsStrategy, onUndefined v1beta1.UndefinedAction, responses int) *fnv1beta1.RunFunctionRequest {
+		script := multiPolicy
+		if responses == 0 {
+			script = "package crossplane\n\nresponse[r] {\n\tr := input.response\n\tfalse\n}\n"
+		}
+		return &fnv1beta1.RunFunctionRequest{
+			Meta: &fnv1beta1.RequestMeta{Tag: "hello"},
+			Input: resource.MustStructObject(&v1beta1.Input{
+				TypeMeta: inputTypeMeta,
+				Spec: v1beta1.InputSpec{
+					OnMultipleResults: strategy,
+					OnUndefined:       onUndefined,
+					Scripts:           map[string]string{"policy.rego": script},
+				},
+			}),
+			Observed: &fnv1beta1.State{
+				Composite: &fnv1beta1.Resource{Resource: resource.MustStructJSON(fmt.Sprintf(`{"spec": {"responses": %d}}`, responses))},
+			},
+		}
+	}
+	normal := func(msg string) *fnv1beta1.Result {
+		return &fnv1beta1.Result{Severity: fnv1beta1.Severity_SEVERITY_NORMAL, Message: msg}
+	}
+	fatal := func(msg string) *fnv1beta1.Result {
+		return &fnv1beta1.Result{Severity: fnv1beta1.Severity_SEVERITY_FATAL, Message: msg}
+	}
+
+	cases := map[string]struct {
+		reason string
+		req    *fnv1beta1.RunFunctionRequest
+		want   []*fnv1beta1.Result
+	}{
+		"Single": {
+			reason: "A single response should be returned regardless of the strategy",
+			req:    req("", "", 1),
+			want:   []*fnv1beta1.Result{normal("one")},
+		},
+		"Fail": {
+			reason: "Multiple responses should fail the evaluation by default",
+			req:    req("", "", 2),
+			want:   []*fnv1beta1.Result{fatal("convert output stage failed: the response rule has 2 values, expected one")},
+		},
+		"ExplicitFail": {
+			reason: "Multiple responses should fail the evaluation if the strategy is fail",
+			req:    req(v1beta1.MultipleResultsFail, "", 2),
+			want:   []*fnv1beta1.Result{fatal("convert output stage failed: the response rule has 2 values, expected one")},
+		},
+		"First": {
+			reason: "The first of multiple responses should be returned if the strategy is first",
+			req:    req(v1beta1.MultipleResultsFirst, "", 2),
+			want:   []*fnv1beta1.Result{normal("one")},
+		},
+		"Merge": {
+			reason: "Multiple responses should be merged, concatenating their results, if the strategy is merge",
+			req:    req(v1beta1.MultipleResultsMerge, "", 2),
+			want:   []*fnv1beta1.Result{normal("one"), normal("two")},
+		},
+		"MergeConflict": {
+			reason: "Merging conflicting responses should fail the evaluation",
+			req:    req(v1beta1.MultipleResultsMerge, "", 3),
+			want:   []*fnv1beta1.Result{fatal(`convert output stage failed: cannot merge values of the response rule: field "desired": field "composite": field "ready": conflicting values READY_FALSE and READY_TRUE`)},
+		},
+		"EmptyPassThrough": {
+			reason: "A response partial set rule without members should pass the response through by default",
+			req:    req(v1beta1.MultipleResultsMerge, "", 0),
+		},
+		"EmptyFatal": {
+			reason: "A response partial set rule without members should be handled like an undefined response rule",
+			req:    req(v1beta1.MultipleResultsMerge, v1beta1.UndefinedActionFatal, 0),
+			want:   []*fnv1beta1.Result{fatal("the response rule is undefined")},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			f := &Function{log: logging.NewNopLogger()}
+			rsp, err := f.RunFunction(context.Background(), tc.req)
+			if err != nil {
+				t.Fatalf("%s\nf.RunFunction(...): %v", tc.reason, err)
+			}
+			if diff := cmp.Diff(tc.want, rsp.GetResults(), protocmp.Transform()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want results, +got results:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestRunFunctionFailurePolicy(t *testing.T) {
+	const conflictingPolicy = `package crossplane
+
+response := object.union(input.response, {"desired": {"resources": {"bucket": {"resource": {"kind": "Bucket"}}}}}) {
+	true
+}
+
+response := input.response {
+	true
+}
+`
+	const invalidResponsePolicy = `package crossplane
+
+response := {"outcome": "fatal"}
+`
+	req := func(fp v1beta1.FailurePolicy, script string) *fnv1beta1.RunFunctionRequest {
+		return &fnv1beta1.RunFunctionRequest{
+			Input: resource.MustStructObject(&v1beta1.Input{
+				TypeMeta: inputTypeMeta,
+				Spec:     v1beta1.InputSpec{FailurePolicy: fp, Scripts: map[string]string{"policy.rego": script}},
+			}),
+			Desired: &fnv1beta1.State{Resources: map[string]*fnv1beta1.Resource{
+				"db": {Resource: resource.MustStructJSON(`{"kind": "Instance"}`)},
+			}},
+		}
+	}
+	passedThrough := &fnv1beta1.State{Resources: map[string]*fnv1beta1.Resource{
+		"db": {Resource: resource.MustStructJSON(`{"kind": "Instance"}`)},
+	}}
+
+	type want struct {
+		desired *fnv1beta1.State
+		results []*fnv1beta1.Result
+	}
+
+	cases := map[string]struct {
+		reason string
+		req    *fnv1beta1.RunFunctionRequest
+		want   want
+	}{
+		"Fail": {
+			reason: "Evaluation errors should return a fatal result naming the failed stage by default",
+			req:    req("", conflictingPolicy),
+			want: want{
+				desired: passedThrough,
+				results: []*fnv1beta1.Result{{
+					Severity: fnv1beta1.Severity_SEVERITY_FATAL,
+					Message:  "evaluate stage failed: cannot evaluate rego query: policy.rego:7: eval_conflict_error: complete rules must not produce multiple outputs",
+				}},
+			},
+		},
+		"IgnoreEvaluate": {
+			reason: "Evaluation errors should return a warning naming the failed stage if the failure policy is Ignore",
+			req:    req(v1beta1.FailurePolicyIgnore, conflictingPolicy),
+			want: want{
+				desired: passedThrough,
+				results: []*fnv1beta1.Result{{
+					Severity: fnv1beta1.Severity_SEVERITY_WARNING,
+					Message:  "ignoring policy evaluation error: evaluate stage failed: cannot evaluate rego query: policy.rego:7: eval_conflict_error: complete rules must not produce multiple outputs",
+				}},
+			},
+		},
+		"IgnoreConvert": {
+			reason: "Errors converting the response should pass the desired state through untouched if the failure policy is Ignore",
+			req:    req(v1beta1.FailurePolicyIgnore, invalidResponsePolicy),
+			want: want{
+				desired: passedThrough,
+				results: []*fnv1beta1.Result{{
+					Severity: fnv1beta1.Severity_SEVERITY_WARNING,
+					Message:  `ignoring policy evaluation error: convert output stage failed: cannot convert rego result into RunFunctionResponse: unknown field "outcome" of apiextensions.fn.proto.v1beta1.RunFunctionResponse`,
+				}},
+			},
+		},
+		"IgnoreWithGatekeeper": {
+			reason: "Gatekeeper constraints should still be evaluated if a policy evaluation error is ignored",
+			req: &fnv1beta1.RunFunctionRequest{
+				Input: resource.MustStructObject(&v1beta1.Input{
+					TypeMeta: inputTypeMeta,
+					Spec: v1beta1.InputSpec{
+						FailurePolicy: v1beta1.FailurePolicyIgnore,
+						Scripts:       map[string]string{"policy.rego": conflictingPolicy},
+						Gatekeeper: &v1beta1.Gatekeeper{
+							ConstraintTemplates: []runtime.RawExtension{{Raw: []byte(requiredLabelsTemplate)}},
+							Constraints: []runtime.RawExtension{{Raw: []byte(`{
+								"apiVersion": "constraints.gatekeeper.sh/v1beta1",
+								"kind": "K8sRequiredLabels",
+								"metadata": {"name": "must-have-owner"},
+								"spec": {"parameters": {"labels": ["owner"]}}
+							}`)}},
+						},
+					},
+				}),
+				Desired: &fnv1beta1.State{Resources: map[string]*fnv1beta1.Resource{
+					"db": {Resource: resource.MustStructJSON(`{"kind": "Instance"}`)},
+				}},
+			},
+			want: want{
+				desired: passedThrough,
+				results: []*fnv1beta1.Result{
+					{
+						Severity: fnv1beta1.Severity_SEVERITY_WARNING,
+						Message:  "ignoring policy evaluation error: evaluate stage failed: cannot evaluate rego query: policy.rego:7: eval_conflict_error: complete rules must not produce multiple outputs",
+					},
+					{
+						Severity: fnv1beta1.Severity_SEVERITY_FATAL,
+						Message:  `[must-have-owner] composed resource "db": you must provide labels: {"owner"}`,
+					},
+				},
+			},
+		},
+		"FailCompile": {
+			reason: "Errors compiling the policy should return a fatal result naming the prepare stage by default",
+			req:    req("", "package crossplane\n\nresponse := undefined_function(1)\n"),
+			want: want{
+				desired: passedThrough,
+				results: []*fnv1beta1.Result{{
+					Severity: fnv1beta1.Severity_SEVERITY_FATAL,
+					Message:  "prepare stage failed: cannot compile rego policy: cannot compile modules: 1 error occurred: policy.rego:3: rego_type_error: undefined function undefined_function",
+				}},
+			},
+		},
+		"IgnoreCompile": {
+			reason: "Errors compiling the policy should return a warning if the failure policy is Ignore",
+			req:    req(v1beta1.FailurePolicyIgnore, "package crossplane\n\nresponse := undefined_function(1)\n"),
+			want: want{
+				desired: passedThrough,
+				results: []*fnv1beta1.Result{{
+					Severity: fnv1beta1.Severity_SEVERITY_WARNING,
+					Message:  "ignoring policy evaluation error: prepare stage failed: cannot compile rego policy: cannot compile modules: 1 error occurred: policy.rego:3: rego_type_error: undefined function undefined_function",
+				}},
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			f := &Function{log: logging.NewNopLogger()}
+			rsp, err := f.RunFunction(context.Background(), tc.req)
+			if err != nil {
+				t.Fatalf("%s\nf.RunFunction(...): %v", tc.reason, err)
+			}
+			if diff := cmp.Diff(tc.want.desired, rsp.GetDesired(), protocmp.Transform()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want desired, +got desired:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(tc.want.results, rsp.GetResults(), protocmp.Transform()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want results, +got results:\n%s", tc.reason, diff)
 			}
 		})
 	}
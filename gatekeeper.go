@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/rego"
+	"google.golang.org/protobuf/types/known/structpb"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/json"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+
+	fnv1beta1 "github.com/crossplane/function-sdk-go/proto/v1beta1"
+
+	"github.com/crossplane/function-rego/input/v1beta1"
+)
+
+const (
+	// gatekeeperTarget is the only ConstraintTemplate target supported.
+	gatekeeperTarget = "admission.k8s.gatekeeper.sh"
+
+	// Groups of Gatekeeper ConstraintTemplates and Constraints.
+	constraintTemplateGroup = "templates.gatekeeper.sh"
+	constraintGroup         = "constraints.gatekeeper.sh"
+
+	// violationRule is the partial set rule ConstraintTemplates use to
+	// return violations.
+	violationRule = "violation"
+)
+
+// A constraintTemplate is the subset of a Gatekeeper ConstraintTemplate used
+// to evaluate its Constraints.
+type constraintTemplate struct {
+	metav1.TypeMeta `json:",inline"`
+	Metadata        struct {
+		Name string `json:"name"`
+	} `json:"metadata"`
+	Spec struct {
+		CRD struct {
+			Spec struct {
+				Names struct {
+					Kind string `json:"kind"`
+				} `json:"names"`
+			} `json:"spec"`
+		} `json:"crd"`
+		Targets []struct {
+			Target string   `json:"target"`
+			Rego   string   `json:"rego"`
+			Libs   []string `json:"libs"`
+		} `json:"targets"`
+	} `json:"spec"`
+}
+
+// A constraint is the subset of a Gatekeeper Constraint used to evaluate it.
+type constraint struct {
+	metav1.TypeMeta `json:",inline"`
+	Metadata        struct {
+		Name string `json:"name"`
+	} `json:"metadata"`
+	Spec struct {
+		EnforcementAction v1beta1.EnforcementAction `json:"enforcementAction"`
+		Match             constraintMatch           `json:"match"`
+		Parameters        map[string]any            `json:"parameters"`
+	} `json:"spec"`
+}
+
+// A constraintMatch selects the resources a constraint applies to. The
+// namespaceSelector isn't supported, since the labels of namespaces aren't
+// known to the Function.
+type constraintMatch struct {
+	Kinds []struct {
+		APIGroups []string `json:"apiGroups"`
+		Kinds     []string `json:"kinds"`
+	} `json:"kinds"`
+	Scope              string                `json:"scope"`
+	Namespaces         []string              `json:"namespaces"`
+	ExcludedNamespaces []string              `json:"excludedNamespaces"`
+	LabelSelector      *metav1.LabelSelector `json:"labelSelector"`
+	NamespaceSelector  *metav1.LabelSelector `json:"namespaceSelector"`
+	Name               string                `json:"name"`
+}
+
+// evaluateConstraints evaluates the supplied Gatekeeper Constraints against
+// each desired composed resource they match, like Gatekeeper evaluates
+// admission requests. A result is returned for each violation, unless the
+// Constraint's enforcement action is dryrun, in which case it's only logged.
+func (f *Function) evaluateConstraints(ctx context.Context, gk *v1beta1.Gatekeeper, req *fnv1beta1.RunFunctionRequest) ([]ruleResult, error) {
+	templates := make(map[string]rego.PreparedEvalQuery, len(gk.ConstraintTemplates))
+	definedBy := make(map[string]string, len(gk.ConstraintTemplates))
+	for i, raw := range gk.ConstraintTemplates {
+		ct := &constraintTemplate{}
+		if err := json.Unmarshal(raw.Raw, ct); err != nil {
+			return nil, errors.Wrapf(err, "cannot decode ConstraintTemplate %d", i)
+		}
+		kind, q, err := f.prepareTemplate(ctx, ct)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid ConstraintTemplate %q", ct.Metadata.Name)
+		}
+		if other, ok := definedBy[kind]; ok {
+			return nil, errors.Errorf("ConstraintTemplates %q and %q both define kind %s", other, ct.Metadata.Name, kind)
+		}
+		definedBy[kind] = ct.Metadata.Name
+		templates[kind] = q
+	}
+
+	constraints := make([]*constraint, 0, len(gk.Constraints))
+	parameters := make(map[*constraint]ast.Value, len(gk.Constraints))
+	for i, raw := range gk.Constraints {
+		c := &constraint{}
+		if err := json.Unmarshal(raw.Raw, c); err != nil {
+			return nil, errors.Wrapf(err, "cannot decode Constraint %d", i)
+		}
+		if err := validConstraint(c); err != nil {
+			return nil, errors.Wrapf(err, "invalid %s Constraint %q", c.Kind, c.Metadata.Name)
+		}
+		if _, ok := templates[c.Kind]; !ok {
+			return nil, errors.Errorf("no ConstraintTemplate defines the kind of %s Constraint %q", c.Kind, c.Metadata.Name)
+		}
+		p, err := ast.InterfaceToValue(c.Spec.Parameters)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid parameters of %s Constraint %q", c.Kind, c.Metadata.Name)
+		}
+		constraints = append(constraints, c)
+		parameters[c] = p
+	}
+
+	desired := req.GetDesired().GetResources()
+	names := make([]string, 0, len(desired))
+	for n := range desired {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	var results []ruleResult
+	for _, name := range names {
+		u := &unstructured.Unstructured{Object: desired[name].GetResource().AsMap()}
+		review := admissionReview(u, desired[name].GetResource(), req.GetObserved().GetResources()[name].GetResource())
+		for _, c := range constraints {
+			ok, err := c.Spec.Match.matches(u)
+			if err != nil {
+				return nil, errors.Wrapf(err, "cannot match %s Constraint %q", c.Kind, c.Metadata.Name)
+			}
+			if !ok {
+				continue
+			}
+			input := ast.NewObject(
+				ast.Item(ast.StringTerm("review"), ast.NewTerm(review)),
+				ast.Item(ast.StringTerm("parameters"), ast.NewTerm(parameters[c])),
+			)
+			rs, err := templates[c.Kind].Eval(ctx, rego.EvalParsedInput(input))
+			if err != nil {
+				return nil, errors.Wrapf(err, "cannot evaluate %s Constraint %q", c.Kind, c.Metadata.Name)
+			}
+			if len(rs) != 1 {
+				return nil, errors.Errorf("expected a single result from %s Constraint %q, got %d", c.Kind, c.Metadata.Name, len(rs))
+			}
+			violations, _ := rs[0].Bindings[violationRule].([]any)
+			for _, v := range violations {
+				msg := memberMessage(v)
+				if msg == "" {
+					msg = "violation of constraint"
+				}
+				msg = fmt.Sprintf("[%s] composed resource %q: %s", c.Metadata.Name, name, msg)
+				switch c.Spec.EnforcementAction {
+				case v1beta1.EnforcementActionDryRun:
+					f.log.Info("Dropping Gatekeeper constraint violation", "enforcementAction", c.Spec.EnforcementAction, "message", msg)
+				case v1beta1.EnforcementActionWarn:
+					results = append(results, ruleResult{policyID: c.Metadata.Name, result: &fnv1beta1.Result{Severity: fnv1beta1.Severity_SEVERITY_WARNING, Message: msg}})
+				default:
+					results = append(results, ruleResult{policyID: c.Metadata.Name, result: &fnv1beta1.Result{Severity: fnv1beta1.Severity_SEVERITY_FATAL, Message: msg}})
+				}
+			}
+		}
+	}
+	return results, nil
+}
+
+// prepareTemplate compiles the Rego of the supplied ConstraintTemplate, and
+// prepares a query binding its violation rule. It returns the kind of the
+// Constraints the template defines.
+func (f *Function) prepareTemplate(ctx context.Context, ct *constraintTemplate) (string, rego.PreparedEvalQuery, error) {
+	if gv, _ := schema.ParseGroupVersion(ct.APIVersion); gv.Group != constraintTemplateGroup || ct.Kind != "ConstraintTemplate" {
+		return "", rego.PreparedEvalQuery{}, errors.Errorf("must be a %s ConstraintTemplate, got %s %s", constraintTemplateGroup, ct.APIVersion, ct.Kind)
+	}
+	kind := ct.Spec.CRD.Spec.Names.Kind
+	if kind == "" {
+		return "", rego.PreparedEvalQuery{}, errors.New("spec.crd.spec.names.kind is required")
+	}
+	if len(ct.Spec.Targets) != 1 || ct.Spec.Targets[0].Target != gatekeeperTarget {
+		return "", rego.PreparedEvalQuery{}, errors.Errorf("must have a single %s target", gatekeeperTarget)
+	}
+
+	// Modules are named after the template so that compiled templates can be
+	// told apart, and are cached like the scripts of Compositions.
+	t := ct.Spec.Targets[0]
+	main := ct.Metadata.Name + ".rego"
+	scripts := map[string]string{main: t.Rego}
+	for i, lib := range t.Libs {
+		scripts[fmt.Sprintf("%s_lib%d.rego", ct.Metadata.Name, i)] = lib
+	}
+	p, _, err := f.policies.compile(nil, scripts)
+	if err != nil {
+		return "", rego.PreparedEvalQuery{}, errors.Wrap(err, "cannot compile rego")
+	}
+
+	rule := p.compiler.Modules[main].Package.Path.Append(ast.StringTerm(violationRule))
+	if len(p.compiler.GetRulesExact(rule)) == 0 {
+		return "", rego.PreparedEvalQuery{}, errors.Errorf("rego must define the %s rule", violationRule)
+	}
+	q, err := p.prepareViolations(ctx, rule)
+	return kind, q, errors.Wrap(err, "cannot prepare rego query")
+}
+
+// prepareViolations prepares a query binding the supplied violation rule of the
+// policy, unless it already was. The prepared query is cached with the policy,
+// so that templates are only prepared once as long as they're cached.
+func (p *policy) prepareViolations(ctx context.Context, rule ast.Ref) (rego.PreparedEvalQuery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.violations != nil {
+		return *p.violations, nil
+	}
+	q, err := rego.New(rego.Compiler(p.compiler), rego.Query(fmt.Sprintf("%s = %s", violationRule, rule))).PrepareForEval(ctx)
+	if err != nil {
+		return rego.PreparedEvalQuery{}, err
+	}
+	p.violations = &q
+	return q, nil
+}
+
+// validConstraint returns an error if the supplied Constraint can't be
+// evaluated by the Function.
+func validConstraint(c *constraint) error {
+	if gv, _ := schema.ParseGroupVersion(c.APIVersion); gv.Group != constraintGroup {
+		return errors.Errorf("apiVersion %q must be of group %s", c.APIVersion, constraintGroup)
+	}
+	if c.Spec.EnforcementAction == "" {
+		c.Spec.EnforcementAction = v1beta1.EnforcementActionDeny
+	}
+	if err := validEnforcementAction(c.Spec.EnforcementAction); err != nil {
+		return err
+	}
+	if c.Spec.Match.NamespaceSelector != nil {
+		return errors.New("spec.match.namespaceSelector is not supported")
+	}
+	return nil
+}
+
+// admissionReview returns the Gatekeeper review of the supplied desired
+// composed resource, as if it were being created, or updated if it was
+// observed.
+func admissionReview(u *unstructured.Unstructured, desired, observed *structpb.Struct) ast.Value {
+	gvk := u.GroupVersionKind()
+	op := "CREATE"
+	if observed != nil {
+		op = "UPDATE"
+	}
+	review := ast.NewObject(
+		ast.Item(ast.StringTerm("kind"), ast.ObjectTerm(
+			ast.Item(ast.StringTerm("group"), ast.StringTerm(gvk.Group)),
+			ast.Item(ast.StringTerm("version"), ast.StringTerm(gvk.Version)),
+			ast.Item(ast.StringTerm("kind"), ast.StringTerm(gvk.Kind)),
+		)),
+		ast.Item(ast.StringTerm("name"), ast.StringTerm(u.GetName())),
+		ast.Item(ast.StringTerm("namespace"), ast.StringTerm(u.GetNamespace())),
+		ast.Item(ast.StringTerm("operation"), ast.StringTerm(op)),
+		ast.Item(ast.StringTerm("object"), ast.NewTerm(structValue(desired))),
+	)
+	if observed != nil {
+		review.Insert(ast.StringTerm("oldObject"), ast.NewTerm(structValue(observed)))
+	}
+	return review
+}
+
+// matches returns true if the supplied resource is matched, using the same
+// semantics as Gatekeeper. Namespace criteria only apply to namespaced
+// resources.
+func (m constraintMatch) matches(u *unstructured.Unstructured) (bool, error) {
+	if !m.matchesKind(u.GroupVersionKind()) {
+		return false, nil
+	}
+
+	ns := u.GetNamespace()
+	switch m.Scope {
+	case "Cluster":
+		if ns != "" {
+			return false, nil
+		}
+	case "Namespaced":
+		if ns == "" {
+			return false, nil
+		}
+	}
+	if ns != "" {
+		if len(m.Namespaces) > 0 && !matchesAny(m.Namespaces, ns) {
+			return false, nil
+		}
+		if matchesAny(m.ExcludedNamespaces, ns) {
+			return false, nil
+		}
+	}
+
+	if m.Name != "" && !matchesGlob(m.Name, u.GetName()) {
+		return false, nil
+	}
+
+	if m.LabelSelector == nil {
+		return true, nil
+	}
+	sel, err := metav1.LabelSelectorAsSelector(m.LabelSelector)
+	if err != nil {
+		return false, errors.Wrap(err, "invalid spec.match.labelSelector")
+	}
+	return sel.Matches(labels.Set(u.GetLabels())), nil
+}
+
+func (m constraintMatch) matchesKind(gvk schema.GroupVersionKind) bool {
+	if len(m.Kinds) == 0 {
+		return true
+	}
+	for _, k := range m.Kinds {
+		if containsOrWildcard(k.APIGroups, gvk.Group) && containsOrWildcard(k.Kinds, gvk.Kind) {
+			return true
+		}
+	}
+	return false
+}
+
+// containsOrWildcard returns true if the supplied values contain the supplied
+// value or the * wildcard.
+func containsOrWildcard(values []string, v string) bool {
+	for _, s := range values {
+		if s == v || s == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesAny returns true if any of the supplied glob patterns matches the
+// supplied value.
+func matchesAny(patterns []string, v string) bool {
+	for _, p := range patterns {
+		if matchesGlob(p, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesGlob matches the supplied value against the supplied pattern, which
+// can start or end with a * wildcard, like Gatekeeper's namespace and name
+// criteria.
+func matchesGlob(pattern, v string) bool {
+	switch {
+	case strings.HasSuffix(pattern, "*"):
+		return strings.HasPrefix(v, strings.TrimSuffix(pattern, "*"))
+	case strings.HasPrefix(pattern, "*"):
+		return strings.HasSuffix(v, strings.TrimPrefix(pattern, "*"))
+	}
+	return pattern == v
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/protobuf/testing/protocmp"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+
+	fnv1beta1 "github.com/crossplane/function-sdk-go/proto/v1beta1"
+	"github.com/crossplane/function-sdk-go/resource"
+
+	"github.com/crossplane/function-rego/input/v1beta1"
+)
+
+const requiredLabelsTemplate = `{
+	"apiVersion": "templates.gatekeeper.sh/v1",
+	"kind": "ConstraintTemplate",
+	"metadata": {"name": "k8srequiredlabels"},
+	"spec": {
+		"crd": {"spec": {"names": {"kind": "K8sRequiredLabels"}}},
+		"targets": [{
+			"target": "admission.k8s.gatekeeper.sh",
+			"rego": "package k8srequiredlabels\n\nimport data.lib.labels\n\nviolation[{\"msg\": msg}] {\n  missing := labels.missing(input.review.object, input.parameters.labels)\n  count(missing) > 0\n  msg := sprintf(\"you must provide labels: %v\", [missing])\n}\n",
+			"libs": ["package lib.labels\n\nmissing(obj, required) = m {\n  provided := {l | obj.metadata.labels[l]}\n  m := {l | l := required[_]} - provided\n}\n"]
+		}]
+	}
+}`
+
+func TestRunFunctionWithGatekeeper(t *testing.T) {
+	reqWithTemplates := func(templates []string, constraint string) *fnv1beta1.RunFunctionRequest {
+		cts := make([]runtime.RawExtension, len(templates))
+		for i, ct := range templates {
+			cts[i] = runtime.RawExtension{Raw: []byte(ct)}
+		}
+		return &fnv1beta1.RunFunctionRequest{
+			Input: resource.MustStructObject(&v1beta1.Input{
+				TypeMeta: inputTypeMeta,
+				Spec: v1beta1.InputSpec{Gatekeeper: &v1beta1.Gatekeeper{
+					ConstraintTemplates: cts,
+					Constraints:         []runtime.RawExtension{{Raw: []byte(constraint)}},
+				}},
+			}),
+			Desired: &fnv1beta1.State{Resources: map[string]*fnv1beta1.Resource{
+				"bucket": {Resource: resource.MustStructJSON(`{
+					"apiVersion": "s3.aws.upbound.io/v1beta1",
+					"kind": "Bucket",
+					"metadata": {"labels": {"team": "platform"}}
+				}`)},
+				"config": {Resource: resource.MustStructJSON(`{
+					"apiVersion": "v1",
+					"kind": "ConfigMap",
+					"metadata": {"namespace": "kube-system", "labels": {"tier": "prod"}}
+				}`)},
+				"db": {Resource: resource.MustStructJSON(`{
+					"apiVersion": "rds.aws.upbound.io/v1beta1",
+					"kind": "Instance",
+					"metadata": {"labels": {"owner": "team-a"}}
+				}`)},
+			}},
+		}
+	}
+	req := func(constraint string) *fnv1beta1.RunFunctionRequest {
+		return reqWithTemplates([]string{requiredLabelsTemplate}, constraint)
+	}
+	fatal := func(msg string) *fnv1beta1.Result {
+		return &fnv1beta1.Result{Severity: fnv1beta1.Severity_SEVERITY_FATAL, Message: msg}
+	}
+	warning := func(msg string) *fnv1beta1.Result {
+		return &fnv1beta1.Result{Severity: fnv1beta1.Severity_SEVERITY_WARNING, Message: msg}
+	}
+
+	cases := map[string]struct {
+		reason string
+		req    *fnv1beta1.RunFunctionRequest
+		want   []*fnv1beta1.Result
+	}{
+		"MatchKinds": {
+			reason: "Constraints should only be evaluated against resources of the kinds they match",
+			req: req(`{
+				"apiVersion": "constraints.gatekeeper.sh/v1beta1",
+				"kind": "K8sRequiredLabels",
+				"metadata": {"name": "must-have-owner"},
+				"spec": {
+					"match": {"kinds": [{"apiGroups": ["s3.aws.upbound.io"], "kinds": ["Bucket"]}]},
+					"parameters": {"labels": ["owner"]}
+				}
+			}`),
+			want: []*fnv1beta1.Result{fatal(`[must-have-owner] composed resource "bucket": you must provide labels: {"owner"}`)},
+		},
+		"Warn": {
+			reason: "Violations of constraints with the warn enforcement action should be returned as warnings",
+			req: req(`{
+				"apiVersion": "constraints.gatekeeper.sh/v1beta1",
+				"kind": "K8sRequiredLabels",
+				"metadata": {"name": "must-have-owner"},
+				"spec": {"enforcementAction": "warn", "parameters": {"labels": ["owner"]}}
+			}`),
+			want: []*fnv1beta1.Result{
+				warning(`[must-have-owner] composed resource "bucket": you must provide labels: {"owner"}`),
+				warning(`[must-have-owner] composed resource "config": you must provide labels: {"owner"}`),
+			},
+		},
+		"DryRun": {
+			reason: "Violations of constraints with the dryrun enforcement action should only be logged",
+			req: req(`{
+				"apiVersion": "constraints.gatekeeper.sh/v1beta1",
+				"kind": "K8sRequiredLabels",
+				"metadata": {"name": "must-have-owner"},
+				"spec": {"enforcementAction": "dryrun", "parameters": {"labels": ["owner"]}}
+			}`),
+		},
+		"ExcludedNamespaces": {
+			reason: "Constraints should not be evaluated against resources in excluded namespaces",
+			req: req(`{
+				"apiVersion": "constraints.gatekeeper.sh/v1beta1",
+				"kind": "K8sRequiredLabels",
+				"metadata": {"name": "must-have-owner"},
+				"spec": {"match": {"excludedNamespaces": ["kube-*"]}, "parameters": {"labels": ["owner"]}}
+			}`),
+			want: []*fnv1beta1.Result{fatal(`[must-have-owner] composed resource "bucket": you must provide labels: {"owner"}`)},
+		},
+		"LabelSelector": {
+			reason: "Constraints should only be evaluated against resources matching their label selector",
+			req: req(`{
+				"apiVersion": "constraints.gatekeeper.sh/v1beta1",
+				"kind": "K8sRequiredLabels",
+				"metadata": {"name": "must-have-owner"},
+				"spec": {"match": {"labelSelector": {"matchLabels": {"tier": "prod"}}}, "parameters": {"labels": ["owner"]}}
+			}`),
+			want: []*fnv1beta1.Result{fatal(`[must-have-owner] composed resource "config": you must provide labels: {"owner"}`)},
+		},
+		"DuplicateKind": {
+			reason: "ConstraintTemplates defining the same kind should return a fatal result rather than one being dropped",
+			req: reqWithTemplates([]string{
+				requiredLabelsTemplate,
+				strings.Replace(requiredLabelsTemplate, `"name": "k8srequiredlabels"`, `"name": "k8srequiredlabels-v2"`, 1),
+			}, `{
+				"apiVersion": "constraints.gatekeeper.sh/v1beta1",
+				"kind": "K8sRequiredLabels",
+				"metadata": {"name": "must-have-owner"},
+				"spec": {"parameters": {"labels": ["owner"]}}
+			}`),
+			want: []*fnv1beta1.Result{fatal(`cannot evaluate Gatekeeper constraints: ConstraintTemplates "k8srequiredlabels" and "k8srequiredlabels-v2" both define kind K8sRequiredLabels`)},
+		},
+		"NoTemplate": {
+			reason: "Constraints of a kind no template defines should return a fatal result",
+			req: req(`{
+				"apiVersion": "constraints.gatekeeper.sh/v1beta1",
+				"kind": "K8sAllowedRepos",
+				"metadata": {"name": "allowed-repos"}
+			}`),
+			want: []*fnv1beta1.Result{fatal(`cannot evaluate Gatekeeper constraints: no ConstraintTemplate defines the kind of K8sAllowedRepos Constraint "allowed-repos"`)},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			f := &Function{log: logging.NewNopLogger(), policies: newPolicyCache(1)}
+			rsp, err := f.RunFunction(context.Background(), tc.req)
+			if err != nil {
+				t.Fatalf("%s\nf.RunFunction(...): %v", tc.reason, err)
+			}
+			if diff := cmp.Diff(tc.want, rsp.GetResults(), protocmp.Transform()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want results, +got results:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestRunFunctionWithGatekeeperAndLibrary(t *testing.T) {
+	mods, err := parseModules(map[string]string{
+		"helpers.rego": "package lib.helpers\n\nowner(obj) = obj.metadata.labels.owner\n",
+	})
+	if err != nil {
+		t.Fatalf("parseModules(...): %v", err)
+	}
+	lib, err := newLibrary(mods, nil)
+	if err != nil {
+		t.Fatalf("newLibrary(...): %v", err)
+	}
+
+	f := &Function{log: logging.NewNopLogger(), policies: newPolicyCache(1)}
+	f.library.Store(lib)
+	req := &fnv1beta1.RunFunctionRequest{
+		Input: resource.MustStructObject(&v1beta1.Input{
+			TypeMeta: inputTypeMeta,
+			Spec: v1beta1.InputSpec{Gatekeeper: &v1beta1.Gatekeeper{
+				ConstraintTemplates: []runtime.RawExtension{{Raw: []byte(requiredLabelsTemplate)}},
+				Constraints: []runtime.RawExtension{{Raw: []byte(`{
+					"apiVersion": "constraints.gatekeeper.sh/v1beta1",
+					"kind": "K8sRequiredLabels",
+					"metadata": {"name": "must-have-owner"},
+					"spec": {"parameters": {"labels": ["owner"]}}
+				}`)}},
+			}},
+		}),
+		Desired: &fnv1beta1.State{Resources: map[string]*fnv1beta1.Resource{
+			"bucket": {Resource: resource.MustStructJSON(`{
+				"apiVersion": "s3.aws.upbound.io/v1beta1",
+				"kind": "Bucket",
+				"metadata": {"labels": {"team": "platform"}}
+			}`)},
+		}},
+	}
+
+	rsp, err := f.RunFunction(context.Background(), req)
+	if err != nil {
+		t.Fatalf("f.RunFunction(...): %v", err)
+	}
+	want := []*fnv1beta1.Result{
+		{Severity: fnv1beta1.Severity_SEVERITY_FATAL, Message: `[must-have-owner] composed resource "bucket": you must provide labels: {"owner"}`},
+	}
+	if diff := cmp.Diff(want, rsp.GetResults(), protocmp.Transform()); diff != "" {
+		t.Errorf("Only constraints should be evaluated if the policy library defines no policy\nf.RunFunction(...): -want results, +got results:\n%s", diff)
+	}
+}
+
+func TestPrepareTemplateCached(t *testing.T) {
+	ct := &constraintTemplate{}
+	if err := json.Unmarshal([]byte(requiredLabelsTemplate), ct); err != nil {
+		t.Fatalf("json.Unmarshal(...): %v", err)
+	}
+	f := &Function{log: logging.NewNopLogger(), policies: newPolicyCache(1)}
+
+	if _, _, err := f.prepareTemplate(context.Background(), ct); err != nil {
+		t.Fatalf("f.prepareTemplate(...): %v", err)
+	}
+	if _, _, err := f.prepareTemplate(context.Background(), ct); err != nil {
+		t.Fatalf("f.prepareTemplate(...): %v", err)
+	}
+
+	// Templates are compiled like scripts named after them.
+	tgt := ct.Spec.Targets[0]
+	p, cached, err := f.policies.compile(nil, map[string]string{"k8srequiredlabels.rego": tgt.Rego, "k8srequiredlabels_lib0.rego": tgt.Libs[0]})
+	if err != nil {
+		t.Fatalf("f.policies.compile(...): %v", err)
+	}
+	if !cached || p.violations == nil {
+		t.Errorf("f.prepareTemplate(...): want the prepared query to be cached with the compiled policy")
+	}
+}
@@ -0,0 +1,485 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport/client"
+	gitserver "github.com/go-git/go-git/v5/plumbing/transport/server"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+
+	"github.com/crossplane/function-rego/input/v1beta1"
+)
+
+func init() {
+	// Serve file:// URLs in-process rather than by running git-upload-pack,
+	// which isn't available in the Function image.
+	client.InstallProtocol("file", gitserver.DefaultServer)
+}
+
+// gitFetchTimeout bounds how long a background fetch of a repository can take.
+const gitFetchTimeout = 5 * time.Minute
+
+// A gitSource loads policies from directories of git repositories. Each
+// repository is mirrored to a cache directory. Branches and tags are fetched
+// when first requested, then in the background at most once per refresh
+// interval, serving the commits they last resolved to meanwhile. Refs that
+// can't be resolved are fetched at most once per refresh interval too. The
+// directory loaded at each commit is checked out to the cache directory under
+// its tree hash, and the most recently used libraries are cached in memory.
+type gitSource struct {
+	log logging.Logger
+
+	// cache is the directory repositories are mirrored to, under repos, and
+	// directories checked out to, under trees.
+	cache string
+
+	// interval is how often branches and tags are refreshed.
+	interval time.Duration
+
+	// size is the maximum number of libraries cached in memory. Unbounded if
+	// not positive.
+	size int
+
+	// allowed are the prefixes of the repositories libraries may be loaded
+	// from. Any repository is allowed if empty.
+	allowed []string
+
+	// refreshes tracks background fetches.
+	refreshes sync.WaitGroup
+
+	// mu guards the mirrors and libraries, but not access to each mirror,
+	// so that repositories are fetched concurrently.
+	mu        sync.Mutex
+	repos     map[string]*gitRepo
+	libraries *lru[string, *library]
+}
+
+// A gitRepo is a mirror of a repository.
+type gitRepo struct {
+	url string
+	dir string
+
+	// fetching serializes fetches of the mirror. Each fetch uses its own
+	// handle of the mirror, so that the mirror can be read meanwhile.
+	fetching sync.Mutex
+
+	// mu serializes access to the handle of the mirror, e.g. to resolve refs
+	// and check out commits. It's replaced by the handle of each successful
+	// fetch, which knows about the objects it fetched.
+	mu sync.Mutex
+	r  *git.Repository
+
+	// state guards the fields below, which can be read while the mirror is
+	// fetched.
+	state sync.Mutex
+
+	// fetched is when the mirror was last fetched, successfully or not.
+	fetched time.Time
+
+	// refreshing is true while the mirror is fetched in the background.
+	refreshing bool
+
+	// refs are the commits the requested branches and tags resolved to
+	// when the mirror was last fetched successfully.
+	refs map[string]plumbing.Hash
+
+	// unresolved are the refs that couldn't be resolved after fetching the
+	// mirror, so that they aren't fetched again before the refresh interval
+	// elapsed.
+	unresolved map[string]unresolvedRef
+}
+
+// An unresolvedRef is a ref that couldn't be resolved.
+type unresolvedRef struct {
+	at  time.Time
+	err error
+}
+
+// library returns the policy library loaded from the supplied source.
+func (s *gitSource) library(ctx context.Context, src *v1beta1.GitSource) (*library, error) {
+	if src.Repo == "" || src.Ref == "" {
+		return nil, errors.New("a repo and a ref are required")
+	}
+	if !hasAllowedPrefix(src.Repo, s.allowed) {
+		return nil, errors.Errorf("git repository %q is not allowed", src.Repo)
+	}
+	dir := strings.Trim(path.Clean("/"+src.Path), "/")
+
+	// Commits never change, so libraries loaded at a commit are served
+	// without looking at the mirror, which may be fetched meanwhile.
+	if plumbing.IsHash(src.Ref) {
+		if lib, ok := s.cached(plumbing.NewHash(src.Ref), dir); ok {
+			return lib, nil
+		}
+	}
+
+	s.mu.Lock()
+	repo, err := s.repo(src.Repo)
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	h, ok := repo.ref(src.Ref)
+	switch {
+	case ok:
+		if repo.startRefresh(s.interval) {
+			s.refreshes.Add(1)
+			go s.refresh(repo)
+		}
+	default:
+		h, err = s.resolve(ctx, repo, src.Ref)
+		if err != nil {
+			return nil, err
+		}
+		if !plumbing.IsHash(src.Ref) {
+			repo.setRef(src.Ref, h)
+		}
+	}
+
+	if lib, ok := s.cached(h, dir); ok {
+		return lib, nil
+	}
+
+	repo.mu.Lock()
+	co, err := s.checkout(repo, h, dir)
+	repo.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	lib, err := loadLibrary(co)
+	if err != nil {
+		return nil, err
+	}
+	lib.source = &querySource{Commit: h.String()}
+
+	s.mu.Lock()
+	s.libraries.add(gitLibraryKey(h, dir), lib)
+	s.mu.Unlock()
+	s.log.Info("Loaded policies from git repository", "repo", src.Repo, "ref", src.Ref, "path", dir, "commit", h.String(), "modules", len(lib.modules))
+	return lib, nil
+}
+
+// cached returns the library loaded from the supplied directory of the
+// supplied commit, if it's cached in memory.
+func (s *gitSource) cached(h plumbing.Hash, dir string) (*library, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.libraries == nil {
+		s.libraries = newLRU[string, *library](s.size)
+	}
+	return s.libraries.get(gitLibraryKey(h, dir))
+}
+
+func gitLibraryKey(h plumbing.Hash, dir string) string {
+	return h.String() + ":" + dir
+}
+
+// refresh fetches the supplied mirror, then resolves the branches and tags
+// requested so far again. Refs keep resolving to their previous commit if the
+// mirror can't be fetched, or they can't be resolved anymore.
+func (s *gitSource) refresh(repo *gitRepo) {
+	defer s.refreshes.Done()
+	defer func() {
+		repo.state.Lock()
+		repo.refreshing = false
+		repo.state.Unlock()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), gitFetchTimeout)
+	defer cancel()
+
+	repo.fetching.Lock()
+	defer repo.fetching.Unlock()
+
+	if err := repo.fetch(ctx); err != nil {
+		s.log.Info("Cannot fetch git repository, using previously fetched refs", "repo", repo.url, "error", err)
+		return
+	}
+
+	repo.state.Lock()
+	refs := make([]string, 0, len(repo.refs))
+	for ref := range repo.refs {
+		refs = append(refs, ref)
+	}
+	repo.state.Unlock()
+
+	for _, ref := range refs {
+		h, err := repo.resolveRef(ref)
+		if err != nil {
+			s.log.Info("Cannot resolve ref of git repository, using previously resolved commit", "repo", repo.url, "ref", ref, "error", err)
+			continue
+		}
+		repo.setRef(ref, h)
+	}
+}
+
+// repo returns the mirror of the repository at the supplied URL, creating it if
+// it doesn't exist yet. New mirrors are fetched on first use.
+func (s *gitSource) repo(url string) (*gitRepo, error) {
+	if repo, ok := s.repos[url]; ok {
+		return repo, nil
+	}
+
+	sum := sha256.Sum256([]byte(url))
+	dir := filepath.Join(s.cache, "repos", hex.EncodeToString(sum[:])[:16])
+	r, err := git.PlainOpen(dir)
+	if errors.Is(err, git.ErrRepositoryNotExists) {
+		r, err = initMirror(dir, url)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot open mirror of git repository %q", url)
+	}
+
+	if s.repos == nil {
+		s.repos = map[string]*gitRepo{}
+	}
+	repo := &gitRepo{url: url, dir: dir, r: r, refs: map[string]plumbing.Hash{}, unresolved: map[string]unresolvedRef{}}
+	s.repos[url] = repo
+	return repo, nil
+}
+
+// initMirror creates a bare repository in the supplied directory that mirrors
+// the branches and tags of the repository at the supplied URL.
+func initMirror(dir, url string) (*git.Repository, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, err
+	}
+	r, err := git.PlainInit(dir, true)
+	if err != nil {
+		return nil, err
+	}
+	_, err = r.CreateRemote(&config.RemoteConfig{
+		Name: git.DefaultRemoteName,
+		URLs: []string{url},
+		Fetch: []config.RefSpec{
+			"+refs/heads/*:refs/heads/*",
+			"+refs/tags/*:refs/tags/*",
+		},
+	})
+	return r, err
+}
+
+// resolve the supplied ref to a commit, fetching the repository first unless
+// the ref can be resolved without fetching it. Refs fetched previously,
+// possibly by another process, are used if the repository can't be fetched.
+func (s *gitSource) resolve(ctx context.Context, repo *gitRepo, ref string) (plumbing.Hash, error) {
+	if h, ok, err := s.resolveLocal(repo, ref); ok {
+		return h, err
+	}
+
+	repo.fetching.Lock()
+	defer repo.fetching.Unlock()
+
+	// The mirror may have been fetched while waiting for the lock.
+	if h, ok, err := s.resolveLocal(repo, ref); ok {
+		return h, err
+	}
+
+	ferr := repo.fetch(ctx)
+	if ferr != nil {
+		s.log.Info("Cannot fetch git repository, using previously fetched refs", "repo", repo.url, "error", ferr)
+	}
+
+	h, err := repo.resolveRef(ref)
+	switch {
+	case err != nil && ferr != nil:
+		err = errors.Wrapf(ferr, "cannot fetch git repository %q", repo.url)
+	case err != nil:
+		err = errors.Wrapf(err, "cannot resolve ref %q of git repository %q", ref, repo.url)
+	}
+	repo.setUnresolved(ref, err)
+	return h, err
+}
+
+// resolveLocal resolves the supplied ref without fetching the mirror. Commits
+// already fetched are resolved, as are branches and tags already fetched until
+// the refresh interval elapsed since the mirror was last fetched. Refs that
+// couldn't be resolved after a fetch within the refresh interval fail with the
+// same error. It returns false if the mirror should be fetched otherwise.
+func (s *gitSource) resolveLocal(repo *gitRepo, ref string) (plumbing.Hash, bool, error) {
+	h, err := repo.resolveRef(ref)
+	if err != nil {
+		if err := repo.unresolvedErr(ref, s.interval); err != nil {
+			return plumbing.ZeroHash, true, err
+		}
+		return plumbing.ZeroHash, false, nil
+	}
+	if plumbing.IsHash(ref) {
+		return h, true, nil
+	}
+	repo.state.Lock()
+	due := time.Since(repo.fetched) >= s.interval
+	repo.state.Unlock()
+	return h, !due, nil
+}
+
+// resolveRef resolves the supplied ref to a commit already fetched.
+func (r *gitRepo) resolveRef(ref string) (plumbing.Hash, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if plumbing.IsHash(ref) {
+		h := plumbing.NewHash(ref)
+		_, err := r.r.CommitObject(h)
+		return h, err
+	}
+	h, err := r.r.ResolveRevision(plumbing.Revision(ref))
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return *h, nil
+}
+
+// fetch the branches and tags of the mirror using a new handle of the mirror,
+// which replaces the current one if the fetch succeeds. The caller must hold
+// the mirror's fetching lock.
+func (r *gitRepo) fetch(ctx context.Context) error {
+	fr, err := git.PlainOpen(r.dir)
+	if err == nil {
+		err = fr.FetchContext(ctx, &git.FetchOptions{RemoteName: git.DefaultRemoteName, Force: true})
+		if errors.Is(err, git.NoErrAlreadyUpToDate) {
+			err = nil
+		}
+	}
+	if err == nil {
+		r.mu.Lock()
+		r.r = fr
+		r.mu.Unlock()
+	}
+	r.state.Lock()
+	r.fetched = time.Now()
+	r.state.Unlock()
+	return err
+}
+
+// ref returns the commit the supplied branch or tag last resolved to, if any.
+func (r *gitRepo) ref(ref string) (plumbing.Hash, bool) {
+	r.state.Lock()
+	defer r.state.Unlock()
+	h, ok := r.refs[ref]
+	return h, ok
+}
+
+func (r *gitRepo) setRef(ref string, h plumbing.Hash) {
+	r.state.Lock()
+	defer r.state.Unlock()
+	r.refs[ref] = h
+}
+
+// unresolvedErr returns why the supplied ref couldn't be resolved, if it
+// couldn't be after a fetch within the supplied interval.
+func (r *gitRepo) unresolvedErr(ref string, interval time.Duration) error {
+	r.state.Lock()
+	defer r.state.Unlock()
+	u, ok := r.unresolved[ref]
+	if !ok || time.Since(u.at) >= interval {
+		return nil
+	}
+	return u.err
+}
+
+// setUnresolved records why the supplied ref couldn't be resolved after a
+// fetch, or that it could if the supplied error is nil.
+func (r *gitRepo) setUnresolved(ref string, err error) {
+	r.state.Lock()
+	defer r.state.Unlock()
+	if err == nil {
+		delete(r.unresolved, ref)
+		return
+	}
+	r.unresolved[ref] = unresolvedRef{at: time.Now(), err: err}
+}
+
+// startRefresh returns true if the mirror should be fetched in the background
+// because the supplied interval elapsed since it was last fetched, and it
+// isn't being fetched already.
+func (r *gitRepo) startRefresh(interval time.Duration) bool {
+	r.state.Lock()
+	defer r.state.Unlock()
+	if r.refreshing || time.Since(r.fetched) < interval {
+		return false
+	}
+	r.refreshing = true
+	return true
+}
+
+// checkout the supplied directory of the supplied commit to the cache
+// directory, unless it already was, returning the directory it was checked out
+// to. Only regular files are checked out.
+func (s *gitSource) checkout(repo *gitRepo, h plumbing.Hash, dir string) (string, error) {
+	c, err := repo.r.CommitObject(h)
+	if err != nil {
+		return "", errors.Wrapf(err, "cannot get commit %s of git repository %q", h, repo.url)
+	}
+	t, err := c.Tree()
+	if err != nil {
+		return "", errors.Wrapf(err, "cannot get tree of commit %s of git repository %q", h, repo.url)
+	}
+	if dir != "" {
+		if t, err = t.Tree(dir); err != nil {
+			return "", errors.Wrapf(err, "cannot get directory %q of commit %s of git repository %q", dir, h, repo.url)
+		}
+	}
+
+	co := filepath.Join(s.cache, "trees", t.Hash.String())
+	if _, err := os.Stat(co); err == nil {
+		return co, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(co), 0o750); err != nil {
+		return "", errors.Wrap(err, "cannot create git cache directory")
+	}
+	tmp, err := os.MkdirTemp(filepath.Dir(co), "."+t.Hash.String()+"-")
+	if err != nil {
+		return "", errors.Wrap(err, "cannot create git cache directory")
+	}
+	defer os.RemoveAll(tmp) //nolint:errcheck // Nothing to do if we can't remove it.
+
+	err = t.Files().ForEach(func(f *object.File) error {
+		if f.Mode != filemode.Regular && f.Mode != filemode.Executable {
+			return nil
+		}
+		r, err := f.Reader()
+		if err != nil {
+			return errors.Wrapf(err, "cannot read file %q", f.Name)
+		}
+		defer r.Close() //nolint:errcheck // Nothing to do if we can't close it.
+		return errors.Wrapf(writeFile(tmp, f.Name, r), "cannot write file %q", f.Name)
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "cannot check out commit %s of git repository %q", h, repo.url)
+	}
+	// Renaming makes sure a partial checkout is never cached.
+	if err := os.Rename(tmp, co); err != nil {
+		return "", errors.Wrapf(err, "cannot cache commit %s of git repository %q", h, repo.url)
+	}
+	return co, nil
+}
+
+// hasAllowedPrefix returns true if s starts with any of the supplied prefixes,
+// or if none are supplied.
+func hasAllowedPrefix(s string, prefixes []string) bool {
+	if len(prefixes) == 0 {
+		return true
+	}
+	for _, p := range prefixes {
+		if strings.HasPrefix(s, p) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/cache"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/protobuf/testing/protocmp"
+
+	"github.com/crossplane/function-sdk-go"
+	fnv1beta1 "github.com/crossplane/function-sdk-go/proto/v1beta1"
+	"github.com/crossplane/function-sdk-go/resource"
+
+	"github.com/crossplane/function-rego/input/v1beta1"
+)
+
+// A testRepo is a local bare repository, committed to using an in-memory
+// worktree.
+type testRepo struct {
+	t   *testing.T
+	dir string
+	r   *git.Repository
+}
+
+func newTestRepo(t *testing.T) *testRepo {
+	t.Helper()
+
+	dir := t.TempDir()
+	r, err := git.Init(filesystem.NewStorage(osfs.New(dir), cache.NewObjectLRUDefault()), memfs.New())
+	if err != nil {
+		t.Fatalf("git.Init(...): %v", err)
+	}
+	return &testRepo{t: t, dir: dir, r: r}
+}
+
+func (tr *testRepo) url() string {
+	return "file://" + tr.dir
+}
+
+// commit the supplied files to the master branch, returning the commit.
+func (tr *testRepo) commit(files map[string]string) plumbing.Hash {
+	tr.t.Helper()
+
+	w, err := tr.r.Worktree()
+	if err != nil {
+		tr.t.Fatalf("r.Worktree(): %v", err)
+	}
+	for name, content := range files {
+		f, err := w.Filesystem.Create(name)
+		if err != nil {
+			tr.t.Fatal(err)
+		}
+		if _, err := f.Write([]byte(content)); err != nil {
+			tr.t.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			tr.t.Fatal(err)
+		}
+		if _, err := w.Add(name); err != nil {
+			tr.t.Fatalf("w.Add(%q): %v", name, err)
+		}
+	}
+	h, err := w.Commit("Update policies", &git.CommitOptions{Author: &object.Signature{Name: "test", Email: "test@example.org", When: time.Now()}})
+	if err != nil {
+		tr.t.Fatalf("w.Commit(...): %v", err)
+	}
+	return h
+}
+
+func (tr *testRepo) tag(name string, h plumbing.Hash) {
+	tr.t.Helper()
+
+	if _, err := tr.r.CreateTag(name, h, nil); err != nil {
+		tr.t.Fatalf("r.CreateTag(%q, ...): %v", name, err)
+	}
+}
+
+func testGitModule(msg string) string {
+	return "package crossplane\n\ndeny[\"" + msg + "\"] { true }\n"
+}
+
+func TestGitSource(t *testing.T) {
+	log, err := function.NewLogger(true)
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+
+	tr := newTestRepo(t)
+	v1 := tr.commit(map[string]string{
+		"README.md":            "Not a policy",
+		"policies/policy.rego": testGitModule("v1"),
+	})
+	tr.tag("v1", v1)
+	v2 := tr.commit(map[string]string{"policies/policy.rego": testGitModule("v2")})
+
+	type args struct {
+		interval time.Duration
+		allowed  []string
+		src      *v1beta1.GitSource
+	}
+	type want struct {
+		commit plumbing.Hash
+		err    string
+	}
+
+	cases := map[string]struct {
+		reason string
+		args   args
+		want   want
+	}{
+		"Branch": {
+			reason: "Branches should be loaded at their latest commit",
+			args:   args{src: &v1beta1.GitSource{Repo: tr.url(), Ref: "master", Path: "policies"}},
+			want:   want{commit: v2},
+		},
+		"Tag": {
+			reason: "Tags should be loaded at the commit they point to",
+			args:   args{src: &v1beta1.GitSource{Repo: tr.url(), Ref: "v1", Path: "policies"}},
+			want:   want{commit: v1},
+		},
+		"Commit": {
+			reason: "Commits should be loaded as is",
+			args:   args{src: &v1beta1.GitSource{Repo: tr.url(), Ref: v1.String(), Path: "/policies/"}},
+			want:   want{commit: v1},
+		},
+		"UnknownRef": {
+			reason: "Refs that don't exist should be reported",
+			args:   args{src: &v1beta1.GitSource{Repo: tr.url(), Ref: "nope"}},
+			want:   want{err: `cannot resolve ref "nope"`},
+		},
+		"UnknownPath": {
+			reason: "Paths that don't exist should be reported",
+			args:   args{src: &v1beta1.GitSource{Repo: tr.url(), Ref: "master", Path: "nope"}},
+			want:   want{err: `cannot get directory "nope"`},
+		},
+		"UnknownRepo": {
+			reason: "Repositories that can't be fetched should be reported",
+			args:   args{src: &v1beta1.GitSource{Repo: "file://" + t.TempDir(), Ref: "master"}},
+			want:   want{err: "cannot fetch git repository"},
+		},
+		"AllowedRepo": {
+			reason: "Repositories matching an allowed prefix should be loaded",
+			args:   args{allowed: []string{"https://example.org/", tr.url()}, src: &v1beta1.GitSource{Repo: tr.url(), Ref: "master", Path: "policies"}},
+			want:   want{commit: v2},
+		},
+		"DisallowedRepo": {
+			reason: "Repositories matching no allowed prefix should be rejected before they're fetched",
+			args:   args{allowed: []string{"https://example.org/"}, src: &v1beta1.GitSource{Repo: tr.url(), Ref: v1.String()}},
+			want:   want{err: fmt.Sprintf("git repository %q is not allowed", tr.url())},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			s := &gitSource{log: log, cache: t.TempDir(), interval: tc.args.interval, allowed: tc.args.allowed}
+			lib, err := s.library(context.Background(), tc.args.src)
+			if tc.want.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.want.err) {
+					t.Errorf("%s\ns.library(...): want error containing %q, got %v", tc.reason, tc.want.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("%s\ns.library(...): unexpected error: %v", tc.reason, err)
+			}
+			if diff := cmp.Diff(tc.want.commit.String(), lib.source.Commit); diff != "" {
+				t.Errorf("%s\ns.library(...): -want commit, +got commit:\n%s", tc.reason, diff)
+			}
+		})
+	}
+
+	t.Run("Refresh", func(t *testing.T) {
+		tr := newTestRepo(t)
+		v1 := tr.commit(map[string]string{"policy.rego": testGitModule("v1")})
+		src := &v1beta1.GitSource{Repo: tr.url(), Ref: "master"}
+
+		s := &gitSource{log: log, cache: t.TempDir(), interval: time.Hour}
+		if _, err := s.library(context.Background(), src); err != nil {
+			t.Fatalf("s.library(...): %v", err)
+		}
+		v2 := tr.commit(map[string]string{"policy.rego": testGitModule("v2")})
+
+		lib, err := s.library(context.Background(), src)
+		if err != nil {
+			t.Fatalf("s.library(...): %v", err)
+		}
+		if diff := cmp.Diff(v1.String(), lib.source.Commit); diff != "" {
+			t.Errorf("s.library(...): want branch not to be refreshed before the interval elapsed: -want commit, +got commit:\n%s", diff)
+		}
+
+		// Once the interval elapsed the branch should be refreshed in the
+		// background, serving the commit it last resolved to meanwhile.
+		s.interval = 0
+		lib, err = s.library(context.Background(), src)
+		if err != nil {
+			t.Fatalf("s.library(...): %v", err)
+		}
+		if diff := cmp.Diff(v1.String(), lib.source.Commit); diff != "" {
+			t.Errorf("s.library(...): want the last resolved commit to be served while refreshing: -want commit, +got commit:\n%s", diff)
+		}
+		s.refreshes.Wait()
+
+		lib, err = s.library(context.Background(), src)
+		if err != nil {
+			t.Fatalf("s.library(...): %v", err)
+		}
+		s.refreshes.Wait()
+		if diff := cmp.Diff(v2.String(), lib.source.Commit); diff != "" {
+			t.Errorf("s.library(...): want branch to be refreshed after the interval elapsed: -want commit, +got commit:\n%s", diff)
+		}
+	})
+
+	t.Run("NewCommit", func(t *testing.T) {
+		tr := newTestRepo(t)
+		tr.commit(map[string]string{"policy.rego": testGitModule("v1")})
+
+		s := &gitSource{log: log, cache: t.TempDir(), interval: time.Hour}
+		if _, err := s.library(context.Background(), &v1beta1.GitSource{Repo: tr.url(), Ref: "master"}); err != nil {
+			t.Fatalf("s.library(...): %v", err)
+		}
+		v2 := tr.commit(map[string]string{"policy.rego": testGitModule("v2")})
+
+		// Commits pushed since the last fetch should be fetched regardless of
+		// the refresh interval.
+		lib, err := s.library(context.Background(), &v1beta1.GitSource{Repo: tr.url(), Ref: v2.String()})
+		if err != nil {
+			t.Fatalf("s.library(...): want commits unknown to the mirror to be fetched, got error: %v", err)
+		}
+		if diff := cmp.Diff(v2.String(), lib.source.Commit); diff != "" {
+			t.Errorf("s.library(...): -want commit, +got commit:\n%s", diff)
+		}
+	})
+
+	t.Run("UnresolvedRef", func(t *testing.T) {
+		tr := newTestRepo(t)
+		v1 := tr.commit(map[string]string{"policy.rego": testGitModule("v1")})
+		src := &v1beta1.GitSource{Repo: tr.url(), Ref: "v1"}
+
+		s := &gitSource{log: log, cache: t.TempDir(), interval: time.Hour}
+		if _, err := s.library(context.Background(), src); err == nil {
+			t.Fatalf("s.library(...): want error resolving a tag that doesn't exist")
+		}
+		tr.tag("v1", v1)
+
+		// Refs that couldn't be resolved shouldn't be fetched again before
+		// the interval elapsed.
+		if _, err := s.library(context.Background(), src); err == nil || !strings.Contains(err.Error(), `cannot resolve ref "v1"`) {
+			t.Errorf("s.library(...): want the unresolved ref not to be fetched again before the interval elapsed, got error %v", err)
+		}
+
+		s.interval = 0
+		lib, err := s.library(context.Background(), src)
+		if err != nil {
+			t.Fatalf("s.library(...): want the unresolved ref to be fetched after the interval elapsed, got error: %v", err)
+		}
+		if diff := cmp.Diff(v1.String(), lib.source.Commit); diff != "" {
+			t.Errorf("s.library(...): -want commit, +got commit:\n%s", diff)
+		}
+	})
+
+	t.Run("WhileFetching", func(t *testing.T) {
+		tr := newTestRepo(t)
+		v1 := tr.commit(map[string]string{"policy.rego": testGitModule("v1")})
+		v2 := tr.commit(map[string]string{"policy.rego": testGitModule("v2")})
+
+		s := &gitSource{log: log, cache: t.TempDir(), interval: time.Hour}
+		if _, err := s.library(context.Background(), &v1beta1.GitSource{Repo: tr.url(), Ref: v1.String()}); err != nil {
+			t.Fatalf("s.library(...): %v", err)
+		}
+
+		// Commits already fetched should be loaded while the mirror is
+		// fetched.
+		repo := s.repos[tr.url()]
+		repo.fetching.Lock()
+		defer repo.fetching.Unlock()
+		for _, h := range []plumbing.Hash{v1, v2} {
+			lib, err := s.library(context.Background(), &v1beta1.GitSource{Repo: tr.url(), Ref: h.String()})
+			if err != nil {
+				t.Fatalf("s.library(...): %v", err)
+			}
+			if diff := cmp.Diff(h.String(), lib.source.Commit); diff != "" {
+				t.Errorf("s.library(...): -want commit, +got commit:\n%s", diff)
+			}
+		}
+	})
+
+	t.Run("Unreachable", func(t *testing.T) {
+		tr := newTestRepo(t)
+		v1 := tr.commit(map[string]string{"policy.rego": testGitModule("v1")})
+		src := &v1beta1.GitSource{Repo: tr.url(), Ref: "master"}
+
+		s := &gitSource{log: log, cache: t.TempDir()}
+		if _, err := s.library(context.Background(), src); err != nil {
+			t.Fatalf("s.library(...): %v", err)
+		}
+		if err := os.RemoveAll(tr.dir); err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 2; i++ {
+			lib, err := s.library(context.Background(), src)
+			s.refreshes.Wait()
+			if err != nil {
+				t.Fatalf("s.library(...): want the last good commit to be served, got error: %v", err)
+			}
+			if diff := cmp.Diff(v1.String(), lib.source.Commit); diff != "" {
+				t.Errorf("s.library(...): want the last good commit to be served: -want commit, +got commit:\n%s", diff)
+			}
+		}
+	})
+
+	t.Run("Bounded", func(t *testing.T) {
+		tr := newTestRepo(t)
+		v1 := tr.commit(map[string]string{"policy.rego": testGitModule("v1")})
+		v2 := tr.commit(map[string]string{"policy.rego": testGitModule("v2")})
+
+		s := &gitSource{log: log, cache: t.TempDir(), interval: time.Hour, size: 1}
+		for _, h := range []plumbing.Hash{v1, v2} {
+			if _, err := s.library(context.Background(), &v1beta1.GitSource{Repo: tr.url(), Ref: h.String()}); err != nil {
+				t.Fatalf("s.library(...): %v", err)
+			}
+		}
+		if got := s.libraries.len(); got != 1 {
+			t.Errorf("s.library(...): want 1 library cached in memory, got %d", got)
+		}
+		if _, ok := s.libraries.get(v2.String() + ":"); !ok {
+			t.Errorf("s.library(...): want the most recently used library to be cached")
+		}
+	})
+}
+
+func TestRunFunctionWithGitSource(t *testing.T) {
+	log, err := function.NewLogger(true)
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+
+	tr := newTestRepo(t)
+	tr.commit(map[string]string{"policy.rego": "package crossplane\n\ndeny[msg] { msg := sprintf(\"commit %s says no\", [input.source.commit]) }\n"})
+	h := tr.commit(map[string]string{"data.json": `{"unused": true}`})
+
+	f := &Function{log: log, git: &gitSource{log: log, cache: t.TempDir()}}
+	rsp, err := f.RunFunction(context.Background(), &fnv1beta1.RunFunctionRequest{
+		Input: resource.MustStructObject(&v1beta1.Input{
+			TypeMeta: inputTypeMeta,
+			Spec:     v1beta1.InputSpec{Source: &v1beta1.Source{Git: &v1beta1.GitSource{Repo: tr.url(), Ref: "master"}}},
+		}),
+	})
+	if err != nil {
+		t.Fatalf("f.RunFunction(...): %v", err)
+	}
+	want := []*fnv1beta1.Result{{
+		Severity: fnv1beta1.Severity_SEVERITY_FATAL,
+		Message:  "commit " + h.String() + " says no",
+	}}
+	if diff := cmp.Diff(want, rsp.GetResults(), protocmp.Transform()); diff != "" {
+		t.Errorf("f.RunFunction(...): -want results, +got results:\n%s", diff)
+	}
+}
@@ -0,0 +1,138 @@
+package v1beta1
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// crdPath is the path of the packaged CRD, generated by go generate.
+const crdPath = "../../package/input/rego.fn.crossplane.io_inputs.yaml"
+
+// TestCRD fails if the packaged CRD drifts from the Go types, for example
+// because go generate wasn't run after changing them.
+func TestCRD(t *testing.T) {
+	data, err := os.ReadFile(crdPath)
+	if err != nil {
+		t.Fatalf("os.ReadFile(%q): %v", crdPath, err)
+	}
+	crd := &apiextensionsv1.CustomResourceDefinition{}
+	if err := yaml.UnmarshalStrict(data, crd); err != nil {
+		t.Fatalf("yaml.UnmarshalStrict(...): %v", err)
+	}
+
+	if diff := cmp.Diff(Group, crd.Spec.Group); diff != "" {
+		t.Errorf("spec.group: -want, +got:\n%s", diff)
+	}
+	if diff := cmp.Diff(InputKind, crd.Spec.Names.Kind); diff != "" {
+		t.Errorf("spec.names.kind: -want, +got:\n%s", diff)
+	}
+	if len(crd.Spec.Versions) != 1 || crd.Spec.Versions[0].Name != Version {
+		t.Fatalf("spec.versions: want only %s", Version)
+	}
+
+	s := crd.Spec.Versions[0].Schema.OpenAPIV3Schema.Properties["spec"]
+	for _, d := range schemaDrift("spec", reflect.TypeOf(InputSpec{}), &s) {
+		t.Error(d)
+	}
+}
+
+// TestCRDGenerated fails if the packaged CRD differs in any way, including
+// descriptions, defaults and validation rules, from the one generated from the
+// Go types.
+func TestCRDGenerated(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Generating the CRD builds controller-gen, which is slow")
+	}
+	gobin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("Generating the CRD requires the go command")
+	}
+
+	dir := t.TempDir()
+	cmd := exec.Command(gobin, "run", "-tags", "generate", "sigs.k8s.io/controller-tools/cmd/controller-gen",
+		"paths=./v1beta1", "crd:crdVersions=v1", "output:artifacts:config="+dir)
+	cmd.Dir = ".."
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("controller-gen: %v\n%s", err, out)
+	}
+
+	want, err := os.ReadFile(filepath.Join(dir, filepath.Base(crdPath)))
+	if err != nil {
+		t.Fatalf("os.ReadFile(...): %v", err)
+	}
+	got, err := os.ReadFile(crdPath)
+	if err != nil {
+		t.Fatalf("os.ReadFile(%q): %v", crdPath, err)
+	}
+	if !bytes.Equal(want, got) {
+		t.Errorf("%s is out of date, run go generate: -want, +got:\n%s", crdPath, cmp.Diff(string(want), string(got)))
+	}
+}
+
+// schemaDrift returns the differences between the properties of the supplied
+// schema and the JSON fields of the supplied type. It only compares the
+// structure of the schema, TestCRDGenerated compares everything else.
+func schemaDrift(path string, t reflect.Type, s *apiextensionsv1.JSONSchemaProps) []string {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch t.Kind() { //nolint:exhaustive // Other kinds have no nested schema.
+	case reflect.Slice:
+		if s.Items == nil || s.Items.Schema == nil {
+			return []string{path + ": want items"}
+		}
+		return schemaDrift(path+"[]", t.Elem(), s.Items.Schema)
+	case reflect.Map:
+		if s.AdditionalProperties == nil || s.AdditionalProperties.Schema == nil {
+			return []string{path + ": want additionalProperties"}
+		}
+		return schemaDrift(path+"[]", t.Elem(), s.AdditionalProperties.Schema)
+	case reflect.Struct:
+	default:
+		return nil
+	}
+
+	drift := []string{}
+	fields := map[string]bool{}
+	required := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		name, opts, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		fields[name] = true
+		if !strings.Contains(opts, "omitempty") {
+			required = append(required, name)
+		}
+		p, ok := s.Properties[name]
+		if !ok {
+			drift = append(drift, path+"."+name+": missing from the CRD")
+			continue
+		}
+		drift = append(drift, schemaDrift(path+"."+name, t.Field(i).Type, &p)...)
+	}
+	for name := range s.Properties {
+		if !fields[name] {
+			drift = append(drift, path+"."+name+": missing from the Go types")
+		}
+	}
+	sort.Strings(required)
+	got := append([]string{}, s.Required...)
+	sort.Strings(got)
+	if diff := cmp.Diff(required, got, cmpopts.EquateEmpty()); diff != "" {
+		drift = append(drift, path+": -want required, +got required:\n"+diff)
+	}
+	return drift
+}
@@ -6,6 +6,7 @@ package v1beta1
 
 import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 )
 
 // This isn't a custom resource, in the sense that we never install its CRD.
@@ -25,7 +26,273 @@ type Input struct {
 	Spec InputSpec `json:"spec"`
 }
 
+// An EnforcementAction determines how fatal results returned by a policy are
+// enforced.
+type EnforcementAction string
+
+// Supported enforcement actions.
+const (
+	// EnforcementActionDeny returns fatal results as is, stopping the
+	// pipeline.
+	EnforcementActionDeny EnforcementAction = "deny"
+
+	// EnforcementActionWarn downgrades fatal results to warnings.
+	EnforcementActionWarn EnforcementAction = "warn"
+
+	// EnforcementActionDryRun only logs fatal results, dropping them from
+	// the response.
+	EnforcementActionDryRun EnforcementAction = "dryrun"
+)
+
+// An EvaluationMode determines what a policy is evaluated against.
+type EvaluationMode string
+
+// Supported evaluation modes.
+const (
+	// EvaluationModeRequest evaluates the policy once against the whole
+	// request.
+	EvaluationModeRequest EvaluationMode = "request"
+
+	// EvaluationModeDesiredResources evaluates the policy once per desired
+	// composed resource.
+	EvaluationModeDesiredResources EvaluationMode = "desiredResources"
+
+	// EvaluationModeObservedResources evaluates the policy once per observed
+	// composed resource.
+	EvaluationModeObservedResources EvaluationMode = "observedResources"
+)
+
+// An OutputValidation determines how a response returned by a policy that
+// breaks the rules of Crossplane is handled.
+type OutputValidation string
+
+// Supported output validations.
+const (
+	// OutputValidationStrict returns a fatal result for each broken rule,
+	// discarding the response.
+	OutputValidationStrict OutputValidation = "strict"
+
+	// OutputValidationLenient returns a warning for each broken rule,
+	// accepting the response as is.
+	OutputValidationLenient OutputValidation = "lenient"
+)
+
+// An UndefinedAction determines what happens when the response rule of a
+// policy is undefined, e.g. because its conditions aren't met.
+type UndefinedAction string
+
+// Supported undefined actions.
+const (
+	// UndefinedActionPassThrough passes the response built so far through
+	// unmodified.
+	UndefinedActionPassThrough UndefinedAction = "passThrough"
+
+	// UndefinedActionFatal returns a fatal result.
+	UndefinedActionFatal UndefinedAction = "fatal"
+
+	// UndefinedActionWarn passes the response built so far through
+	// unmodified, returning a warning.
+	UndefinedActionWarn UndefinedAction = "warn"
+)
+
+// A MultipleResultsStrategy determines what happens when a policy returns more
+// than one response, using a response partial set rule.
+type MultipleResultsStrategy string
+
+// Supported multiple results strategies.
+const (
+	// MultipleResultsFail fails the evaluation.
+	MultipleResultsFail MultipleResultsStrategy = "fail"
+
+	// MultipleResultsMerge merges the responses in order. Sets and arrays
+	// are concatenated, and objects merged recursively. Conflicting values
+	// fail the evaluation.
+	MultipleResultsMerge MultipleResultsStrategy = "merge"
+
+	// MultipleResultsFirst takes the first response.
+	MultipleResultsFirst MultipleResultsStrategy = "first"
+)
+
+// A FailurePolicy determines what happens when a policy fails to be
+// evaluated.
+type FailurePolicy string
+
+// Supported failure policies.
+const (
+	// FailurePolicyFail returns a fatal result.
+	FailurePolicyFail FailurePolicy = "Fail"
+
+	// FailurePolicyIgnore returns a warning and drops the output of the
+	// policy, running the rest of the function as usual.
+	FailurePolicyIgnore FailurePolicy = "Ignore"
+)
+
 // InputSpec defines the desired state of Input
 type InputSpec struct {
-	Scripts map[string]string `json:"scripts"`
+	// Scripts are Rego modules, by file name, compiled together with the
+	// policies of the source or the Function's policy library.
+	// +kubebuilder:validation:XValidation:rule="size(self) > 0",message="scripts must not be empty"
+	// +kubebuilder:validation:XValidation:rule="self.all(name, size(self[name]) > 0)",message="scripts must not be empty strings"
+	// +optional
+	Scripts map[string]string `json:"scripts,omitempty"`
+
+	// Source from which to load policies compiled together with the scripts,
+	// instead of the Function's policy library.
+	// +optional
+	Source *Source `json:"source,omitempty"`
+
+	// Mode determines what the policy is evaluated against. In the
+	// desiredResources and observedResources modes the policy is evaluated
+	// once per composed resource, and its results are prefixed with the name
+	// of the resource. Defaults to request.
+	// +kubebuilder:validation:XValidation:rule="self in ['request', 'desiredResources', 'observedResources']",message="mode must be one of request, desiredResources or observedResources"
+	// +optional
+	Mode EvaluationMode `json:"mode,omitempty"`
+
+	// OutputValidation determines how a response returned by the policy is
+	// handled if it writes fields of the composite resource other than its
+	// status, returns composed resources without an apiVersion or kind, or
+	// returns results or readiness of unknown severity. Defaults to lenient.
+	// +kubebuilder:validation:XValidation:rule="self in ['strict', 'lenient']",message="outputValidation must be one of strict or lenient"
+	// +optional
+	OutputValidation OutputValidation `json:"outputValidation,omitempty"`
+
+	// OnUndefined determines what happens when the response rule of the
+	// policy is undefined. Defaults to passThrough.
+	// +kubebuilder:validation:XValidation:rule="self in ['passThrough', 'fatal', 'warn']",message="onUndefined must be one of passThrough, fatal or warn"
+	// +optional
+	OnUndefined UndefinedAction `json:"onUndefined,omitempty"`
+
+	// OnMultipleResults determines what happens when the response rule of
+	// the policy is a partial set rule holding more than one response.
+	// Responses are ordered like the members of Rego sets. Defaults to fail.
+	// +kubebuilder:validation:XValidation:rule="self in ['fail', 'merge', 'first']",message="onMultipleResults must be one of fail, merge or first"
+	// +optional
+	OnMultipleResults MultipleResultsStrategy `json:"onMultipleResults,omitempty"`
+
+	// FailurePolicy determines what happens when the policy fails to be
+	// prepared, evaluated or converted into a response, e.g. because of a
+	// runtime error. Defaults to Fail.
+	// +kubebuilder:validation:XValidation:rule="self in ['Fail', 'Ignore']",message="failurePolicy must be one of Fail or Ignore"
+	// +optional
+	FailurePolicy FailurePolicy `json:"failurePolicy,omitempty"`
+
+	// ChangeSummary returns a normal result summarizing how the Function
+	// changed the desired state, i.e. which composed resources it added,
+	// removed or modified, and at which field paths. The summary is always
+	// logged at debug level.
+	// +optional
+	ChangeSummary bool `json:"changeSummary,omitempty"`
+
+	// EnforcementAction determines how fatal results returned by the policy
+	// are enforced. Defaults to deny.
+	// +kubebuilder:validation:XValidation:rule="self in ['deny', 'warn', 'dryrun']",message="enforcementAction must be one of deny, warn or dryrun"
+	// +optional
+	EnforcementAction EnforcementAction `json:"enforcementAction,omitempty"`
+
+	// AllowEnforcementActionOverride allows composite resources to override
+	// the enforcement action using the
+	// rego.fn.crossplane.io/enforcement-action annotation.
+	// +optional
+	AllowEnforcementActionOverride bool `json:"allowEnforcementActionOverride,omitempty"`
+
+	// SchemaValidationAction determines how desired composed resources that
+	// don't match the schema of their kind are reported, when the Function
+	// is started with a schema directory. Defaults to deny.
+	// +kubebuilder:validation:XValidation:rule="self in ['deny', 'warn', 'dryrun']",message="schemaValidationAction must be one of deny, warn or dryrun"
+	// +optional
+	SchemaValidationAction EnforcementAction `json:"schemaValidationAction,omitempty"`
+
+	// Exemptions suppress the results of the policies with the supplied IDs
+	// until they expire.
+	// +optional
+	Exemptions []Exemption `json:"exemptions,omitempty"`
+
+	// AllowExemptionAnnotations allows composite resources to declare
+	// further exemptions using the rego.fn.crossplane.io/exemptions
+	// annotation.
+	// +optional
+	AllowExemptionAnnotations bool `json:"allowExemptionAnnotations,omitempty"`
+
+	// Profile the evaluation of the policy, logging the expressions that
+	// took the most time.
+	// +optional
+	Profile bool `json:"profile,omitempty"`
+
+	// Gatekeeper ConstraintTemplates and Constraints to evaluate against each
+	// desired composed resource, in addition to or instead of the scripts.
+	// +optional
+	Gatekeeper *Gatekeeper `json:"gatekeeper,omitempty"`
+}
+
+// Gatekeeper ConstraintTemplates and Constraints. Each Constraint is evaluated
+// against the desired composed resources it matches, using the violation rule
+// of the ConstraintTemplate defining its kind.
+type Gatekeeper struct {
+	// ConstraintTemplates are templates.gatekeeper.sh ConstraintTemplate
+	// manifests targeting admission.k8s.gatekeeper.sh.
+	ConstraintTemplates []runtime.RawExtension `json:"constraintTemplates"`
+
+	// Constraints are constraints.gatekeeper.sh manifests, of the kinds
+	// defined by the ConstraintTemplates.
+	Constraints []runtime.RawExtension `json:"constraints"`
+}
+
+// An Exemption suppresses the results of the policies with the supplied IDs,
+// as declared by the custom.id METADATA annotation of deny and warn rules,
+// until it expires.
+type Exemption struct {
+	// PolicyIDs are the IDs of the exempted policies.
+	PolicyIDs []string `json:"policyIDs"`
+
+	// Justification explains why the exemption was granted.
+	Justification string `json:"justification"`
+
+	// Expires is the RFC3339 time at which the exemption stops applying.
+	Expires string `json:"expires"`
+}
+
+// A Source from which to load policies. Only one of its fields can be
+// specified.
+// +kubebuilder:validation:XValidation:rule="!(has(self.oci) && has(self.git))",message="only one of oci or git can be specified"
+type Source struct {
+	// OCI loads a policy bundle from an OCI artifact.
+	// +optional
+	OCI *OCISource `json:"oci,omitempty"`
+
+	// Git loads policies from a git repository.
+	// +optional
+	Git *GitSource `json:"git,omitempty"`
+}
+
+// An OCISource loads a policy bundle from an OCI artifact whose single layer,
+// or layer of media type application/vnd.oci.image.layer.v1.tar+gzip, is a
+// gzipped bundle tarball.
+type OCISource struct {
+	// Digest of the manifest of the artifact, e.g. sha256:3f2a...
+	// +kubebuilder:validation:Pattern=`^sha256:[a-f0-9]{64}$`
+	Digest string `json:"digest"`
+
+	// Repository from which to pull the artifact, e.g.
+	// registry.example.org/policies. The artifact is read from the
+	// Function's OCI image layout directory if omitted.
+	// +optional
+	Repository string `json:"repository,omitempty"`
+}
+
+// A GitSource loads the Rego modules and data documents found in a directory of
+// a git repository at a ref, like the Function's policy library directory.
+type GitSource struct {
+	// Repo is the URL of the repository, e.g. https://example.org/policies.git
+	// or file:///srv/git/policies.git for a local bare repository.
+	Repo string `json:"repo"`
+
+	// Ref is the branch, tag or commit at which to load policies. Branches
+	// and tags are refreshed periodically, while commits are loaded once.
+	Ref string `json:"ref"`
+
+	// Path of the directory containing the policies within the repository.
+	// Defaults to its root.
+	// +optional
+	Path string `json:"path,omitempty"`
 }
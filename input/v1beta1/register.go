@@ -0,0 +1,22 @@
+package v1beta1
+
+import (
+	"reflect"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// Package type metadata.
+const (
+	Group   = "rego.fn.crossplane.io"
+	Version = "v1beta1"
+)
+
+// GroupVersion is the API group and version of this package.
+var GroupVersion = schema.GroupVersion{Group: Group, Version: Version}
+
+// Input type metadata.
+var (
+	InputKind             = reflect.TypeOf(Input{}).Name()
+	InputGroupVersionKind = GroupVersion.WithKind(InputKind)
+)
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/loader"
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/storage"
+	"github.com/open-policy-agent/opa/storage/inmem"
+	"k8s.io/apimachinery/pkg/util/json"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+)
+
+// A library of Rego modules and data documents loaded from a directory, either
+// baked into the Function image or mounted into its pod. The library is
+// compiled together with the scripts supplied by each Composition.
+type library struct {
+	modules map[string]*ast.Module
+	store   storage.Store
+
+	// revision identifies the content of the library.
+	revision string
+
+	// source the library was loaded from, exposed to policies, if any.
+	source *querySource
+
+	// policy is the library compiled on its own, used as is when a
+	// Composition supplies no scripts.
+	policy *policy
+}
+
+// loadLibrary loads and compiles every Rego module and data document (i.e.
+// JSON or YAML file) found in the supplied directory and its subdirectories,
+// except for tests and hidden files. Modules are named after their path
+// relative to the directory, while documents are loaded under the data path
+// matching their directory, like OPA does. All errors are returned at once.
+func loadLibrary(dir string) (*library, error) {
+	res, err := loader.NewFileLoader().WithProcessAnnotation(true).Filtered([]string{dir}, ignoreLibraryFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot load policy directory %q", dir)
+	}
+
+	mods := make(map[string]*ast.Module, len(res.Modules))
+	raw := make(map[string][]byte, len(res.Modules))
+	for _, f := range res.Modules {
+		rel, err := filepath.Rel(dir, f.Name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot determine name of module %q", f.Name)
+		}
+		mods[filepath.ToSlash(rel)] = f.Parsed
+		raw[filepath.ToSlash(rel)] = f.Raw
+	}
+	rev, err := revision(raw, res.Documents)
+	if err != nil {
+		return nil, err
+	}
+
+	lib, err := newLibrary(mods, res.Documents)
+	if err != nil {
+		return nil, err
+	}
+	lib.revision = rev
+	return lib, nil
+}
+
+// revision derives a revision from the supplied raw modules and data documents.
+func revision(raw map[string][]byte, docs map[string]any) (string, error) {
+	names := make([]string, 0, len(raw))
+	for n := range raw {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	h := sha256.New()
+	for _, n := range names {
+		_, _ = h.Write([]byte(n))
+		_, _ = h.Write(raw[n])
+	}
+	// Map keys are sorted when marshalled, so the hash is stable.
+	data, err := json.Marshal(docs)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot marshal data documents")
+	}
+	_, _ = h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))[:12], nil
+}
+
+// ignoreLibraryFile is a loader filter ignoring Rego tests and hidden files or
+// directories, such as the ..data directories of ConfigMap volumes.
+func ignoreLibraryFile(_ string, info fs.FileInfo, depth int) bool {
+	if depth > 0 && strings.HasPrefix(info.Name(), ".") {
+		return true
+	}
+	return !info.IsDir() && strings.HasSuffix(info.Name(), "_test.rego")
+}
+
+// newLibrary compiles the supplied parsed modules and data documents into a
+// library.
+func newLibrary(mods map[string]*ast.Module, data map[string]any) (*library, error) {
+	p, err := compilePolicy(mods)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot compile policy library")
+	}
+	if data == nil {
+		data = map[string]any{}
+	}
+	return &library{modules: mods, store: inmem.NewFromObject(data), policy: p}, nil
+}
+
+// with returns the modules of the library together with the supplied ones.
+// Modules must not be named after a library module.
+func (l *library) with(mods map[string]*ast.Module) (map[string]*ast.Module, error) {
+	if l == nil {
+		return mods, nil
+	}
+	all := make(map[string]*ast.Module, len(l.modules)+len(mods))
+	for n, m := range l.modules {
+		all[n] = m
+	}
+	for n, m := range mods {
+		if _, ok := all[n]; ok {
+			return nil, errors.Errorf("module %q is already defined by the policy library", n)
+		}
+		all[n] = m
+	}
+	return all, nil
+}
+
+// compile the supplied Rego scripts together with the library, if any. The
+// compiled library is returned as is if no scripts are supplied.
+func (l *library) compile(scripts map[string]string) (*policy, error) {
+	if l != nil && len(scripts) == 0 {
+		return l.policy, nil
+	}
+	mods, err := parseModules(scripts)
+	if err != nil {
+		return nil, err
+	}
+	all, err := l.with(mods)
+	if err != nil {
+		return nil, err
+	}
+	return compilePolicy(all)
+}
+
+// definesPolicy returns true if the library has modules in the policy
+// package, rather than only helper packages.
+func (l *library) definesPolicy() bool {
+	if l == nil {
+		return false
+	}
+	for _, m := range l.modules {
+		if m.Package.Path.Equal(policyPackagePath()) {
+			return true
+		}
+	}
+	return false
+}
+
+// options returns the options required to evaluate a policy compiled with the
+// library, if any.
+func (l *library) options() []func(*rego.Rego) {
+	if l == nil {
+		return nil
+	}
+	return []func(*rego.Rego){rego.Store(l.store)}
+}
+
+// useLibrary atomically makes the supplied library the active one, used by all
+// subsequent requests.
+func (f *Function) useLibrary(lib *library) {
+	old := f.library.Swap(lib)
+	f.libraryErr.Store(nil)
+	f.libraryPending.Store(false)
+	// Set the new revision before deleting the old one, so that scrapes
+	// always see a revision.
+	libraryRevision.WithLabelValues(lib.revision).Set(1)
+	if old != nil && old.revision != lib.revision {
+		libraryRevision.DeleteLabelValues(old.revision)
+	}
+	f.log.Info("Activated policy library", "revision", lib.revision, "modules", len(lib.modules))
+}
+
+// libraryFailed records why a policy library could not be activated. Any
+// active library keeps being used, otherwise requests fail with the error.
+func (f *Function) libraryFailed(err error) {
+	f.libraryErr.Store(&err)
+	f.libraryPending.Store(false)
+	var ve *verificationError
+	if errors.As(err, &ve) {
+		bundleVerificationFailures.Inc()
+		f.log.Info("Policy bundle failed signature verification", "error", err)
+	}
+	if f.library.Load() != nil {
+		f.log.Info("Cannot activate policy library, keeping the active one", "error", err)
+		return
+	}
+	f.log.Info("Cannot activate policy library", "error", err)
+}
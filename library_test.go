@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/open-policy-agent/opa/storage"
+	"google.golang.org/protobuf/testing/protocmp"
+
+	"github.com/crossplane/function-sdk-go"
+	fnv1beta1 "github.com/crossplane/function-sdk-go/proto/v1beta1"
+	"github.com/crossplane/function-sdk-go/resource"
+
+	"github.com/crossplane/function-rego/input/v1beta1"
+)
+
+func TestLoadLibrary(t *testing.T) {
+	type want struct {
+		modules []string
+		data    map[string]any
+		errs    []string
+	}
+
+	cases := map[string]struct {
+		reason string
+		files  map[string]string
+		want   want
+	}{
+		"LoadsModulesRecursively": {
+			reason: "Every Rego module but tests should be loaded, named after its relative path",
+			files: map[string]string{
+				"main.rego":             "package crossplane\n\ndeny[\"no\"] { data.lib.helpers.always }\n",
+				"lib/helpers.rego":      "package lib.helpers\n\nalways = true\n",
+				"lib/helpers_test.rego": "package lib.helpers\n\ntest_always { always }\n",
+				"..data/main.rego":      "package crossplane\n\ndeny[\"no\"] { true }\n",
+				"README.md":             "# Not a module",
+			},
+			want: want{
+				modules: []string{"lib/helpers.rego", "main.rego"},
+			},
+		},
+		"LoadsDataDocuments": {
+			reason: "JSON and YAML files should be loaded as data under the path of their directory",
+			files: map[string]string{
+				"main.rego":            "package crossplane\n\ndeny[msg] { msg := data.messages.denied; data.config.enabled }\n",
+				"messages/data.json":   `{"denied": "no"}`,
+				"config/settings.yaml": "enabled: true\n",
+			},
+			want: want{
+				modules: []string{"main.rego"},
+				data: map[string]any{
+					"messages": map[string]any{"denied": "no"},
+					"config":   map[string]any{"enabled": true},
+				},
+			},
+		},
+		"ReportsAllParseErrors": {
+			reason: "Parse errors of every module should be reported at once",
+			files: map[string]string{
+				"a.rego": "package crossplane\n\ndeny[",
+				"b.rego": "package crossplane\n\nwarn[",
+			},
+			want: want{
+				errs: []string{"a.rego:3", "b.rego:3"},
+			},
+		},
+		"ReportsAllCompileErrors": {
+			reason: "Compile errors of every module should be reported at once",
+			files: map[string]string{
+				"a.rego": "package crossplane\n\ndeny[x] { x := unknown_a }\n",
+				"b.rego": "package crossplane\n\nwarn[x] { x := unknown_b }\n",
+			},
+			want: want{
+				errs: []string{"cannot compile policy library", "unknown_a", "unknown_b"},
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			for p, content := range tc.files {
+				p = filepath.Join(dir, p)
+				if err := os.MkdirAll(filepath.Dir(p), 0o700); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(p, []byte(content), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			lib, err := loadLibrary(dir)
+			for _, e := range tc.want.errs {
+				if err == nil || !strings.Contains(err.Error(), e) {
+					t.Errorf("%s\nloadLibrary(...): want error containing %q, got %v", tc.reason, e, err)
+				}
+			}
+			if len(tc.want.errs) > 0 {
+				return
+			}
+			if err != nil {
+				t.Fatalf("%s\nloadLibrary(...): unexpected error: %v", tc.reason, err)
+			}
+
+			got := make([]string, 0, len(lib.modules))
+			for n := range lib.modules {
+				got = append(got, n)
+			}
+			if diff := cmp.Diff(tc.want.modules, got, cmpopts.SortSlices(func(a, b string) bool { return a < b })); diff != "" {
+				t.Errorf("%s\nloadLibrary(...): -want modules, +got modules:\n%s", tc.reason, diff)
+			}
+
+			ctx := context.Background()
+			data, err := storage.ReadOne(ctx, lib.store, storage.Path{})
+			if err != nil {
+				t.Fatalf("storage.ReadOne(...): %v", err)
+			}
+			if diff := cmp.Diff(tc.want.data, data, cmpopts.EquateEmpty()); diff != "" {
+				t.Errorf("%s\nloadLibrary(...): -want data, +got data:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestRunFunctionWithLibrary(t *testing.T) {
+	log, err := function.NewLogger(true)
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+
+	mods, err := parseModules(map[string]string{
+		"lib.rego": `
+package crossplane
+
+deny[msg] {
+	data.crossplane.forbidden
+	msg := data.messages.forbidden
+}
+`,
+	})
+	if err != nil {
+		t.Fatalf("parseModules(...): %v", err)
+	}
+	lib, err := newLibrary(mods, map[string]any{"messages": map[string]any{"forbidden": "library says no"}})
+	if err != nil {
+		t.Fatalf("newLibrary(...): %v", err)
+	}
+
+	cases := map[string]struct {
+		reason  string
+		scripts map[string]string
+		want    []*fnv1beta1.Result
+	}{
+		"LibraryOnly": {
+			reason: "The compiled library should be used as is if no scripts are supplied",
+		},
+		"LibraryWithScripts": {
+			reason: "Scripts should be compiled together with the library",
+			scripts: map[string]string{
+				"hello.rego": "package crossplane\n\nforbidden = true\n",
+			},
+			want: []*fnv1beta1.Result{
+				{Severity: fnv1beta1.Severity_SEVERITY_FATAL, Message: "library says no"},
+			},
+		},
+		"ScriptNamedAfterLibraryModule": {
+			reason: "Scripts must not be named after a library module",
+			scripts: map[string]string{
+				"lib.rego": "package crossplane\n\nforbidden = true\n",
+			},
+			want: []*fnv1beta1.Result{
+				{Severity: fnv1beta1.Severity_SEVERITY_FATAL, Message: `prepare stage failed: cannot compile rego policy: module "lib.rego" is already defined by the policy library`},
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			f := &Function{log: log}
+			f.library.Store(lib)
+
+			rsp, _ := f.RunFunction(context.Background(), &fnv1beta1.RunFunctionRequest{
+				Input: resource.MustStructObject(&v1beta1.Input{TypeMeta: inputTypeMeta, Spec: v1beta1.InputSpec{Scripts: tc.scripts}}),
+			})
+			if diff := cmp.Diff(tc.want, rsp.GetResults(), protocmp.Transform()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want results, +got results:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestRunFunctionBeforeLibraryLoaded(t *testing.T) {
+	log, err := function.NewLogger(true)
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+
+	mods, err := parseModules(map[string]string{
+		"lib.rego": "package crossplane\n\ndeny[\"library says no\"]\n",
+	})
+	if err != nil {
+		t.Fatalf("parseModules(...): %v", err)
+	}
+	lib, err := newLibrary(mods, nil)
+	if err != nil {
+		t.Fatalf("newLibrary(...): %v", err)
+	}
+
+	f := &Function{log: log}
+	f.libraryPending.Store(true)
+
+	req := &fnv1beta1.RunFunctionRequest{
+		Input: resource.MustStructObject(&v1beta1.Input{TypeMeta: inputTypeMeta, Spec: v1beta1.InputSpec{Scripts: map[string]string{
+			"hello.rego": "package crossplane\n",
+		}}}),
+	}
+
+	rsp, _ := f.RunFunction(context.Background(), req)
+	want := []*fnv1beta1.Result{
+		{Severity: fnv1beta1.Severity_SEVERITY_FATAL, Message: "policy library is not loaded yet"},
+	}
+	if diff := cmp.Diff(want, rsp.GetResults(), protocmp.Transform()); diff != "" {
+		t.Errorf("Requests should fail until the policy library is loaded\nf.RunFunction(...): -want results, +got results:\n%s", diff)
+	}
+
+	f.useLibrary(lib)
+
+	rsp, _ = f.RunFunction(context.Background(), req)
+	want = []*fnv1beta1.Result{
+		{Severity: fnv1beta1.Severity_SEVERITY_FATAL, Message: "library says no"},
+	}
+	if diff := cmp.Diff(want, rsp.GetResults(), protocmp.Transform()); diff != "" {
+		t.Errorf("Requests should be evaluated with the policy library once it is loaded\nf.RunFunction(...): -want results, +got results:\n%s", diff)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	fnv1beta1 "github.com/crossplane/function-sdk-go/proto/v1beta1"
+)
+
+// limitEvaluations returns an interceptor limiting how many times the Function
+// can run concurrently. Calls over the limit wait for up to the supplied
+// timeout, or until their context is done, and then fail with the retryable
+// ResourceExhausted code. Other methods, e.g. health checks, are not limited.
+// The interceptor does nothing if max isn't positive.
+func limitEvaluations(max int, timeout time.Duration) grpc.UnaryServerInterceptor {
+	if max <= 0 {
+		return func(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+			return handler(ctx, req)
+		}
+	}
+
+	sem := make(chan struct{}, max)
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if info.FullMethod != fnv1beta1.FunctionRunnerService_RunFunction_FullMethodName {
+			return handler(ctx, req)
+		}
+
+		select {
+		case sem <- struct{}{}:
+			// Fast path, there's no need to queue.
+		default:
+			if err := wait(ctx, sem, timeout); err != nil {
+				return nil, err
+			}
+		}
+		defer func() { <-sem }()
+
+		return handler(ctx, req)
+	}
+}
+
+// wait for a slot of the supplied semaphore for up to the supplied timeout.
+func wait(ctx context.Context, sem chan struct{}, timeout time.Duration) error {
+	evaluationQueueDepth.Inc()
+	defer evaluationQueueDepth.Dec()
+
+	start := time.Now()
+	defer func() { evaluationQueueWait.Observe(time.Since(start).Seconds()) }()
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+
+	select {
+	case sem <- struct{}{}:
+		return nil
+	case <-t.C:
+		evaluationsRejected.Inc()
+		return status.Errorf(codes.ResourceExhausted, "too many concurrent evaluations, waited %s for one to finish", timeout)
+	case <-ctx.Done():
+		evaluationsRejected.Inc()
+		return status.FromContextError(ctx.Err()).Err()
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	fnv1beta1 "github.com/crossplane/function-sdk-go/proto/v1beta1"
+)
+
+func TestLimitEvaluations(t *testing.T) {
+	run := &grpc.UnaryServerInfo{FullMethod: fnv1beta1.FunctionRunnerService_RunFunction_FullMethodName}
+	health := &grpc.UnaryServerInfo{FullMethod: "/grpc.health.v1.Health/Check"}
+	done := func(context.Context, any) (any, error) { return "done", nil }
+
+	// Occupy the only slot until released.
+	limit := limitEvaluations(1, 50*time.Millisecond)
+	started, release := make(chan struct{}), make(chan struct{})
+	go func() {
+		_, _ = limit(context.Background(), nil, run, func(context.Context, any) (any, error) {
+			close(started)
+			<-release
+			return nil, nil
+		})
+	}()
+	<-started
+
+	type args struct {
+		info    *grpc.UnaryServerInfo
+		release bool
+	}
+	type want struct {
+		rsp  any
+		code codes.Code
+	}
+
+	cases := map[string]struct {
+		reason string
+		args   args
+		want   want
+	}{
+		"Rejected": {
+			reason: "Calls waiting longer than the timeout should fail with ResourceExhausted",
+			args:   args{info: run},
+			want:   want{code: codes.ResourceExhausted},
+		},
+		"NotLimited": {
+			reason: "Calls to other methods should not be limited",
+			args:   args{info: health},
+			want:   want{rsp: "done", code: codes.OK},
+		},
+		"Waited": {
+			reason: "Calls should run once a slot is released within the timeout",
+			args:   args{info: run, release: true},
+			want:   want{rsp: "done", code: codes.OK},
+		},
+	}
+
+	// Cases are order dependent, since the slot is only released once.
+	for _, name := range []string{"Rejected", "NotLimited", "Waited"} {
+		tc := cases[name]
+		t.Run(name, func(t *testing.T) {
+			if tc.args.release {
+				go func() {
+					time.Sleep(10 * time.Millisecond)
+					close(release)
+				}()
+			}
+			rsp, err := limit(context.Background(), nil, tc.args.info, done)
+			if diff := cmp.Diff(tc.want.rsp, rsp); diff != "" {
+				t.Errorf("%s\nlimit(...): -want rsp, +got rsp:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(tc.want.code, status.Code(err)); diff != "" {
+				t.Errorf("%s\nlimit(...): -want code, +got code:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
@@ -2,32 +2,203 @@
 package main
 
 import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
 	"github.com/alecthomas/kong"
+	"github.com/open-policy-agent/opa/bundle"
+	"go.opentelemetry.io/otel/propagation"
+	"google.golang.org/grpc"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
 
 	"github.com/crossplane/function-sdk-go"
 )
 
 // CLI of this Function.
 type CLI struct {
+	Serve serveCmd `cmd:"" default:"withargs" help:"Serve the Function. This is the default command."`
+	Bench benchCmd `cmd:"" help:"Benchmark a policy against a set of request fixtures."`
+}
+
+// serveCmd serves the Function.
+type serveCmd struct {
 	Debug bool `short:"d" help:"Emit debug logs in addition to info logs."`
 
 	Network     string `help:"Network on which to listen for gRPC connections." default:"tcp"`
 	Address     string `help:"Address at which to listen for gRPC connections." default:":9443"`
 	TLSCertsDir string `help:"Directory containing server certs (tls.key, tls.crt) and the CA used to verify client certificates (ca.crt)" env:"TLS_SERVER_CERTS_DIR"`
 	Insecure    bool   `help:"Run without mTLS credentials. If you supply this flag --tls-server-certs-dir will be ignored."`
+	Reflection  bool   `help:"Serve the gRPC server reflection service, e.g. to debug the Function using grpcurl." default:"true" negatable:""`
+	PolicyDir   string `help:"Directory containing a library of Rego policies shared by all Compositions. Compiled at startup, the Function reports NOT_SERVING until it succeeds." env:"POLICY_DIR" xor:"policies"`
+
+	PolicyBundle       string             `help:"OPA bundle, either a gzipped tarball or a directory, used as a library of Rego policies shared by all Compositions. The Function reports NOT_SERVING and requests fail until it is loaded, e.g. while its signature can't be verified." env:"POLICY_BUNDLE" xor:"policies"`
+	BundleVerification bundleVerification `embed:"" prefix:"bundle-verification-"`
+
+	OCILayout   string `help:"OCI image layout directory from which to read the policy bundles of Compositions specifying an OCI source without a repository." env:"OCI_LAYOUT" type:"path"`
+	OCICacheDir string `help:"Directory to which policy bundles loaded from OCI sources are unpacked. Defaults to a directory in the system temporary directory." env:"OCI_CACHE_DIR" type:"path"`
+
+	OCIAllowedRepositories []string `help:"Prefixes, e.g. registry.example.org/platform/, of the repositories OCI sources may pull policy bundles from. Any repository is allowed if empty." env:"OCI_ALLOWED_REPOSITORIES"`
+
+	GitCacheDir        string        `help:"Directory to which the repositories of git sources are mirrored and checked out. Defaults to a directory in the system temporary directory." env:"GIT_CACHE_DIR" type:"path"`
+	GitRefreshInterval time.Duration `help:"How often the branches and tags of git sources are refreshed." default:"1m"`
+	GitAllowedRepos    []string      `help:"Prefixes, e.g. https://github.com/example-org/, of the repositories git sources may load policies from. Any repository is allowed if empty." env:"GIT_ALLOWED_REPOS"`
+	SourceCacheSize    int           `help:"Maximum number of policy libraries loaded from OCI and git sources to keep in memory. Unlimited if zero." default:"32"`
+
+	WatchPolicies  bool          `help:"Reload the policy library whenever --policy-dir or --policy-bundle changes, keeping the active one if the new one is invalid."`
+	ReloadDelay    time.Duration `help:"How long to wait for changes to the policy library to settle before reloading it." default:"1s"`
+	MetricsAddress string        `help:"Address at which to serve Prometheus metrics. Metrics are not served if empty."`
+
+	MaxConcurrentEvaluations int           `help:"Maximum number of requests evaluated concurrently. Unlimited if zero." default:"0"`
+	EvaluationQueueTimeout   time.Duration `help:"How long requests over --max-concurrent-evaluations wait to be evaluated before failing with the retryable ResourceExhausted code." default:"10s"`
+	PolicyCacheSize          int           `help:"Maximum number of policies compiled from the scripts of Compositions to cache. Policies are compiled for every request if zero." default:"128"`
+	ProfileTop               int           `help:"Number of expressions logged when an Input enables profiling." default:"10"`
+	ResourceWorkers          int           `help:"Maximum number of composed resources each request evaluates concurrently in the desiredResources and observedResources modes." default:"4"`
+	MinTTL                   time.Duration `help:"Minimum TTL policies can set using the ttl rule." default:"10s"`
+	MaxTTL                   time.Duration `help:"Maximum TTL policies can set using the ttl rule. Unbounded if zero." default:"1h"`
+	SchemaDir                string        `help:"Directory containing CustomResourceDefinitions against whose schemas desired composed resources are validated. Resources are not validated if empty." env:"SCHEMA_DIR" type:"path"`
+
+	OTLPEndpoint string `help:"OTLP gRPC endpoint, e.g. otel-collector:4317, to which to export traces. Traces are not exported if empty." env:"OTLP_ENDPOINT"`
+	OTLPInsecure bool   `help:"Export traces to --otlp-endpoint without TLS."`
+}
+
+// Validate the flags of the serve command.
+func (c *serveCmd) Validate() error {
+	if c.MaxTTL > 0 && c.MaxTTL < c.MinTTL {
+		return errors.Errorf("--max-ttl (%s) must not be shorter than --min-ttl (%s)", c.MaxTTL, c.MinTTL)
+	}
+	return nil
 }
 
 // Run this Function.
-func (c *CLI) Run() error {
+func (c *serveCmd) Run() error {
 	log, err := function.NewLogger(c.Debug)
 	if err != nil {
 		return err
 	}
 
-	return function.Serve(&Function{log: log},
+	vc, err := c.BundleVerification.config()
+	if err != nil {
+		return err
+	}
+	ociCache := c.OCICacheDir
+	if ociCache == "" {
+		ociCache = filepath.Join(os.TempDir(), "function-rego", "oci")
+	}
+	gitCache := c.GitCacheDir
+	if gitCache == "" {
+		gitCache = filepath.Join(os.TempDir(), "function-rego", "git")
+	}
+
+	f := &Function{
+		log:        log,
+		debug:      c.Debug,
+		oci:        &ociSource{log: log, layout: c.OCILayout, cache: ociCache, vc: vc, size: c.SourceCacheSize, allowed: c.OCIAllowedRepositories},
+		git:        &gitSource{log: log, cache: gitCache, interval: c.GitRefreshInterval, size: c.SourceCacheSize, allowed: c.GitAllowedRepos},
+		policies:   newPolicyCache(c.PolicyCacheSize),
+		profileTop: c.ProfileTop,
+
+		resourceWorkers: c.ResourceWorkers,
+		minTTL:          c.MinTTL,
+		maxTTL:          c.MaxTTL,
+	}
+
+	if c.SchemaDir != "" {
+		if f.schemas, err = loadSchemas(c.SchemaDir); err != nil {
+			return err
+		}
+		log.Info("Loaded schemas", "dir", c.SchemaDir, "kinds", len(f.schemas.schemas))
+	}
+
+	if c.OTLPEndpoint != "" {
+		tp, err := newTracerProvider(context.Background(), c.OTLPEndpoint, c.OTLPInsecure)
+		if err != nil {
+			return err
+		}
+		// Flush any buffered spans when we return.
+		defer tp.Shutdown(context.Background()) //nolint:errcheck // Nothing to do if we can't flush spans.
+		f.tracer = tp.Tracer(tracerName)
+	}
+
+	cfg := serverConfig{
+		log:        log,
+		reflection: c.Reflection,
+		interceptors: []grpc.UnaryServerInterceptor{
+			propagateTrace(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})),
+			limitEvaluations(c.MaxConcurrentEvaluations, c.EvaluationQueueTimeout),
+		},
+	}
+	srv, err := newServer(f, cfg,
 		function.Listen(c.Network, c.Address),
 		function.MTLSCertificates(c.TLSCertsDir),
 		function.Insecure(c.Insecure))
+	if err != nil {
+		return err
+	}
+
+	load, watchDir := c.libraryLoader(vc)
+
+	// Requests may arrive before the policy library is loaded, e.g. from a
+	// client that doesn't check our health. Fail them until it is.
+	f.libraryPending.Store(load != nil)
+
+	errs := make(chan error, 2)
+	go func() { errs <- srv.serve() }()
+
+	if c.MetricsAddress != "" {
+		go func() { errs <- serveMetrics(c.MetricsAddress) }()
+	}
+
+	if load != nil {
+		lib, err := load()
+		switch {
+		case err != nil && c.PolicyDir != "":
+			// Policy directories are trusted, so we fail fast.
+			srv.stop()
+			return err
+		case err != nil:
+			// We keep reporting NOT_SERVING until a policy
+			// bundle is activated, e.g. by the watcher below.
+			f.libraryFailed(err)
+		default:
+			f.useLibrary(lib)
+		}
+	}
+	if load == nil || f.library.Load() != nil {
+		srv.setServing()
+	}
+
+	if load != nil && c.WatchPolicies {
+		activate := func(lib *library) {
+			f.useLibrary(lib)
+			srv.setServing()
+		}
+		w := &libraryWatcher{dir: watchDir, log: log, load: load, debounce: c.ReloadDelay, activate: activate, fail: f.libraryFailed}
+		go func() { errs <- w.watch(context.Background()) }()
+	}
+
+	err = <-errs
+	srv.stop()
+	return err
+}
+
+// libraryLoader returns a function loading the configured policy library, and
+// the directory to watch for changes to it. It returns a nil function if no
+// policy library is configured. Bundles are verified using the supplied config.
+func (c *serveCmd) libraryLoader(vc *bundle.VerificationConfig) (func() (*library, error), string) {
+	switch {
+	case c.PolicyDir != "":
+		return func() (*library, error) { return loadLibrary(c.PolicyDir) }, c.PolicyDir
+	case c.PolicyBundle != "":
+		dir := c.PolicyBundle
+		if fi, err := os.Stat(dir); err == nil && !fi.IsDir() {
+			dir = filepath.Dir(dir)
+		}
+		return func() (*library, error) { return loadBundle(c.PolicyBundle, vc) }, dir
+	}
+	return nil, ""
 }
 
 func main() {
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"runtime/debug"
+	"time"
+
+	"github.com/open-policy-agent/opa/ast"
+
+	fnv1beta1 "github.com/crossplane/function-sdk-go/proto/v1beta1"
+)
+
+// The version and commit of the Function. Set at build time, e.g. using
+// -ldflags "-X main.version=v0.1.0 -X main.commit=abc123", or read from the
+// build info of the binary otherwise.
+var (
+	version string
+	commit  string
+)
+
+func init() {
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return
+	}
+	if version == "" {
+		version = bi.Main.Version
+	}
+	for _, s := range bi.Settings {
+		if s.Key == "vcs.revision" && commit == "" {
+			commit = s.Value
+		}
+	}
+}
+
+// queryMeta describes the evaluation of a policy, exposed to policies as
+// input.meta.
+type queryMeta struct {
+	// Tag of the request.
+	Tag string `json:"tag,omitempty"`
+
+	// Version and commit of the Function.
+	Version string `json:"version,omitempty"`
+	Commit  string `json:"commit,omitempty"`
+
+	// PolicyRevision identifies the content of the policy library or bundle
+	// the policy was compiled with, if any.
+	PolicyRevision string `json:"policyRevision,omitempty"`
+
+	// Time at which the policy was evaluated.
+	Time time.Time `json:"time"`
+}
+
+// newQueryMeta describes the evaluation of a policy compiled with the supplied
+// library, if any, against the supplied request at the supplied time.
+func newQueryMeta(req *fnv1beta1.RunFunctionRequest, lib *library, now time.Time) *queryMeta {
+	m := &queryMeta{
+		Tag:     req.GetMeta().GetTag(),
+		Version: version,
+		Commit:  commit,
+		Time:    now,
+	}
+	if lib != nil {
+		m.PolicyRevision = lib.revision
+	}
+	return m
+}
+
+// value returns the query meta as a Rego value. The time is encoded as an
+// RFC 3339 string, which time.parse_rfc3339_ns can parse.
+func (m *queryMeta) value() ast.Value {
+	obj := ast.NewObject(ast.Item(ast.StringTerm("time"), ast.StringTerm(m.Time.UTC().Format(time.RFC3339Nano))))
+	for k, v := range map[string]string{
+		"tag":            m.Tag,
+		"version":        m.Version,
+		"commit":         m.Commit,
+		"policyRevision": m.PolicyRevision,
+	} {
+		if v != "" {
+			obj.Insert(ast.StringTerm(k), ast.StringTerm(v))
+		}
+	}
+	return obj
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/protobuf/testing/protocmp"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+
+	fnv1beta1 "github.com/crossplane/function-sdk-go/proto/v1beta1"
+	"github.com/crossplane/function-sdk-go/resource"
+
+	"github.com/crossplane/function-rego/input/v1beta1"
+)
+
+func TestRunFunctionMeta(t *testing.T) {
+	const metaPolicy = `package crossplane
+
+warn[msg] {
+	time.parse_rfc3339_ns(input.meta.time) > 0
+	msg := sprintf("request %s evaluated by %s (%s)", [input.meta.tag, input.meta.version, input.meta.commit])
+}
+`
+	v, c := version, commit
+	version, commit = "v1.2.3", "abc123"
+	t.Cleanup(func() { version, commit = v, c })
+
+	req := func(mode v1beta1.EvaluationMode) *fnv1beta1.RunFunctionRequest {
+		return &fnv1beta1.RunFunctionRequest{
+			Meta: &fnv1beta1.RequestMeta{Tag: "hello"},
+			Input: resource.MustStructObject(&v1beta1.Input{
+				TypeMeta: inputTypeMeta,
+				Spec:     v1beta1.InputSpec{Mode: mode, Scripts: map[string]string{"policy.rego": metaPolicy}},
+			}),
+			Desired: &fnv1beta1.State{Resources: map[string]*fnv1beta1.Resource{
+				"bucket": {Resource: resource.MustStructJSON(`{}`)},
+			}},
+		}
+	}
+	warning := func(msg string) *fnv1beta1.Result {
+		return &fnv1beta1.Result{Severity: fnv1beta1.Severity_SEVERITY_WARNING, Message: msg}
+	}
+
+	cases := map[string]struct {
+		reason string
+		req    *fnv1beta1.RunFunctionRequest
+		want   []*fnv1beta1.Result
+	}{
+		"Request": {
+			reason: "Policies should be able to reference the metadata of their evaluation",
+			req:    req(""),
+			want:   []*fnv1beta1.Result{warning("request hello evaluated by v1.2.3 (abc123)")},
+		},
+		"DesiredResources": {
+			reason: "Policies evaluated per composed resource should be able to reference the metadata of their evaluation",
+			req:    req(v1beta1.EvaluationModeDesiredResources),
+			want:   []*fnv1beta1.Result{warning(`composed resource "bucket": request hello evaluated by v1.2.3 (abc123)`)},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			f := &Function{log: logging.NewNopLogger()}
+			rsp, err := f.RunFunction(context.Background(), tc.req)
+			if err != nil {
+				t.Fatalf("%s\nf.RunFunction(...): %v", tc.reason, err)
+			}
+			if diff := cmp.Diff(tc.want, rsp.GetResults(), protocmp.Transform()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want results, +got results:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
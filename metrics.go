@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+)
+
+const metricsNamespace = "function_rego"
+
+// metrics exposed by the Function.
+var metrics = prometheus.NewRegistry()
+
+var (
+	libraryRevision = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "policy_library_info",
+		Help:      "The revision of the active policy library, always 1.",
+	}, []string{"revision"})
+
+	libraryReloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "policy_library_reloads_total",
+		Help:      "The number of attempts to reload the policy library, by result.",
+	}, []string{"result"})
+
+	bundleVerificationFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "policy_bundle_verification_failures_total",
+		Help:      "The number of times the policy bundle failed signature verification.",
+	})
+
+	evaluationQueueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "evaluation_queue_depth",
+		Help:      "The number of requests waiting for a concurrent evaluation slot.",
+	})
+
+	evaluationQueueWait = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "evaluation_queue_wait_seconds",
+		Help:      "How long requests waited for a concurrent evaluation slot.",
+		Buckets:   []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	})
+
+	evaluationsRejected = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "evaluations_rejected_total",
+		Help:      "The number of requests rejected because no concurrent evaluation slot became available in time.",
+	})
+)
+
+func init() {
+	metrics.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		libraryRevision,
+		libraryReloads,
+		bundleVerificationFailures,
+		evaluationQueueDepth,
+		evaluationQueueWait,
+		evaluationsRejected,
+	)
+}
+
+// serveMetrics serves the Function's metrics over HTTP at the supplied address.
+// Blocks until the server returns an error.
+func serveMetrics(address string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metrics, promhttp.HandlerOpts{}))
+	srv := &http.Server{Addr: address, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	return errors.Wrapf(srv.ListenAndServe(), "cannot serve metrics at address %q", address)
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/open-policy-agent/opa/bundle"
+	"golang.org/x/sync/singleflight"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+
+	"github.com/crossplane/function-rego/input/v1beta1"
+)
+
+// bundleLayerMediaType is the media type of the layer containing the bundle
+// tarball, as pushed by OPA compatible tooling.
+const bundleLayerMediaType = types.OCILayer
+
+// ociPullTimeout bounds how long pulling and unpacking an artifact can take.
+const ociPullTimeout = 5 * time.Minute
+
+// An ociSource loads policy bundles from OCI artifacts, referenced by the
+// digest of their manifest. Artifacts are read from an OCI image layout
+// directory, or pulled from a registry, and unpacked to a cache directory so
+// that each is only fetched once. The most recently used libraries are cached
+// in memory by digest.
+type ociSource struct {
+	log logging.Logger
+
+	// layout is the OCI image layout directory, if any.
+	layout string
+
+	// cache is the directory bundles are unpacked to, under
+	// <algorithm>/<hex>.
+	cache string
+
+	// vc verifies bundle signatures, if not nil.
+	vc *bundle.VerificationConfig
+
+	// size is the maximum number of libraries cached in memory. Unbounded if
+	// not positive.
+	size int
+
+	// allowed are the prefixes of the repositories artifacts may be pulled
+	// from. Any repository is allowed if empty.
+	allowed []string
+
+	// fetches deduplicates concurrent fetches of the same artifact, which
+	// happen without holding mu so that cached libraries are always served
+	// promptly.
+	fetches singleflight.Group
+
+	mu        sync.Mutex
+	libraries *lru[string, *library]
+}
+
+// library returns the policy library loaded from the supplied source.
+func (s *ociSource) library(ctx context.Context, src *v1beta1.OCISource) (*library, error) {
+	h, err := v1.NewHash(src.Digest)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid digest %q", src.Digest)
+	}
+
+	key := h.String()
+	s.mu.Lock()
+	if s.libraries == nil {
+		s.libraries = newLRU[string, *library](s.size)
+	}
+	lib, ok := s.libraries.get(key)
+	s.mu.Unlock()
+	if ok {
+		return lib, nil
+	}
+
+	// The fetch is shared by concurrent requests for the same artifact, so it
+	// mustn't be cancelled with the request that started it. Each request
+	// still stops waiting for it when cancelled.
+	ch := s.fetches.DoChan(key, func() (any, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), ociPullTimeout)
+		defer cancel()
+
+		dir, err := s.unpack(ctx, src.Repository, h)
+		if err != nil {
+			return nil, err
+		}
+		lib, err := loadBundle(dir, s.vc)
+		if err != nil {
+			return nil, err
+		}
+		lib.source = &querySource{Digest: key}
+
+		s.mu.Lock()
+		s.libraries.add(key, lib)
+		s.mu.Unlock()
+		s.log.Info("Loaded policy bundle from OCI artifact", "digest", key, "revision", lib.revision, "modules", len(lib.modules))
+		return lib, nil
+	})
+	select {
+	case <-ctx.Done():
+		return nil, errors.Wrapf(ctx.Err(), "cannot fetch OCI artifact %s", key)
+	case r := <-ch:
+		if r.Err != nil {
+			return nil, r.Err
+		}
+		return r.Val.(*library), nil //nolint:forcetypeassert // Fetches always return libraries.
+	}
+}
+
+// unpack the bundle of the artifact with the supplied digest to the cache
+// directory, unless it already was, returning the directory it was unpacked
+// to.
+func (s *ociSource) unpack(ctx context.Context, repository string, h v1.Hash) (string, error) {
+	dir := filepath.Join(s.cache, h.Algorithm, h.Hex)
+	if _, err := os.Stat(dir); err == nil {
+		return dir, nil
+	}
+
+	img, err := s.image(ctx, repository, h)
+	if err != nil {
+		return "", err
+	}
+	// Registries verify the manifest digest, but image layouts don't.
+	d, err := img.Digest()
+	if err != nil {
+		return "", errors.Wrapf(err, "cannot compute digest of OCI artifact %s", h)
+	}
+	if d != h {
+		return "", errors.Errorf("OCI artifact %s has digest %s", h, d)
+	}
+	l, err := bundleLayer(img)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid OCI artifact %s", h)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dir), 0o750); err != nil {
+		return "", errors.Wrap(err, "cannot create OCI cache directory")
+	}
+	tmp, err := os.MkdirTemp(filepath.Dir(dir), "."+h.Hex+"-")
+	if err != nil {
+		return "", errors.Wrap(err, "cannot create OCI cache directory")
+	}
+	defer os.RemoveAll(tmp) //nolint:errcheck // Nothing to do if we can't remove it.
+
+	if err := unpackLayer(l, tmp); err != nil {
+		return "", errors.Wrapf(err, "cannot unpack bundle of OCI artifact %s", h)
+	}
+	// Renaming makes sure a partially unpacked bundle is never cached.
+	if err := os.Rename(tmp, dir); err != nil {
+		return "", errors.Wrapf(err, "cannot cache bundle of OCI artifact %s", h)
+	}
+	return dir, nil
+}
+
+// image returns the artifact with the supplied digest, pulled from the supplied
+// repository or read from the image layout directory if none is supplied.
+func (s *ociSource) image(ctx context.Context, repository string, h v1.Hash) (v1.Image, error) {
+	if repository == "" {
+		if s.layout == "" {
+			return nil, errors.New("no OCI image layout directory configured, a repository is required")
+		}
+		p, err := layout.FromPath(s.layout)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot read OCI image layout %q", s.layout)
+		}
+		img, err := p.Image(h)
+		return img, errors.Wrapf(err, "cannot read OCI artifact %s from image layout %q", h, s.layout)
+	}
+
+	ref, err := name.NewDigest(repository + "@" + h.String())
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid OCI repository %q", repository)
+	}
+	if !hasAllowedPrefix(ref.Context().Name(), s.allowed) {
+		return nil, errors.Errorf("OCI repository %q is not allowed", ref.Context().Name())
+	}
+	img, err := remote.Image(ref, remote.WithContext(ctx), remote.WithAuthFromKeychain(authn.DefaultKeychain))
+	return img, errors.Wrapf(err, "cannot pull OCI artifact %s", ref)
+}
+
+// bundleLayer returns the layer of the supplied artifact containing the bundle,
+// i.e. its only layer or its only layer of the bundle layer media type.
+func bundleLayer(img v1.Image) (v1.Layer, error) {
+	ls, err := img.Layers()
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot get layers")
+	}
+	if len(ls) == 1 {
+		return ls[0], nil
+	}
+	var found v1.Layer
+	for _, l := range ls {
+		mt, err := l.MediaType()
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot get layer media type")
+		}
+		if mt != bundleLayerMediaType {
+			continue
+		}
+		if found != nil {
+			return nil, errors.Errorf("more than one layer of media type %s", bundleLayerMediaType)
+		}
+		found = l
+	}
+	if found == nil {
+		return nil, errors.Errorf("no layer of media type %s", bundleLayerMediaType)
+	}
+	return found, nil
+}
+
+// unpackLayer extracts the gzipped tarball of the supplied layer to the
+// supplied directory, verifying it matches the layer digest.
+func unpackLayer(l v1.Layer, dir string) error {
+	want, err := l.Digest()
+	if err != nil {
+		return errors.Wrap(err, "cannot get layer digest")
+	}
+	rc, err := l.Compressed()
+	if err != nil {
+		return errors.Wrap(err, "cannot read layer")
+	}
+	defer rc.Close() //nolint:errcheck // Nothing to do if we can't close it.
+
+	h := sha256.New()
+	r := io.TeeReader(rc, h)
+	if err := untar(r, dir); err != nil {
+		return err
+	}
+	// Hash any trailing padding the tar reader didn't need.
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return errors.Wrap(err, "cannot read layer")
+	}
+	if got := "sha256:" + hex.EncodeToString(h.Sum(nil)); want.Algorithm != "sha256" || got != want.String() {
+		return errors.Errorf("layer digest mismatch: want %s, got %s", want, got)
+	}
+	return nil
+}
+
+// untar extracts the regular files and directories of the supplied gzipped
+// tarball to the supplied directory. Other entries are ignored.
+func untar(r io.Reader, dir string) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return errors.Wrap(err, "cannot decompress bundle")
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "cannot read bundle")
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			path, err := securePath(dir, hdr.Name)
+			if err != nil {
+				return err
+			}
+			if err := os.MkdirAll(path, 0o750); err != nil {
+				return errors.Wrapf(err, "cannot create bundle directory %q", hdr.Name)
+			}
+		case tar.TypeReg:
+			if err := writeFile(dir, hdr.Name, tr); err != nil {
+				return errors.Wrapf(err, "cannot write bundle file %q", hdr.Name)
+			}
+		}
+	}
+	return errors.Wrap(gz.Close(), "cannot decompress bundle")
+}
+
+// securePath joins the supplied directory and slash separated name, which must
+// not escape the directory.
+func securePath(dir, name string) (string, error) {
+	rel := filepath.Clean(filepath.FromSlash(strings.TrimPrefix(name, "/")))
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errors.Errorf("file %q is outside of directory %q", name, dir)
+	}
+	return filepath.Join(dir, rel), nil
+}
+
+// writeFile writes the content of the supplied reader to the file with the
+// supplied slash separated name within the supplied directory, creating any
+// missing parent directories.
+func writeFile(dir, name string, r io.Reader) error {
+	path, err := securePath(dir, name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Clean(path), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil { //nolint:gosec // Policies are trusted not to be decompression bombs.
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
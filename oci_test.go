@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/bundle"
+	"google.golang.org/protobuf/testing/protocmp"
+
+	"github.com/crossplane/function-sdk-go"
+	fnv1beta1 "github.com/crossplane/function-sdk-go/proto/v1beta1"
+	"github.com/crossplane/function-sdk-go/resource"
+
+	"github.com/crossplane/function-rego/input/v1beta1"
+)
+
+const testOCIModule = `package crossplane
+
+deny[msg] { msg := sprintf("bundle %s says no", [input.source.digest]) }
+`
+
+// testArtifact returns an OCI artifact whose single layer is a bundle tarball
+// containing the supplied module.
+func testArtifact(t *testing.T, module string) v1.Image {
+	t.Helper()
+
+	b := bundle.Bundle{
+		Manifest: bundle.Manifest{Revision: "v1"},
+		Data:     map[string]any{},
+		Modules: []bundle.ModuleFile{{
+			URL:    "/policy.rego",
+			Path:   "/policy.rego",
+			Raw:    []byte(module),
+			Parsed: ast.MustParseModule(module),
+		}},
+	}
+	buf := &bytes.Buffer{}
+	if err := bundle.NewWriter(buf).DisableFormat(true).Write(b); err != nil {
+		t.Fatalf("bundle.NewWriter(...).Write(...): %v", err)
+	}
+	img, err := mutate.AppendLayers(mutate.MediaType(empty.Image, types.OCIManifestSchema1), static.NewLayer(buf.Bytes(), bundleLayerMediaType))
+	if err != nil {
+		t.Fatalf("mutate.AppendLayers(...): %v", err)
+	}
+	return img
+}
+
+// writeTestLayout writes an OCI image layout containing the supplied artifact.
+func writeTestLayout(t *testing.T, img v1.Image) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	p, err := layout.Write(dir, empty.Index)
+	if err != nil {
+		t.Fatalf("layout.Write(...): %v", err)
+	}
+	if err := p.AppendImage(img); err != nil {
+		t.Fatalf("p.AppendImage(...): %v", err)
+	}
+	return dir
+}
+
+func TestOCISource(t *testing.T) {
+	log, err := function.NewLogger(true)
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+
+	img := testArtifact(t, testOCIModule)
+	d, err := img.Digest()
+	if err != nil {
+		t.Fatalf("img.Digest(): %v", err)
+	}
+
+	dir := writeTestLayout(t, img)
+
+	reg := httptest.NewServer(registry.New())
+	t.Cleanup(reg.Close)
+	repo := strings.TrimPrefix(reg.URL, "http://") + "/policies"
+	ref, err := name.ParseReference(repo + ":v1")
+	if err != nil {
+		t.Fatalf("name.ParseReference(...): %v", err)
+	}
+	if err := remote.Write(ref, img); err != nil {
+		t.Fatalf("remote.Write(...): %v", err)
+	}
+
+	type args struct {
+		layout  string
+		allowed []string
+		src     *v1beta1.OCISource
+	}
+	type want struct {
+		digest string
+		err    string
+	}
+
+	cases := map[string]struct {
+		reason string
+		args   args
+		want   want
+	}{
+		"Layout": {
+			reason: "Artifacts should be read from the image layout if no repository is supplied",
+			args:   args{layout: dir, src: &v1beta1.OCISource{Digest: d.String()}},
+			want:   want{digest: d.String()},
+		},
+		"Registry": {
+			reason: "Artifacts should be pulled from the supplied repository",
+			args:   args{src: &v1beta1.OCISource{Digest: d.String(), Repository: repo}},
+			want:   want{digest: d.String()},
+		},
+		"NoLayout": {
+			reason: "A repository is required if no image layout is configured",
+			args:   args{src: &v1beta1.OCISource{Digest: d.String()}},
+			want:   want{err: "no OCI image layout directory configured"},
+		},
+		"UnknownDigest": {
+			reason: "Artifacts missing from the image layout should be reported",
+			args:   args{layout: dir, src: &v1beta1.OCISource{Digest: "sha256:" + strings.Repeat("0", 64)}},
+			want:   want{err: "cannot read OCI artifact"},
+		},
+		"AllowedRepository": {
+			reason: "Artifacts should be pulled from repositories matching an allowed prefix",
+			args:   args{allowed: []string{"registry.example.org/", repo}, src: &v1beta1.OCISource{Digest: d.String(), Repository: repo}},
+			want:   want{digest: d.String()},
+		},
+		"DisallowedRepository": {
+			reason: "Artifacts should not be pulled from repositories matching no allowed prefix",
+			args:   args{allowed: []string{"registry.example.org/"}, src: &v1beta1.OCISource{Digest: d.String(), Repository: repo}},
+			want:   want{err: fmt.Sprintf("OCI repository %q is not allowed", repo)},
+		},
+		"LayoutIgnoresAllowedRepositories": {
+			reason: "Artifacts read from the image layout should not be subject to allowed repositories",
+			args:   args{layout: dir, allowed: []string{"registry.example.org/"}, src: &v1beta1.OCISource{Digest: d.String()}},
+			want:   want{digest: d.String()},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			s := &ociSource{log: log, layout: tc.args.layout, cache: t.TempDir(), allowed: tc.args.allowed}
+			lib, err := s.library(context.Background(), tc.args.src)
+			if tc.want.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.want.err) {
+					t.Errorf("%s\ns.library(...): want error containing %q, got %v", tc.reason, tc.want.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("%s\ns.library(...): unexpected error: %v", tc.reason, err)
+			}
+			if diff := cmp.Diff(tc.want.digest, lib.source.Digest); diff != "" {
+				t.Errorf("%s\ns.library(...): -want digest, +got digest:\n%s", tc.reason, diff)
+			}
+		})
+	}
+
+	t.Run("Cached", func(t *testing.T) {
+		cache := t.TempDir()
+		s := &ociSource{log: log, layout: dir, cache: cache}
+		if _, err := s.library(context.Background(), &v1beta1.OCISource{Digest: d.String()}); err != nil {
+			t.Fatalf("s.library(...): %v", err)
+		}
+
+		// A new source, e.g. after a restart, should use the unpacked bundle
+		// without reading the image layout.
+		s = &ociSource{log: log, layout: t.TempDir(), cache: cache}
+		if _, err := s.library(context.Background(), &v1beta1.OCISource{Digest: d.String()}); err != nil {
+			t.Errorf("s.library(...): want the cached bundle to be used, got error: %v", err)
+		}
+	})
+	t.Run("Concurrent", func(t *testing.T) {
+		s := &ociSource{log: log, layout: dir, cache: t.TempDir()}
+
+		libs := make(chan *library, 10)
+		for i := 0; i < cap(libs); i++ {
+			go func() {
+				lib, err := s.library(context.Background(), &v1beta1.OCISource{Digest: d.String()})
+				if err != nil {
+					t.Errorf("s.library(...): %v", err)
+				}
+				libs <- lib
+			}()
+		}
+		first := <-libs
+		for i := 1; i < cap(libs); i++ {
+			if lib := <-libs; lib != first {
+				t.Errorf("s.library(...): want concurrent requests to share a single library")
+			}
+		}
+	})
+
+	t.Run("CancelledWhilePulling", func(t *testing.T) {
+		// The registry blocks the first manifest pull until released.
+		pulling, release := make(chan struct{}), make(chan struct{})
+		var once sync.Once
+		reg := registry.New()
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodGet && strings.Contains(r.URL.Path, "/manifests/") {
+				once.Do(func() {
+					close(pulling)
+					<-release
+				})
+			}
+			reg.ServeHTTP(w, r)
+		}))
+		t.Cleanup(srv.Close)
+		repo := strings.TrimPrefix(srv.URL, "http://") + "/policies"
+		ref, err := name.ParseReference(repo + ":v1")
+		if err != nil {
+			t.Fatalf("name.ParseReference(...): %v", err)
+		}
+		if err := remote.Write(ref, img); err != nil {
+			t.Fatalf("remote.Write(...): %v", err)
+		}
+
+		s := &ociSource{log: log, cache: t.TempDir()}
+		src := &v1beta1.OCISource{Digest: d.String(), Repository: repo}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancelled := make(chan error, 1)
+		go func() {
+			_, err := s.library(ctx, src)
+			cancelled <- err
+		}()
+		<-pulling
+
+		waited := make(chan error, 1)
+		go func() {
+			_, err := s.library(context.Background(), src)
+			waited <- err
+		}()
+		// Give the second request time to wait for the shared pull.
+		time.Sleep(100 * time.Millisecond)
+
+		cancel()
+		if err := <-cancelled; err == nil {
+			t.Errorf("s.library(...): want an error when the request is cancelled")
+		}
+		close(release)
+		if err := <-waited; err != nil {
+			t.Errorf("s.library(...): want other requests waiting for the pull not to be cancelled, got error: %v", err)
+		}
+	})
+
+	t.Run("Bounded", func(t *testing.T) {
+		other := testArtifact(t, "package crossplane\n")
+		od, err := other.Digest()
+		if err != nil {
+			t.Fatalf("other.Digest(): %v", err)
+		}
+		p, err := layout.FromPath(dir)
+		if err != nil {
+			t.Fatalf("layout.FromPath(...): %v", err)
+		}
+		if err := p.AppendImage(other); err != nil {
+			t.Fatalf("p.AppendImage(...): %v", err)
+		}
+
+		s := &ociSource{log: log, layout: dir, cache: t.TempDir(), size: 1}
+		for _, h := range []v1.Hash{d, od} {
+			if _, err := s.library(context.Background(), &v1beta1.OCISource{Digest: h.String()}); err != nil {
+				t.Fatalf("s.library(...): %v", err)
+			}
+		}
+		if got := s.libraries.len(); got != 1 {
+			t.Errorf("s.library(...): want 1 library cached in memory, got %d", got)
+		}
+		if _, ok := s.libraries.get(od.String()); !ok {
+			t.Errorf("s.library(...): want the most recently used library to be cached")
+		}
+	})
+}
+
+func TestRunFunctionWithOCISource(t *testing.T) {
+	log, err := function.NewLogger(true)
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+
+	img := testArtifact(t, testOCIModule)
+	d, err := img.Digest()
+	if err != nil {
+		t.Fatalf("img.Digest(): %v", err)
+	}
+	dir := writeTestLayout(t, img)
+
+	f := &Function{log: log, oci: &ociSource{log: log, layout: dir, cache: t.TempDir()}}
+	rsp, err := f.RunFunction(context.Background(), &fnv1beta1.RunFunctionRequest{
+		Input: resource.MustStructObject(&v1beta1.Input{
+			TypeMeta: inputTypeMeta,
+			Spec:     v1beta1.InputSpec{Source: &v1beta1.Source{OCI: &v1beta1.OCISource{Digest: d.String()}}},
+		}),
+	})
+	if err != nil {
+		t.Fatalf("f.RunFunction(...): %v", err)
+	}
+	want := []*fnv1beta1.Result{{
+		Severity: fnv1beta1.Severity_SEVERITY_FATAL,
+		Message:  "bundle " + d.String() + " says no",
+	}}
+	if diff := cmp.Diff(want, rsp.GetResults(), protocmp.Transform()); diff != "" {
+		t.Errorf("f.RunFunction(...): -want results, +got results:\n%s", diff)
+	}
+}
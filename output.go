@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"google.golang.org/protobuf/proto"
+
+	fnv1beta1 "github.com/crossplane/function-sdk-go/proto/v1beta1"
+)
+
+// Top-level fields of the desired composite resource Crossplane doesn't ignore.
+var compositeFields = map[string]bool{
+	"apiVersion": true,
+	"kind":       true,
+	"status":     true,
+}
+
+// validateOutput returns each rule of Crossplane broken by the changes the
+// policy made to the supplied response, which was the supplied original one
+// before the policy returned it.
+func validateOutput(original, rsp *fnv1beta1.RunFunctionResponse) []string {
+	var problems []string
+
+	was := original.GetDesired().GetComposite().GetResource().GetFields()
+	is := rsp.GetDesired().GetComposite().GetResource().GetFields()
+	for _, k := range changedFields(was, is) {
+		if !compositeFields[k] {
+			problems = append(problems, fmt.Sprintf("desired composite resource: Crossplane ignores the %s field, only the status can be written", k))
+		}
+	}
+
+	desired := rsp.GetDesired().GetResources()
+	names := make([]string, 0, len(desired))
+	for n := range desired {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		r := desired[name]
+		if proto.Equal(r, original.GetDesired().GetResources()[name]) {
+			continue
+		}
+		fields := r.GetResource().GetFields()
+		for _, k := range []string{"apiVersion", "kind"} {
+			if fields[k].GetStringValue() == "" {
+				problems = append(problems, fmt.Sprintf("desired composed resource %q: %s is required", name, k))
+			}
+		}
+		if fnv1beta1.Ready_name[int32(r.GetReady())] == "" {
+			problems = append(problems, fmt.Sprintf("desired composed resource %q: unknown readiness %d", name, r.GetReady()))
+		}
+	}
+
+	for i, r := range rsp.GetResults() {
+		if i < len(original.GetResults()) && proto.Equal(r, original.GetResults()[i]) {
+			continue
+		}
+		if r.GetSeverity() == fnv1beta1.Severity_SEVERITY_UNSPECIFIED || fnv1beta1.Severity_name[int32(r.GetSeverity())] == "" {
+			problems = append(problems, fmt.Sprintf("result %d: invalid severity %d, must be one of %s, %s or %s", i, r.GetSeverity(),
+				fnv1beta1.Severity_SEVERITY_FATAL, fnv1beta1.Severity_SEVERITY_WARNING, fnv1beta1.Severity_SEVERITY_NORMAL))
+		}
+	}
+
+	return problems
+}
+
+// changedFields returns the sorted keys of the fields that differ between the
+// supplied ones.
+func changedFields[V proto.Message](was, is map[string]V) []string {
+	var changed []string
+	for k, v := range is {
+		if w, ok := was[k]; !ok || !proto.Equal(w, v) {
+			changed = append(changed, k)
+		}
+	}
+	for k := range was {
+		if _, ok := is[k]; !ok {
+			changed = append(changed, k)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/protobuf/testing/protocmp"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+
+	fnv1beta1 "github.com/crossplane/function-sdk-go/proto/v1beta1"
+	"github.com/crossplane/function-sdk-go/resource"
+
+	"github.com/crossplane/function-rego/input/v1beta1"
+)
+
+func TestRunFunctionOutputValidation(t *testing.T) {
+	const invalidPolicy = `package crossplane
+
+response := object.union(input.response, {
+	"desired": {
+		"composite": {"resource": {"spec": {"replicas": 3}, "status": {"ready": true}}},
+		"resources": {"bucket": {"resource": {"kind": "Bucket"}}},
+	},
+	"results": [{"severity": 0, "message": "hello"}],
+})
+`
+	req := func(ov v1beta1.OutputValidation, script string) *fnv1beta1.RunFunctionRequest {
+		return &fnv1beta1.RunFunctionRequest{
+			Input: resource.MustStructObject(&v1beta1.Input{
+				TypeMeta: inputTypeMeta,
+				Spec:     v1beta1.InputSpec{OutputValidation: ov, Scripts: map[string]string{"policy.rego": script}},
+			}),
+			Desired: &fnv1beta1.State{
+				Resources: map[string]*fnv1beta1.Resource{
+					// Resources returned by previous Functions aren't
+					// validated.
+					"previous": {Resource: resource.MustStructJSON(`{"metadata": {}}`)},
+				},
+			},
+		}
+	}
+	desired := func(composite string, resources map[string]string) *fnv1beta1.State {
+		s := &fnv1beta1.State{Resources: map[string]*fnv1beta1.Resource{}}
+		if composite != "" {
+			s.Composite = &fnv1beta1.Resource{Resource: resource.MustStructJSON(composite)}
+		}
+		for name, r := range resources {
+			s.Resources[name] = &fnv1beta1.Resource{Resource: resource.MustStructJSON(r)}
+		}
+		return s
+	}
+
+	type want struct {
+		desired *fnv1beta1.State
+		results []*fnv1beta1.Result
+	}
+
+	cases := map[string]struct {
+		reason string
+		req    *fnv1beta1.RunFunctionRequest
+		want   want
+	}{
+		"Valid": {
+			reason: "Responses that follow the rules of Crossplane should be accepted without results",
+			req: req(v1beta1.OutputValidationStrict, `package crossplane
+
+response := object.union(input.response, {"desired": {
+	"composite": {"resource": {"status": {"ready": true}}},
+	"resources": {"bucket": {"resource": {"apiVersion": "s3.aws.upbound.io/v1beta1", "kind": "Bucket"}}},
+}})
+`),
+			want: want{
+				desired: desired(`{"status": {"ready": true}}`, map[string]string{
+					"previous": `{"metadata": {}}`,
+					"bucket":   `{"apiVersion": "s3.aws.upbound.io/v1beta1", "kind": "Bucket"}`,
+				}),
+			},
+		},
+		"Lenient": {
+			reason: "Lenient output validation should accept invalid responses, returning a warning per broken rule",
+			req:    req("", invalidPolicy),
+			want: want{
+				desired: desired(`{"spec": {"replicas": 3}, "status": {"ready": true}}`, map[string]string{
+					"previous": `{"metadata": {}}`,
+					"bucket":   `{"kind": "Bucket"}`,
+				}),
+				results: []*fnv1beta1.Result{
+					{Message: "hello"},
+					{Severity: fnv1beta1.Severity_SEVERITY_WARNING, Message: "invalid response: desired composite resource: Crossplane ignores the spec field, only the status can be written"},
+					{Severity: fnv1beta1.Severity_SEVERITY_WARNING, Message: `invalid response: desired composed resource "bucket": apiVersion is required`},
+					{Severity: fnv1beta1.Severity_SEVERITY_WARNING, Message: "invalid response: result 0: invalid severity 0, must be one of SEVERITY_FATAL, SEVERITY_WARNING or SEVERITY_NORMAL"},
+				},
+			},
+		},
+		"Strict": {
+			reason: "Strict output validation should discard invalid responses, returning a fatal result per broken rule",
+			req:    req(v1beta1.OutputValidationStrict, invalidPolicy),
+			want: want{
+				desired: desired("", map[string]string{"previous": `{"metadata": {}}`}),
+				results: []*fnv1beta1.Result{
+					{Severity: fnv1beta1.Severity_SEVERITY_FATAL, Message: "invalid response: desired composite resource: Crossplane ignores the spec field, only the status can be written"},
+					{Severity: fnv1beta1.Severity_SEVERITY_FATAL, Message: `invalid response: desired composed resource "bucket": apiVersion is required`},
+					{Severity: fnv1beta1.Severity_SEVERITY_FATAL, Message: "invalid response: result 0: invalid severity 0, must be one of SEVERITY_FATAL, SEVERITY_WARNING or SEVERITY_NORMAL"},
+				},
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			f := &Function{log: logging.NewNopLogger()}
+			rsp, err := f.RunFunction(context.Background(), tc.req)
+			if err != nil {
+				t.Fatalf("%s\nf.RunFunction(...): %v", tc.reason, err)
+			}
+			if diff := cmp.Diff(tc.want.desired, rsp.GetDesired(), protocmp.Transform()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want desired, +got desired:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(tc.want.results, rsp.GetResults(), protocmp.Transform()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want results, +got results:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
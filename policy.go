@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/rego"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+
+	fnv1beta1 "github.com/crossplane/function-sdk-go/proto/v1beta1"
+)
+
+const (
+	// policyPackage is the package policies must declare their rules in.
+	policyPackage = "crossplane"
+
+	// responseRule is the rule policies use to return a whole
+	// RunFunctionResponse.
+	responseRule = "response"
+
+	// ttlRule is the rule policies use to set how long the response may be
+	// cached, either as a duration string or a number of seconds.
+	ttlRule = "ttl"
+
+	// denyRule and warnRule are partial set rules whose members are turned
+	// into results, using the METADATA annotations of each rule.
+	denyRule = "deny"
+	warnRule = "warn"
+)
+
+// A policy is a set of compiled Rego modules.
+type policy struct {
+	compiler *ast.Compiler
+	rules    []*resultRule
+
+	// hasResponse is true if the policy defines the response rule.
+	hasResponse bool
+
+	// multiResponse is true if the response rule is a partial set rule,
+	// each of its members being a response.
+	multiResponse bool
+
+	// hasTTL is true if the policy defines the ttl rule.
+	hasTTL bool
+
+	// mu guards violations, the prepared query of the policy of a
+	// Gatekeeper ConstraintTemplate, if it was prepared.
+	mu         sync.Mutex
+	violations *rego.PreparedEvalQuery
+}
+
+// A resultRule is a deny or warn rule, renamed so that it can be evaluated on
+// its own and its results attributed to its METADATA annotations.
+type resultRule struct {
+	// name of the renamed rule in the policy package.
+	name string
+
+	// kind is either deny or warn.
+	kind string
+
+	// source is the rule as parsed, before it was renamed, used to resolve
+	// its annotations.
+	source *ast.Rule
+
+	meta ruleMetadata
+}
+
+// ruleMetadata is the subset of the OPA METADATA annotations of a rule used to
+// build results.
+type ruleMetadata struct {
+	ID          string
+	Title       string
+	Description string
+	Severity    string
+	URL         string
+}
+
+// parseModules parses the supplied Rego scripts, keyed by module name.
+func parseModules(scripts map[string]string) (map[string]*ast.Module, error) {
+	mods := make(map[string]*ast.Module, len(scripts))
+	for n, src := range scripts {
+		m, err := ast.ParseModuleWithOpts(n, src, ast.ParserOptions{ProcessAnnotation: true})
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot parse module %q", n)
+		}
+		mods[n] = m
+	}
+	return mods, nil
+}
+
+// compilePolicy compiles the supplied parsed Rego modules, which are left
+// untouched. Every deny and warn rule in the policy package is renamed to a
+// unique name, and a rule aggregating it back into the original deny or warn
+// set is added, so that policies can still refer to deny and warn as usual.
+func compilePolicy(parsed map[string]*ast.Module) (*policy, error) {
+	mods := make(map[string]*ast.Module, len(parsed))
+	p := &policy{}
+
+	// Sort module names so the renamed rules are stable between calls.
+	names := make([]string, 0, len(parsed))
+	for n := range parsed {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	for _, n := range names {
+		m := parsed[n].Copy()
+		if m.Package.Path.Equal(policyPackagePath()) {
+			if err := p.renameResultRules(m, parsed[n]); err != nil {
+				return nil, errors.Wrapf(err, "cannot prepare module %q", n)
+			}
+		}
+		mods[n] = m
+	}
+
+	c := ast.NewCompiler()
+	c.Compile(mods)
+	if c.Failed() {
+		return nil, errors.Wrap(c.Errors, "cannot compile modules")
+	}
+	p.compiler = c
+	rsp := c.GetRulesExact(policyPackagePath().Append(ast.StringTerm(responseRule)))
+	p.hasResponse = len(rsp) > 0
+	p.multiResponse = p.hasResponse && rsp[0].Head.RuleKind() == ast.MultiValue
+	p.hasTTL = len(c.GetRulesExact(policyPackagePath().Append(ast.StringTerm(ttlRule)))) > 0
+
+	// Resolve annotations against the rules as parsed, so that annotations
+	// scoped to the deny or warn document apply to each of their bodies.
+	sources := make([]*ast.Module, len(names))
+	for i, n := range names {
+		sources[i] = parsed[n]
+	}
+	as, errs := ast.BuildAnnotationSet(sources)
+	if len(errs) > 0 {
+		return nil, errors.Wrap(errs, "cannot process annotations")
+	}
+	for _, r := range p.rules {
+		r.meta = metadataFromChain(as.Chain(r.source))
+	}
+
+	return p, nil
+}
+
+// renameResultRules renames every deny and warn rule of the supplied copy of
+// the supplied parsed module. Deny and warn rules must be partial set rules.
+func (p *policy) renameResultRules(m, parsed *ast.Module) error {
+	// Aggregating rules are appended to the module as we go, so only range
+	// over the rules it was parsed with.
+	rules := m.Rules
+	for i, r := range rules {
+		kind := r.Head.Ref()[0].String()
+		if kind != denyRule && kind != warnRule {
+			continue
+		}
+		if len(r.Head.Ref()) != 1 || r.Head.RuleKind() != ast.MultiValue {
+			return errors.Errorf("%s rule on line %d must be a partial set rule, e.g. %s[msg] { ... }", kind, r.Location.Row, kind)
+		}
+		name := fmt.Sprintf("__%s_%d", kind, len(p.rules))
+		r.Head.Name = ast.Var(name)
+		r.Head.Reference = ast.Ref{ast.VarTerm(name)}
+
+		agg, err := ast.ParseRule(fmt.Sprintf("%s[x] { x := %s.%s[_] }", kind, policyPackagePath(), name))
+		if err != nil {
+			return errors.Wrapf(err, "cannot aggregate %s rule", kind)
+		}
+		agg.Module = m
+		m.Rules = append(m.Rules, agg)
+		p.rules = append(p.rules, &resultRule{name: name, kind: kind, source: parsed.Rules[i]})
+	}
+	return nil
+}
+
+// query returns the Rego query used to evaluate the policy, binding every deny
+// and warn rule to a variable of the same name, and the response and ttl
+// rules, if any, to arrays holding their value, which are empty if they are
+// undefined. This way the query remains defined when these rules aren't. A
+// response partial set rule is bound as is, since it's always defined and may
+// hold several responses.
+func (p *policy) query() string {
+	q := make([]string, 0, len(p.rules)+2)
+	switch {
+	case p.multiResponse:
+		q = append(q, fmt.Sprintf("%s = %s.%s", responseRule, policyPackagePath(), responseRule))
+	case p.hasResponse:
+		q = append(q, fmt.Sprintf("%s = [r | r = %s.%s]", responseRule, policyPackagePath(), responseRule))
+	}
+	if p.hasTTL {
+		q = append(q, fmt.Sprintf("%s = [t | t = %s.%s]", ttlRule, policyPackagePath(), ttlRule))
+	}
+	for _, r := range p.rules {
+		q = append(q, fmt.Sprintf("%s = %s.%s", r.name, policyPackagePath(), r.name))
+	}
+	return strings.Join(q, "; ")
+}
+
+// prepare the policy for evaluation.
+func (p *policy) prepare(ctx context.Context, opts ...func(*rego.Rego)) (rego.PreparedEvalQuery, error) {
+	opts = append([]func(*rego.Rego){rego.Compiler(p.compiler), rego.Query(p.query())}, opts...)
+	return rego.New(opts...).PrepareForEval(ctx)
+}
+
+// A ruleResult is a result built from a member of a deny or warn rule.
+type ruleResult struct {
+	// policyID is the custom.id METADATA annotation of the rule, if any.
+	policyID string
+
+	result *fnv1beta1.Result
+}
+
+// results builds a result for each member of each deny and warn rule bound in
+// the supplied expression bindings.
+func (p *policy) results(b rego.Vars) []ruleResult {
+	var out []ruleResult
+	for _, r := range p.rules {
+		members, _ := b[r.name].([]any)
+		for _, m := range members {
+			out = append(out, ruleResult{policyID: r.meta.ID, result: r.result(m)})
+		}
+	}
+	return out
+}
+
+// result builds a result from a member of the rule, using the rule METADATA
+// annotations to determine its severity and enrich its message.
+func (r *resultRule) result(member any) *fnv1beta1.Result {
+	sev := fnv1beta1.Severity_SEVERITY_FATAL
+	if r.kind == warnRule {
+		sev = fnv1beta1.Severity_SEVERITY_WARNING
+	}
+	if s, ok := parseSeverity(r.meta.Severity); ok {
+		sev = s
+	}
+
+	msg := memberMessage(member)
+	if msg == "" {
+		msg = r.meta.Description
+	}
+	switch {
+	case msg == "" && r.meta.Title == "":
+		msg = fmt.Sprintf("%s rule matched", r.kind)
+	case msg == "":
+		msg = r.meta.Title
+	case r.meta.Title != "" && msg != r.meta.Title:
+		msg = r.meta.Title + ": " + msg
+	}
+	if r.meta.ID != "" {
+		msg = fmt.Sprintf("[%s] %s", r.meta.ID, msg)
+	}
+	if r.meta.URL != "" {
+		msg = fmt.Sprintf("%s (see %s)", msg, r.meta.URL)
+	}
+
+	return &fnv1beta1.Result{Severity: sev, Message: msg}
+}
+
+// memberMessage returns the message of a deny or warn set member, which is
+// either a string or an object with a msg field.
+func memberMessage(member any) string {
+	switch m := member.(type) {
+	case string:
+		return m
+	case map[string]any:
+		if s, ok := m["msg"].(string); ok {
+			return s
+		}
+	}
+	return ""
+}
+
+// parseSeverity parses a severity either in its protobuf form (e.g.
+// SEVERITY_FATAL) or in its short form (e.g. fatal).
+func parseSeverity(s string) (fnv1beta1.Severity, bool) {
+	if s == "" {
+		return fnv1beta1.Severity_SEVERITY_UNSPECIFIED, false
+	}
+	s = strings.ToUpper(s)
+	if !strings.HasPrefix(s, "SEVERITY_") {
+		s = "SEVERITY_" + s
+	}
+	v, ok := fnv1beta1.Severity_value[s]
+	if !ok || v == int32(fnv1beta1.Severity_SEVERITY_UNSPECIFIED) {
+		return fnv1beta1.Severity_SEVERITY_UNSPECIFIED, false
+	}
+	return fnv1beta1.Severity(v), true
+}
+
+// metadataFromChain returns the metadata of a rule from its annotations chain,
+// preferring annotations declared closest to the rule.
+func metadataFromChain(chain ast.AnnotationsRefSet) ruleMetadata {
+	var md ruleMetadata
+	for _, ar := range chain {
+		a := ar.Annotations
+		if a == nil {
+			continue
+		}
+		next := ruleMetadata{Title: a.Title, Description: a.Description}
+		if id, ok := a.Custom["id"].(string); ok {
+			next.ID = id
+		}
+		if sev, ok := a.Custom["severity"].(string); ok {
+			next.Severity = sev
+		}
+		if len(a.RelatedResources) > 0 {
+			next.URL = a.RelatedResources[0].Ref.String()
+		}
+		md = md.merge(next)
+	}
+	return md
+}
+
+// merge returns the metadata with any empty field set from other.
+func (md ruleMetadata) merge(other ruleMetadata) ruleMetadata {
+	if md.ID == "" {
+		md.ID = other.ID
+	}
+	if md.Title == "" {
+		md.Title = other.Title
+	}
+	if md.Description == "" {
+		md.Description = other.Description
+	}
+	if md.Severity == "" {
+		md.Severity = other.Severity
+	}
+	if md.URL == "" {
+		md.URL = other.URL
+	}
+	return md
+}
+
+func policyPackagePath() ast.Ref {
+	return ast.DefaultRootRef.Append(ast.StringTerm(policyPackage))
+}
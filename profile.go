@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/google/pprof/profile"
+	"github.com/open-policy-agent/opa/profiler"
+)
+
+// profileCriteria order profiled expressions by time, then by number of
+// evaluations.
+var profileCriteria = []string{"total_time_ns", "num_eval", "num_redo", "file", "line"}
+
+// logProfile logs the top n expressions of the supplied profile.
+func (f *Function) logProfile(tag string, prof *profiler.Profiler, n int) {
+	for i, s := range prof.ReportTopNResults(n, profileCriteria) {
+		f.log.Info("Profiled policy expression",
+			"tag", tag,
+			"rank", i+1,
+			"location", exprLocation(s),
+			"expression", exprText(s),
+			"time", time.Duration(s.ExprTimeNs).String(),
+			"evals", s.NumEval,
+			"redos", s.NumRedo)
+	}
+}
+
+// exprLocation returns the file and line of a profiled expression. Expressions
+// of the query built by the Function have no file.
+func exprLocation(s profiler.ExprStats) string {
+	switch {
+	case s.Location == nil:
+		return ""
+	case s.Location.File == "":
+		return fmt.Sprintf("query:%d", s.Location.Row)
+	}
+	return fmt.Sprintf("%s:%d", s.Location.File, s.Location.Row)
+}
+
+// exprText returns the first line of a profiled expression.
+func exprText(s profiler.ExprStats) string {
+	if s.Location == nil {
+		return ""
+	}
+	t, _, _ := strings.Cut(string(s.Location.Text), "\n")
+	return t
+}
+
+// writePprof writes the supplied profiled expressions to the supplied writer as
+// a gzipped pprof profile, with one sample per expression.
+func writePprof(w io.Writer, stats []profiler.ExprStats) error {
+	p := &profile.Profile{
+		SampleType: []*profile.ValueType{
+			{Type: "evaluations", Unit: "count"},
+			{Type: "time", Unit: "nanoseconds"},
+		},
+		DefaultSampleType: "time",
+	}
+	for i, s := range stats {
+		id := uint64(i + 1)
+		fn := &profile.Function{ID: id, Name: exprText(s), SystemName: exprLocation(s)}
+		loc := &profile.Location{ID: id}
+		if s.Location != nil {
+			fn.Filename = s.Location.File
+			loc.Line = []profile.Line{{Function: fn, Line: int64(s.Location.Row)}}
+		}
+		p.Function = append(p.Function, fn)
+		p.Location = append(p.Location, loc)
+		p.Sample = append(p.Sample, &profile.Sample{
+			Location: []*profile.Location{loc},
+			Value:    []int64{int64(s.NumEval), s.ExprTimeNs},
+		})
+	}
+	if err := p.CheckValid(); err != nil {
+		return err
+	}
+	return p.Write(w)
+}
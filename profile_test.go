@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/pprof/profile"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+
+	fnv1beta1 "github.com/crossplane/function-sdk-go/proto/v1beta1"
+	"github.com/crossplane/function-sdk-go/resource"
+
+	"github.com/crossplane/function-rego/input/v1beta1"
+)
+
+func TestProfileRequests(t *testing.T) {
+	script := "package crossplane\n\nwarn[msg] {\n\tsome i\n\tnumbers[i] > 1\n\tmsg := sprintf(\"%d\", [i])\n}\n\nnumbers := [1, 2, 3]\n"
+	reqs := []*fnv1beta1.RunFunctionRequest{{
+		Input: resource.MustStructObject(&v1beta1.Input{TypeMeta: inputTypeMeta, Spec: v1beta1.InputSpec{Scripts: map[string]string{"policy.rego": script}}}),
+	}}
+	f := &Function{log: logging.NewNopLogger()}
+
+	stats, err := profileRequests(context.Background(), f, reqs)
+	if err != nil {
+		t.Fatalf("profileRequests(...): %v", err)
+	}
+	if f.profiler != nil {
+		t.Errorf("profileRequests(...): want the profiler to be removed")
+	}
+
+	evals := map[string]int{}
+	for _, s := range stats {
+		evals[exprLocation(s)] = s.NumEval
+	}
+	// The comparison is evaluated at least once for each of the numbers.
+	if evals["policy.rego:5"] < 3 {
+		t.Errorf("profileRequests(...): want policy.rego:5 to be evaluated at least 3 times, got %d", evals["policy.rego:5"])
+	}
+
+	buf := &bytes.Buffer{}
+	if err := writePprof(buf, stats); err != nil {
+		t.Fatalf("writePprof(...): %v", err)
+	}
+	p, err := profile.Parse(buf)
+	if err != nil {
+		t.Fatalf("profile.Parse(...): %v", err)
+	}
+	if diff := cmp.Diff(len(stats), len(p.Sample)); diff != "" {
+		t.Errorf("writePprof(...): -want samples, +got samples:\n%s", diff)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sort"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/profiler"
+	"github.com/open-policy-agent/opa/rego"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+
+	fnv1beta1 "github.com/crossplane/function-sdk-go/proto/v1beta1"
+
+	"github.com/crossplane/function-rego/input/v1beta1"
+)
+
+// A resourceInput is the input of a policy evaluated once per composed
+// resource.
+type resourceInput struct {
+	// Name of the composed resource in the pipeline, not its metadata.name.
+	Name string `json:"name"`
+
+	Resource *structpb.Struct `json:"resource"`
+
+	// Composite is the observed composite resource.
+	Composite *structpb.Struct `json:"composite,omitempty"`
+
+	Source *querySource `json:"source,omitempty"`
+
+	Meta *queryMeta `json:"meta,omitempty"`
+}
+
+// value returns the resource input as a Rego value.
+func (ri resourceInput) value() ast.Value {
+	obj := ast.NewObject(
+		ast.Item(ast.StringTerm("name"), ast.StringTerm(ri.Name)),
+		ast.Item(ast.StringTerm("resource"), ast.NewTerm(protoValue(ri.Resource.ProtoReflect()))),
+	)
+	if ri.Composite != nil {
+		obj.Insert(ast.StringTerm("composite"), ast.NewTerm(protoValue(ri.Composite.ProtoReflect())))
+	}
+	if ri.Source != nil {
+		obj.Insert(ast.StringTerm("source"), ast.NewTerm(ri.Source.value()))
+	}
+	if ri.Meta != nil {
+		obj.Insert(ast.StringTerm("meta"), ast.NewTerm(ri.Meta.value()))
+	}
+	return obj
+}
+
+// resourceInputs returns an input for each desired or observed composed
+// resource of the supplied request, depending on the supplied mode, in order
+// of name.
+func resourceInputs(mode v1beta1.EvaluationMode, req *fnv1beta1.RunFunctionRequest, src *querySource, meta *queryMeta) []resourceInput {
+	resources := req.GetDesired().GetResources()
+	if mode == v1beta1.EvaluationModeObservedResources {
+		resources = req.GetObserved().GetResources()
+	}
+	names := make([]string, 0, len(resources))
+	for n := range resources {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	in := make([]resourceInput, len(names))
+	for i, n := range names {
+		in[i] = resourceInput{
+			Name:      n,
+			Resource:  resources[n].GetResource(),
+			Composite: req.GetObserved().GetComposite().GetResource(),
+			Source:    src,
+			Meta:      meta,
+		}
+	}
+	return in
+}
+
+// evaluateResources evaluates the supplied prepared query of the supplied
+// policy against each of the supplied inputs, using up to resourceWorkers
+// concurrent evaluations. The results of the deny and warn rules of each
+// evaluation are prefixed with the name of the composed resource, and returned
+// in the order of the inputs. Evaluations that panic, e.g. in an OPA built-in,
+// are logged with their stack and return an error, since the panics of worker
+// goroutines can't be recovered from by the server.
+func (f *Function) evaluateResources(ctx context.Context, q rego.PreparedEvalQuery, p *policy, inputs []resourceInput, prof *profiler.Profiler) ([]ruleResult, error) {
+	workers := f.resourceWorkers
+	if workers <= 0 || prof != nil {
+		// Profilers don't support concurrent evaluations.
+		workers = 1
+	}
+
+	out := make([][]ruleResult, len(inputs))
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(workers)
+	for i := range inputs {
+		i := i
+		g.Go(func() (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					f.log.Info("Evaluation panicked", "resource", inputs[i].Name, "panic", r, "stack", string(debug.Stack()))
+					err = errors.Errorf("evaluation of composed resource %q panicked: %v", inputs[i].Name, r)
+				}
+			}()
+			b, err := evaluate(gctx, q, inputs[i].value(), prof)
+			if err != nil {
+				return errors.Wrapf(err, "cannot evaluate composed resource %q", inputs[i].Name)
+			}
+			results := p.results(b)
+			for _, r := range results {
+				r.result.Message = fmt.Sprintf("composed resource %q: %s", inputs[i].Name, r.result.GetMessage())
+			}
+			out[i] = results
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	var results []ruleResult
+	for _, r := range out {
+		results = append(results, r...)
+	}
+	return results, nil
+}
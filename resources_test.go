@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/types"
+	"google.golang.org/protobuf/testing/protocmp"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+
+	fnv1beta1 "github.com/crossplane/function-sdk-go/proto/v1beta1"
+	"github.com/crossplane/function-sdk-go/resource"
+
+	"github.com/crossplane/function-rego/input/v1beta1"
+)
+
+func TestRunFunctionPerResource(t *testing.T) {
+	const ownerPolicy = `package crossplane
+
+deny[msg] {
+	not input.resource.metadata.labels.owner
+	msg := sprintf("%s of %s must have an owner", [input.name, input.composite.metadata.name])
+}
+`
+	req := func(mode v1beta1.EvaluationMode, script string) *fnv1beta1.RunFunctionRequest {
+		return &fnv1beta1.RunFunctionRequest{
+			Input: resource.MustStructObject(&v1beta1.Input{
+				TypeMeta: inputTypeMeta,
+				Spec:     v1beta1.InputSpec{Mode: mode, Scripts: map[string]string{"policy.rego": script}},
+			}),
+			Observed: &fnv1beta1.State{
+				Composite: &fnv1beta1.Resource{Resource: resource.MustStructJSON(`{"metadata": {"name": "xr"}}`)},
+				Resources: map[string]*fnv1beta1.Resource{
+					"bucket": {Resource: resource.MustStructJSON(`{"metadata": {"labels": {"owner": "team-a"}}}`)},
+					"db":     {Resource: resource.MustStructJSON(`{"metadata": {}}`)},
+				},
+			},
+			Desired: &fnv1beta1.State{
+				Resources: map[string]*fnv1beta1.Resource{
+					"bucket": {Resource: resource.MustStructJSON(`{"metadata": {}}`)},
+					"db":     {Resource: resource.MustStructJSON(`{"metadata": {}}`)},
+					"queue":  {Resource: resource.MustStructJSON(`{"metadata": {"labels": {"owner": "team-b"}}}`)},
+				},
+			},
+		}
+	}
+	fatal := func(msg string) *fnv1beta1.Result {
+		return &fnv1beta1.Result{Severity: fnv1beta1.Severity_SEVERITY_FATAL, Message: msg}
+	}
+
+	cases := map[string]struct {
+		reason string
+		req    *fnv1beta1.RunFunctionRequest
+		want   []*fnv1beta1.Result
+	}{
+		"DesiredResources": {
+			reason: "The policy should be evaluated once per desired composed resource, and its results prefixed with the resource's name",
+			req:    req(v1beta1.EvaluationModeDesiredResources, ownerPolicy),
+			want: []*fnv1beta1.Result{
+				fatal(`composed resource "bucket": bucket of xr must have an owner`),
+				fatal(`composed resource "db": db of xr must have an owner`),
+			},
+		},
+		"ObservedResources": {
+			reason: "The policy should be evaluated once per observed composed resource",
+			req:    req(v1beta1.EvaluationModeObservedResources, ownerPolicy),
+			want: []*fnv1beta1.Result{
+				fatal(`composed resource "db": db of xr must have an owner`),
+			},
+		},
+		"ResponseRule": {
+			reason: "Policies evaluated per resource should not be able to return a whole response",
+			req:    req(v1beta1.EvaluationModeDesiredResources, "package crossplane\n\nresponse := input.response\n"),
+			want: []*fnv1beta1.Result{
+				fatal("the response rule is not supported in the desiredResources mode"),
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			f := &Function{log: logging.NewNopLogger(), policies: newPolicyCache(1), resourceWorkers: 2}
+			rsp, err := f.RunFunction(context.Background(), tc.req)
+			if err != nil {
+				t.Fatalf("%s\nf.RunFunction(...): %v", tc.reason, err)
+			}
+			if diff := cmp.Diff(tc.want, rsp.GetResults(), protocmp.Transform()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want results, +got results:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestEvaluateResourcesPanic(t *testing.T) {
+	boom := rego.Function1(&rego.Function{Name: "boom", Decl: types.NewFunction(types.Args(types.A), types.A)},
+		func(rego.BuiltinContext, *ast.Term) (*ast.Term, error) { panic("boom") })
+	q, err := rego.New(rego.Query("x = boom(input.name)"), boom).PrepareForEval(context.Background())
+	if err != nil {
+		t.Fatalf("PrepareForEval(...): %v", err)
+	}
+
+	f := &Function{log: logging.NewNopLogger(), resourceWorkers: 2}
+	inputs := []resourceInput{{Name: "bucket"}, {Name: "db"}}
+
+	_, err = f.evaluateResources(context.Background(), q, &policy{}, inputs, nil)
+	if err == nil || !strings.Contains(err.Error(), "panicked: boom") {
+		t.Errorf("f.evaluateResources(...): want an error reporting the panic, got %v", err)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"k8s.io/apiextensions-apiserver/pkg/apis/apiextensions"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	structuralschema "k8s.io/apiextensions-apiserver/pkg/apiserver/schema"
+	"k8s.io/apiextensions-apiserver/pkg/apiserver/schema/pruning"
+	"k8s.io/apiextensions-apiserver/pkg/apiserver/validation"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/yaml"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+
+	fnv1beta1 "github.com/crossplane/function-sdk-go/proto/v1beta1"
+
+	"github.com/crossplane/function-rego/input/v1beta1"
+)
+
+// A schemaIndex holds the OpenAPI schemas of CRDs, by the group, version and
+// kind of the resources they define.
+type schemaIndex struct {
+	schemas map[schema.GroupVersionKind]*resourceSchema
+}
+
+// A resourceSchema is the schema of a version of a CRD.
+type resourceSchema struct {
+	structural *structuralschema.Structural
+	validator  validation.SchemaCreateValidator
+}
+
+// loadSchemas loads the schemas of every version of every CRD found in the
+// YAML or JSON files of the supplied directory and its subdirectories. Other
+// kinds of documents are ignored.
+func loadSchemas(dir string) (*schemaIndex, error) {
+	idx := &schemaIndex{schemas: map[schema.GroupVersionKind]*resourceSchema{}}
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path != dir && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		switch filepath.Ext(path) {
+		case ".yaml", ".yml", ".json":
+			return errors.Wrapf(idx.loadFile(path), "cannot load schemas from %q", path)
+		}
+		return nil
+	})
+	return idx, errors.Wrapf(err, "cannot load schema directory %q", dir)
+}
+
+func (idx *schemaIndex) loadFile(path string) error {
+	f, err := os.Open(path) //nolint:gosec // Reading files of the configured directory is intended.
+	if err != nil {
+		return err
+	}
+	defer f.Close() //nolint:errcheck // Only read.
+
+	d := yaml.NewYAMLOrJSONDecoder(f, 4096)
+	for {
+		u := &unstructured.Unstructured{}
+		err := d.Decode(&u.Object)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "cannot decode document")
+		}
+		if u.GroupVersionKind() != apiextensionsv1.SchemeGroupVersion.WithKind("CustomResourceDefinition") {
+			continue
+		}
+		crd := &apiextensionsv1.CustomResourceDefinition{}
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, crd); err != nil {
+			return errors.Wrapf(err, "cannot decode CustomResourceDefinition %q", u.GetName())
+		}
+		if err := idx.add(crd); err != nil {
+			return errors.Wrapf(err, "invalid CustomResourceDefinition %q", crd.GetName())
+		}
+	}
+}
+
+func (idx *schemaIndex) add(crd *apiextensionsv1.CustomResourceDefinition) error {
+	for _, v := range crd.Spec.Versions {
+		if v.Schema == nil || v.Schema.OpenAPIV3Schema == nil {
+			continue
+		}
+		s := &apiextensions.JSONSchemaProps{}
+		if err := apiextensionsv1.Convert_v1_JSONSchemaProps_To_apiextensions_JSONSchemaProps(v.Schema.OpenAPIV3Schema, s, nil); err != nil {
+			return errors.Wrapf(err, "cannot convert schema of version %s", v.Name)
+		}
+		ss, err := structuralschema.NewStructural(s)
+		if err != nil {
+			return errors.Wrapf(err, "schema of version %s is not structural", v.Name)
+		}
+		sv, _, err := validation.NewSchemaValidator(s)
+		if err != nil {
+			return errors.Wrapf(err, "cannot build validator of version %s", v.Name)
+		}
+		gvk := schema.GroupVersionKind{Group: crd.Spec.Group, Version: v.Name, Kind: crd.Spec.Names.Kind}
+		idx.schemas[gvk] = &resourceSchema{structural: ss, validator: sv}
+	}
+	return nil
+}
+
+// validate the supplied resource against the schema of its kind, if known,
+// returning each of its problems prefixed with the path of the field at
+// fault. The resource is modified.
+func (idx *schemaIndex) validate(obj map[string]any) ([]string, bool) {
+	u := &unstructured.Unstructured{Object: obj}
+	s, ok := idx.schemas[u.GroupVersionKind()]
+	if !ok {
+		return nil, false
+	}
+
+	// Unknown fields are pruned before validating the remaining ones, like
+	// the API server does.
+	var problems []string
+	for _, p := range pruning.PruneWithOptions(obj, s.structural, true, structuralschema.UnknownFieldPathOptions{TrackUnknownFieldPaths: true}) {
+		problems = append(problems, fmt.Sprintf("%s: unknown field", p))
+	}
+	for _, err := range validation.ValidateCustomResource(nil, integers(obj), s.validator) {
+		problems = append(problems, err.Error())
+	}
+	sort.Strings(problems)
+	return problems, true
+}
+
+// integers converts the whole float64 numbers of the supplied JSON value to
+// int64, like the API server decodes them, so that they validate as integers.
+func integers(v any) any {
+	switch t := v.(type) {
+	case float64:
+		if t == math.Trunc(t) && math.Abs(t) < math.MaxInt64 {
+			return int64(t)
+		}
+	case map[string]any:
+		for k, e := range t {
+			t[k] = integers(e)
+		}
+	case []any:
+		for i, e := range t {
+			t[i] = integers(e)
+		}
+	}
+	return v
+}
+
+// validateSchemas validates the desired composed resources of the supplied
+// response against the schemas of their kinds, returning a fatal result for
+// each problem, or a warning if the supplied enforcement action is warn.
+// Problems are only logged if it is dryrun.
+func (f *Function) validateSchemas(rsp *fnv1beta1.RunFunctionResponse, ea v1beta1.EnforcementAction) []*fnv1beta1.Result {
+	desired := rsp.GetDesired().GetResources()
+	names := make([]string, 0, len(desired))
+	for n := range desired {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	var results []*fnv1beta1.Result
+	for _, name := range names {
+		obj := desired[name].GetResource().AsMap()
+		u := &unstructured.Unstructured{Object: obj}
+		apiVersion, kind := u.GetAPIVersion(), u.GetKind()
+		problems, ok := f.schemas.validate(obj)
+		if !ok {
+			f.log.Debug("Not validating composed resource without a known schema", "name", name, "apiVersion", apiVersion, "kind", kind)
+			continue
+		}
+		for _, p := range problems {
+			msg := fmt.Sprintf("composed resource %q does not match the schema of %s %s: %s", name, apiVersion, kind, p)
+			switch ea {
+			case v1beta1.EnforcementActionDryRun:
+				f.log.Info("Dropping schema validation error", "enforcementAction", ea, "message", msg)
+			case v1beta1.EnforcementActionWarn:
+				results = append(results, &fnv1beta1.Result{Severity: fnv1beta1.Severity_SEVERITY_WARNING, Message: msg})
+			default:
+				results = append(results, &fnv1beta1.Result{Severity: fnv1beta1.Severity_SEVERITY_FATAL, Message: msg})
+			}
+		}
+	}
+	return results
+}
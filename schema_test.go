@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/protobuf/testing/protocmp"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+
+	fnv1beta1 "github.com/crossplane/function-sdk-go/proto/v1beta1"
+	"github.com/crossplane/function-sdk-go/resource"
+
+	"github.com/crossplane/function-rego/input/v1beta1"
+)
+
+const bucketCRD = `---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: ignored
+---
+apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: buckets.s3.aws.upbound.io
+spec:
+  group: s3.aws.upbound.io
+  names:
+    kind: Bucket
+    plural: buckets
+  scope: Cluster
+  versions:
+  - name: v1beta1
+    served: true
+    storage: true
+    schema:
+      openAPIV3Schema:
+        type: object
+        properties:
+          spec:
+            type: object
+            required: [forProvider]
+            properties:
+              forProvider:
+                type: object
+                required: [region]
+                properties:
+                  region:
+                    type: string
+                  retention:
+                    type: integer
+                    minimum: 1
+`
+
+func TestRunFunctionWithSchemas(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "bucket.yaml"), []byte(bucketCRD), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	schemas, err := loadSchemas(dir)
+	if err != nil {
+		t.Fatalf("loadSchemas(...): %v", err)
+	}
+
+	req := func(action v1beta1.EnforcementAction, resources map[string]string) *fnv1beta1.RunFunctionRequest {
+		desired := map[string]*fnv1beta1.Resource{}
+		for name, r := range resources {
+			desired[name] = &fnv1beta1.Resource{Resource: resource.MustStructJSON(r)}
+		}
+		return &fnv1beta1.RunFunctionRequest{
+			Input: resource.MustStructObject(&v1beta1.Input{
+				TypeMeta: inputTypeMeta,
+				Spec: v1beta1.InputSpec{
+					Scripts:                map[string]string{"policy.rego": "package crossplane\n\ndeny[msg] {\n\tmsg := input.nothing\n}\n"},
+					SchemaValidationAction: action,
+				},
+			}),
+			Desired: &fnv1beta1.State{Resources: desired},
+		}
+	}
+
+	cases := map[string]struct {
+		reason string
+		req    *fnv1beta1.RunFunctionRequest
+		want   []*fnv1beta1.Result
+	}{
+		"Valid": {
+			reason: "Desired composed resources that match their schema should not return results",
+			req: req("", map[string]string{
+				"bucket": `{"apiVersion": "s3.aws.upbound.io/v1beta1", "kind": "Bucket", "metadata": {"name": "b"}, "spec": {"forProvider": {"region": "eu-west-1", "retention": 7}}}`,
+			}),
+		},
+		"UnknownKind": {
+			reason: "Desired composed resources of kinds without a known schema should not be validated",
+			req: req("", map[string]string{
+				"queue": `{"apiVersion": "sqs.aws.upbound.io/v1beta1", "kind": "Queue", "spec": {"whatever": true}}`,
+			}),
+		},
+		"Invalid": {
+			reason: "Each problem of desired composed resources that don't match their schema should return a fatal result with the path of the field at fault",
+			req: req("", map[string]string{
+				"bucket": `{"apiVersion": "s3.aws.upbound.io/v1beta1", "kind": "Bucket", "spec": {"forProvider": {"retention": 0, "tags": {"env": "prod"}}}}`,
+				"other":  `{"apiVersion": "s3.aws.upbound.io/v1beta1", "kind": "Bucket", "spec": {"forProvider": {"region": 1}}}`,
+			}),
+			want: []*fnv1beta1.Result{
+				{Severity: fnv1beta1.Severity_SEVERITY_FATAL, Message: `composed resource "bucket" does not match the schema of s3.aws.upbound.io/v1beta1 Bucket: spec.forProvider.region: Required value`},
+				{Severity: fnv1beta1.Severity_SEVERITY_FATAL, Message: `composed resource "bucket" does not match the schema of s3.aws.upbound.io/v1beta1 Bucket: spec.forProvider.retention: Invalid value: 0: spec.forProvider.retention in body should be greater than or equal to 1`},
+				{Severity: fnv1beta1.Severity_SEVERITY_FATAL, Message: `composed resource "bucket" does not match the schema of s3.aws.upbound.io/v1beta1 Bucket: spec.forProvider.tags: unknown field`},
+				{Severity: fnv1beta1.Severity_SEVERITY_FATAL, Message: `composed resource "other" does not match the schema of s3.aws.upbound.io/v1beta1 Bucket: spec.forProvider.region: Invalid value: "integer": spec.forProvider.region in body must be of type string: "integer"`},
+			},
+		},
+		"Warn": {
+			reason: "Problems should be returned as warnings when the schema validation action is warn",
+			req: req(v1beta1.EnforcementActionWarn, map[string]string{
+				"bucket": `{"apiVersion": "s3.aws.upbound.io/v1beta1", "kind": "Bucket", "spec": {"forProvider": {"region": "eu-west-1", "acl": "private"}}}`,
+			}),
+			want: []*fnv1beta1.Result{
+				{Severity: fnv1beta1.Severity_SEVERITY_WARNING, Message: `composed resource "bucket" does not match the schema of s3.aws.upbound.io/v1beta1 Bucket: spec.forProvider.acl: unknown field`},
+			},
+		},
+		"DryRun": {
+			reason: "Problems should only be logged when the schema validation action is dryrun",
+			req: req(v1beta1.EnforcementActionDryRun, map[string]string{
+				"bucket": `{"apiVersion": "s3.aws.upbound.io/v1beta1", "kind": "Bucket", "spec": {"forProvider": {"region": "eu-west-1", "acl": "private"}}}`,
+			}),
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			f := &Function{log: logging.NewNopLogger(), schemas: schemas}
+			rsp, err := f.RunFunction(context.Background(), tc.req)
+			if err != nil {
+				t.Fatalf("%s\nf.RunFunction(...): %v", tc.reason, err)
+			}
+			if diff := cmp.Diff(tc.want, rsp.GetResults(), protocmp.Transform()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want results, +got results:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"net"
+	"runtime/debug"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthv1 "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+
+	"github.com/crossplane/function-sdk-go"
+	fnv1beta1 "github.com/crossplane/function-sdk-go/proto/v1beta1"
+	"github.com/crossplane/function-sdk-go/response"
+)
+
+// A server serves a Function over gRPC, alongside a gRPC health service and,
+// optionally, the gRPC server reflection service.
+type server struct {
+	srv    *grpc.Server
+	health *health.Server
+	lis    net.Listener
+}
+
+// serverConfig configures a server beyond what function.Serve supports.
+type serverConfig struct {
+	// log panics.
+	log logging.Logger
+
+	// reflection registers the reflection service if true.
+	reflection bool
+
+	// interceptors run after panics are recovered from.
+	interceptors []grpc.UnaryServerInterceptor
+}
+
+// newServer creates a gRPC server for the supplied Function, configured like
+// function.Serve would. The health service reports NOT_SERVING until
+// setServing is called. Panics are recovered and logged.
+func newServer(fn fnv1beta1.FunctionRunnerServiceServer, cfg serverConfig, o ...function.ServeOption) (*server, error) {
+	so := &function.ServeOptions{
+		Network: function.DefaultNetwork,
+		Address: function.DefaultAddress,
+	}
+
+	for _, fn := range o {
+		if err := fn(so); err != nil {
+			return nil, errors.Wrap(err, "cannot apply ServeOption")
+		}
+	}
+
+	if so.Credentials == nil {
+		return nil, errors.New("no credentials provided - did you specify the Insecure or MTLSCertificates options?")
+	}
+
+	lis, err := net.Listen(so.Network, so.Address)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot listen for %s connections at address %q", so.Network, so.Address)
+	}
+
+	s := &server{
+		srv:    grpc.NewServer(grpc.Creds(so.Credentials), grpc.ChainUnaryInterceptor(append([]grpc.UnaryServerInterceptor{recoverPanics(cfg.log)}, cfg.interceptors...)...)),
+		health: health.NewServer(),
+		lis:    lis,
+	}
+	s.health.SetServingStatus("", healthv1.HealthCheckResponse_NOT_SERVING)
+
+	if cfg.reflection {
+		reflection.Register(s.srv)
+	}
+	healthv1.RegisterHealthServer(s.srv, s.health)
+	fnv1beta1.RegisterFunctionRunnerServiceServer(s.srv, fn)
+	return s, nil
+}
+
+// setServing marks the server as ready to serve requests.
+func (s *server) setServing() {
+	s.health.SetServingStatus("", healthv1.HealthCheckResponse_SERVING)
+}
+
+// serve requests. Blocks until the server returns an error.
+func (s *server) serve() error {
+	return errors.Wrap(s.srv.Serve(s.lis), "cannot serve mTLS gRPC connections")
+}
+
+// stop the server immediately.
+func (s *server) stop() {
+	s.health.Shutdown()
+	s.srv.Stop()
+}
+
+// recoverPanics returns an interceptor recovering from panics, e.g. in OPA
+// built-ins, so that they don't take down the whole process. Panics are logged
+// with their stack trace. Panics running the Function return a fatal result,
+// while panics serving other methods return an internal error.
+func recoverPanics(log logging.Logger) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (rsp any, err error) {
+		defer func() {
+			r := recover()
+			if r == nil {
+				return
+			}
+			log.Info("Recovered from panic", "method", info.FullMethod, "panic", r, "stack", string(debug.Stack()))
+
+			if req, ok := req.(*fnv1beta1.RunFunctionRequest); ok {
+				frsp := response.To(req, response.DefaultTTL)
+				response.Fatal(frsp, errors.Errorf("function panicked: %v", r))
+				rsp, err = frsp, nil
+				return
+			}
+			rsp, err = nil, status.Errorf(codes.Internal, "panic: %v", r)
+		}()
+		return handler(ctx, req)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/alecthomas/kong"
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	healthv1 "google.golang.org/grpc/health/grpc_health_v1"
+	reflectionv1alpha "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/testing/protocmp"
+
+	"github.com/crossplane/function-sdk-go"
+	fnv1beta1 "github.com/crossplane/function-sdk-go/proto/v1beta1"
+)
+
+// panicky is a Function that always panics.
+type panicky struct {
+	fnv1beta1.UnimplementedFunctionRunnerServiceServer
+}
+
+func (panicky) RunFunction(context.Context, *fnv1beta1.RunFunctionRequest) (*fnv1beta1.RunFunctionResponse, error) {
+	panic("boom")
+}
+
+func TestServer(t *testing.T) {
+	log, err := function.NewLogger(true)
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+
+	srv, err := newServer(panicky{}, serverConfig{log: log}, function.Listen("tcp", "127.0.0.1:0"), function.Insecure(true))
+	if err != nil {
+		t.Fatalf("newServer(...): %v", err)
+	}
+	go srv.serve() //nolint:errcheck // Returns once stopped.
+	t.Cleanup(srv.stop)
+
+	conn, err := grpc.Dial(srv.lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("grpc.Dial(...): %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	ctx := context.Background()
+
+	t.Run("Health", func(t *testing.T) {
+		hc := healthv1.NewHealthClient(conn)
+		for _, want := range []healthv1.HealthCheckResponse_ServingStatus{healthv1.HealthCheckResponse_NOT_SERVING, healthv1.HealthCheckResponse_SERVING} {
+			rsp, err := hc.Check(ctx, &healthv1.HealthCheckRequest{})
+			if err != nil {
+				t.Fatalf("hc.Check(...): %v", err)
+			}
+			if diff := cmp.Diff(want, rsp.GetStatus()); diff != "" {
+				t.Errorf("hc.Check(...): -want status, +got status:\n%s", diff)
+			}
+			srv.setServing()
+		}
+	})
+
+	t.Run("Panic", func(t *testing.T) {
+		rsp, err := fnv1beta1.NewFunctionRunnerServiceClient(conn).RunFunction(ctx, &fnv1beta1.RunFunctionRequest{Meta: &fnv1beta1.RequestMeta{Tag: "hello"}})
+		if err != nil {
+			t.Fatalf("RunFunction(...): want panics to be recovered, got error: %v", err)
+		}
+		want := []*fnv1beta1.Result{{
+			Severity: fnv1beta1.Severity_SEVERITY_FATAL,
+			Message:  "function panicked: boom",
+		}}
+		if diff := cmp.Diff(want, rsp.GetResults(), protocmp.Transform()); diff != "" {
+			t.Errorf("RunFunction(...): -want results, +got results:\n%s", diff)
+		}
+		if diff := cmp.Diff("hello", rsp.GetMeta().GetTag()); diff != "" {
+			t.Errorf("RunFunction(...): -want tag, +got tag:\n%s", diff)
+		}
+	})
+
+	t.Run("NoReflection", func(t *testing.T) {
+		s, err := reflectionv1alpha.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+		if err == nil {
+			_, err = s.Recv()
+		}
+		if diff := cmp.Diff(codes.Unimplemented, status.Code(err)); diff != "" {
+			t.Errorf("ServerReflectionInfo(...): want reflection not to be served: -want code, +got code:\n%s", diff)
+		}
+	})
+}
+
+func TestReflectionFlag(t *testing.T) {
+	cases := map[string]struct {
+		reason string
+		args   []string
+		want   bool
+	}{
+		"Default": {
+			reason: "The reflection service should be served by default, like function.Serve does",
+			args:   []string{"serve"},
+			want:   true,
+		},
+		"Disabled": {
+			reason: "The reflection service should not be served if disabled",
+			args:   []string{"serve", "--no-reflection"},
+			want:   false,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			cli := &CLI{}
+			p, err := kong.New(cli)
+			if err != nil {
+				t.Fatalf("kong.New(...): %v", err)
+			}
+			if _, err := p.Parse(tc.args); err != nil {
+				t.Fatalf("p.Parse(%v): %v", tc.args, err)
+			}
+			if diff := cmp.Diff(tc.want, cli.Serve.Reflection); diff != "" {
+				t.Errorf("%s\np.Parse(%v): -want reflection, +got reflection:\n%s", tc.reason, tc.args, diff)
+			}
+		})
+	}
+}
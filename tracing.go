@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	sdkresource "go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+
+	fnv1beta1 "github.com/crossplane/function-sdk-go/proto/v1beta1"
+)
+
+// tracerName is the name of the tracer used to trace the Function.
+const tracerName = "github.com/crossplane/function-rego"
+
+// Span attributes.
+const (
+	attrTag      = attribute.Key("crossplane.function.tag")
+	attrCacheHit = attribute.Key("function_rego.cache.hit")
+)
+
+// newTracerProvider returns a tracer provider exporting spans in batches to the
+// supplied OTLP gRPC endpoint.
+func newTracerProvider(ctx context.Context, endpoint string, insecure bool) (*sdktrace.TracerProvider, error) {
+	o := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(endpoint)}
+	if insecure {
+		o = append(o, otlptracegrpc.WithInsecure())
+	}
+	exp, err := otlptracegrpc.New(ctx, o...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot create OTLP trace exporter for endpoint %q", endpoint)
+	}
+	res := sdkresource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName("function-rego"))
+	return sdktrace.NewTracerProvider(sdktrace.WithBatcher(exp), sdktrace.WithResource(res)), nil
+}
+
+// propagateTrace returns an interceptor extracting the trace context, if any,
+// from the metadata of incoming calls so that spans are part of the caller's
+// trace.
+func propagateTrace(p propagation.TextMapPropagator) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		md, ok := metadata.FromIncomingContext(ctx)
+		if !ok {
+			return handler(ctx, req)
+		}
+		return handler(p.Extract(ctx, metadataCarrier(md)), req)
+	}
+}
+
+// A metadataCarrier adapts gRPC metadata to a TextMapCarrier.
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+	if v := metadata.MD(c).Get(key); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+func (c metadataCarrier) Set(key, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// endSpan ends the supplied span, recording the supplied error, if any.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// fatalResult returns an error with the message of the first fatal result of
+// the supplied response, if any.
+func fatalResult(rsp *fnv1beta1.RunFunctionResponse) error {
+	for _, r := range rsp.GetResults() {
+		if r.GetSeverity() == fnv1beta1.Severity_SEVERITY_FATAL {
+			return errors.New(r.GetMessage())
+		}
+	}
+	return nil
+}
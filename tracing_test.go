@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	collectortracev1 "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/crossplane/function-sdk-go"
+	fnv1beta1 "github.com/crossplane/function-sdk-go/proto/v1beta1"
+	"github.com/crossplane/function-sdk-go/resource"
+
+	"github.com/crossplane/function-rego/input/v1beta1"
+)
+
+func TestRunFunctionSpans(t *testing.T) {
+	log, err := function.NewLogger(true)
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+
+	sr := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))
+	f := &Function{log: log, debug: true, tracer: tp.Tracer(tracerName), policies: newPolicyCache(1)}
+
+	req := &fnv1beta1.RunFunctionRequest{
+		Input: resource.MustStructObject(&v1beta1.Input{
+			TypeMeta: inputTypeMeta,
+			Spec:     v1beta1.InputSpec{Scripts: map[string]string{"policy.rego": "package crossplane\n\nwarn[\"careful\"] { true }\n"}},
+		}),
+	}
+
+	// The caller's trace context is propagated using gRPC metadata.
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01"))
+	run := func(ctx context.Context, req any) (any, error) {
+		return f.RunFunction(ctx, req.(*fnv1beta1.RunFunctionRequest)) //nolint:forcetypeassert // Always a RunFunctionRequest.
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := propagateTrace(propagation.TraceContext{})(ctx, req, &grpc.UnaryServerInfo{}, run); err != nil {
+			t.Fatalf("RunFunction(...): %v", err)
+		}
+	}
+
+	type span struct {
+		Name     string
+		TraceID  string
+		CacheHit *bool
+	}
+	hit, miss := true, false
+	got := []span{}
+	for _, s := range sr.Ended() {
+		sp := span{Name: s.Name(), TraceID: s.SpanContext().TraceID().String()}
+		for _, a := range s.Attributes() {
+			if a.Key == attrCacheHit {
+				v := a.Value.AsBool()
+				sp.CacheHit = &v
+			}
+		}
+		got = append(got, sp)
+	}
+	want := []span{}
+	for _, cacheHit := range []*bool{&miss, &hit} {
+		want = append(want,
+			span{Name: "DecodeInput", TraceID: traceID},
+			span{Name: "LoadPolicies", TraceID: traceID},
+			span{Name: "ValidateInput", TraceID: traceID},
+			span{Name: "Compile", TraceID: traceID, CacheHit: cacheHit},
+			span{Name: "Evaluate", TraceID: traceID},
+			span{Name: "ConvertOutput", TraceID: traceID},
+			span{Name: "DiffDesiredState", TraceID: traceID},
+			span{Name: "RunFunction", TraceID: traceID},
+		)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("RunFunction(...): -want spans, +got spans:\n%s", diff)
+	}
+}
+
+// A collector records the names of the spans exported to it.
+type collector struct {
+	collectortracev1.UnimplementedTraceServiceServer
+
+	mu    sync.Mutex
+	spans []string
+}
+
+func (c *collector) Export(_ context.Context, req *collectortracev1.ExportTraceServiceRequest) (*collectortracev1.ExportTraceServiceResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, rs := range req.GetResourceSpans() {
+		for _, ss := range rs.GetScopeSpans() {
+			for _, s := range ss.GetSpans() {
+				c.spans = append(c.spans, s.GetName())
+			}
+		}
+	}
+	return &collectortracev1.ExportTraceServiceResponse{}, nil
+}
+
+func TestNewTracerProvider(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &collector{}
+	srv := grpc.NewServer()
+	collectortracev1.RegisterTraceServiceServer(srv, c)
+	go srv.Serve(lis) //nolint:errcheck // Returns once stopped.
+	t.Cleanup(srv.Stop)
+
+	ctx := context.Background()
+	tp, err := newTracerProvider(ctx, lis.Addr().String(), true)
+	if err != nil {
+		t.Fatalf("newTracerProvider(...): %v", err)
+	}
+	_, span := tp.Tracer(tracerName).Start(ctx, "RunFunction")
+	span.End()
+	if err := tp.Shutdown(ctx); err != nil {
+		t.Fatalf("tp.Shutdown(...): %v", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if diff := cmp.Diff([]string{"RunFunction"}, c.spans); diff != "" {
+		t.Errorf("newTracerProvider(...): -want exported spans, +got exported spans:\n%s", diff)
+	}
+}
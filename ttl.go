@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+
+	fnv1beta1 "github.com/crossplane/function-sdk-go/proto/v1beta1"
+)
+
+// setTTL sets the TTL of the supplied response meta to the supplied value of
+// the ttl rule, if defined, bounded by the minimum and maximum TTL of the
+// Function. A warning is returned if the TTL is out of bounds.
+func (f *Function) setTTL(meta *fnv1beta1.ResponseMeta, binding any) ([]ruleResult, error) {
+	// The ttl rule is bound to an array holding its value, if defined.
+	values, _ := binding.([]any)
+	if len(values) == 0 || meta == nil {
+		return nil, nil
+	}
+
+	ttl, err := parseTTL(values[0])
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid %s rule", ttlRule)
+	}
+
+	var results []ruleResult
+	bounded := ttl
+	switch {
+	case ttl < f.minTTL:
+		bounded = f.minTTL
+	case f.maxTTL > 0 && ttl > f.maxTTL:
+		bounded = f.maxTTL
+	}
+	if bounded != ttl {
+		msg := fmt.Sprintf("TTL %s is out of the bounds of %s to %s, using %s", ttl, f.minTTL, f.maxTTL, bounded)
+		if f.maxTTL == 0 {
+			msg = fmt.Sprintf("TTL %s is shorter than %s, using %s", ttl, f.minTTL, bounded)
+		}
+		results = append(results, ruleResult{result: &fnv1beta1.Result{Severity: fnv1beta1.Severity_SEVERITY_WARNING, Message: msg}})
+	}
+	meta.Ttl = durationpb.New(bounded)
+	return results, nil
+}
+
+// parseTTL parses the supplied TTL, either a duration string, e.g. "5m", or a
+// number of seconds.
+func parseTTL(v any) (time.Duration, error) {
+	switch t := v.(type) {
+	case string:
+		return time.ParseDuration(t)
+	case json.Number:
+		s, err := t.Float64()
+		return time.Duration(s * float64(time.Second)), err
+	}
+	return 0, errors.Errorf("TTL must be a duration string or a number of seconds, got %v", v)
+}
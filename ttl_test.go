@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/protobuf/testing/protocmp"
+
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+
+	fnv1beta1 "github.com/crossplane/function-sdk-go/proto/v1beta1"
+	"github.com/crossplane/function-sdk-go/resource"
+	"github.com/crossplane/function-sdk-go/response"
+
+	"github.com/crossplane/function-rego/input/v1beta1"
+)
+
+func TestRunFunctionTTL(t *testing.T) {
+	req := func(mode v1beta1.EvaluationMode, ttl string) *fnv1beta1.RunFunctionRequest {
+		script := "package crossplane\n\nwarn[msg] {\n\tmsg := input.nothing\n}\n"
+		if ttl != "" {
+			script += "\nttl := " + ttl + "\n"
+		}
+		return &fnv1beta1.RunFunctionRequest{
+			Input: resource.MustStructObject(&v1beta1.Input{
+				TypeMeta: inputTypeMeta,
+				Spec:     v1beta1.InputSpec{Mode: mode, Scripts: map[string]string{"policy.rego": script}},
+			}),
+		}
+	}
+
+	withResponse := func(ov v1beta1.OutputValidation, script string) *fnv1beta1.RunFunctionRequest {
+		return &fnv1beta1.RunFunctionRequest{
+			Input: resource.MustStructObject(&v1beta1.Input{
+				TypeMeta: inputTypeMeta,
+				Spec:     v1beta1.InputSpec{OutputValidation: ov, Scripts: map[string]string{"policy.rego": script}},
+			}),
+		}
+	}
+	const invalidResponsePolicy = `package crossplane
+
+response := {"desired": {"resources": {"bucket": {"resource": {"kind": "Bucket"}}}}}
+
+ttl := "5m"
+`
+
+	type want struct {
+		ttl     time.Duration
+		results []*fnv1beta1.Result
+	}
+
+	cases := map[string]struct {
+		reason string
+		req    *fnv1beta1.RunFunctionRequest
+		want   want
+	}{
+		"Default": {
+			reason: "The default TTL should be used if the policy doesn't define the ttl rule",
+			req:    req("", ""),
+			want:   want{ttl: response.DefaultTTL},
+		},
+		"Duration": {
+			reason: "A TTL returned as a duration string should be used",
+			req:    req("", `"5m"`),
+			want:   want{ttl: 5 * time.Minute},
+		},
+		"Seconds": {
+			reason: "A TTL returned as a number of seconds should be used",
+			req:    req("", "30"),
+			want:   want{ttl: 30 * time.Second},
+		},
+		"TooShort": {
+			reason: "A TTL shorter than the minimum TTL should be raised to it, returning a warning",
+			req:    req("", `"1s"`),
+			want: want{
+				ttl: 10 * time.Second,
+				results: []*fnv1beta1.Result{
+					{Severity: fnv1beta1.Severity_SEVERITY_WARNING, Message: "TTL 1s is out of the bounds of 10s to 1h0m0s, using 10s"},
+				},
+			},
+		},
+		"TooLong": {
+			reason: "A TTL longer than the maximum TTL should be lowered to it, returning a warning",
+			req:    req("", `"2h"`),
+			want: want{
+				ttl: time.Hour,
+				results: []*fnv1beta1.Result{
+					{Severity: fnv1beta1.Severity_SEVERITY_WARNING, Message: "TTL 2h0m0s is out of the bounds of 10s to 1h0m0s, using 1h0m0s"},
+				},
+			},
+		},
+		"Invalid": {
+			reason: "An invalid TTL should return a fatal result",
+			req:    req("", `"soon"`),
+			want: want{
+				ttl: response.DefaultTTL,
+				results: []*fnv1beta1.Result{
+					{Severity: fnv1beta1.Severity_SEVERITY_FATAL, Message: `convert output stage failed: invalid ttl rule: time: invalid duration "soon"`},
+				},
+			},
+		},
+		"OnlyTTL": {
+			reason: "A policy defining only the ttl rule should set the TTL",
+			req:    withResponse("", "package crossplane\n\nttl := \"5m\"\n"),
+			want:   want{ttl: 5 * time.Minute},
+		},
+		"StrictDiscarded": {
+			reason: "The TTL should be discarded with a response discarded by strict output validation",
+			req:    withResponse(v1beta1.OutputValidationStrict, invalidResponsePolicy),
+			want: want{
+				ttl: response.DefaultTTL,
+				results: []*fnv1beta1.Result{
+					{Severity: fnv1beta1.Severity_SEVERITY_FATAL, Message: `invalid response: desired composed resource "bucket": apiVersion is required`},
+				},
+			},
+		},
+		"LenientKept": {
+			reason: "The TTL should be set if lenient output validation keeps the response",
+			req:    withResponse(v1beta1.OutputValidationLenient, invalidResponsePolicy),
+			want: want{
+				ttl: 5 * time.Minute,
+				results: []*fnv1beta1.Result{
+					{Severity: fnv1beta1.Severity_SEVERITY_WARNING, Message: `invalid response: desired composed resource "bucket": apiVersion is required`},
+				},
+			},
+		},
+		"PerResource": {
+			reason: "Policies evaluated per resource should not be able to set the TTL",
+			req:    req(v1beta1.EvaluationModeDesiredResources, `"5m"`),
+			want: want{
+				ttl: response.DefaultTTL,
+				results: []*fnv1beta1.Result{
+					{Severity: fnv1beta1.Severity_SEVERITY_FATAL, Message: "the ttl rule is not supported in the desiredResources mode"},
+				},
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			f := &Function{log: logging.NewNopLogger(), minTTL: 10 * time.Second, maxTTL: time.Hour}
+			rsp, err := f.RunFunction(context.Background(), tc.req)
+			if err != nil {
+				t.Fatalf("%s\nf.RunFunction(...): %v", tc.reason, err)
+			}
+			if diff := cmp.Diff(tc.want.ttl, rsp.GetMeta().GetTtl().AsDuration()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want TTL, +got TTL:\n%s", tc.reason, diff)
+			}
+			if diff := cmp.Diff(tc.want.results, rsp.GetResults(), protocmp.Transform()); diff != "" {
+				t.Errorf("%s\nf.RunFunction(...): -want results, +got results:\n%s", tc.reason, diff)
+			}
+		})
+	}
+}
+
+func TestRunFunctionUnboundedTTL(t *testing.T) {
+	req := &fnv1beta1.RunFunctionRequest{
+		Input: resource.MustStructObject(&v1beta1.Input{
+			TypeMeta: inputTypeMeta,
+			Spec:     v1beta1.InputSpec{Scripts: map[string]string{"policy.rego": "package crossplane\n\nttl := \"48h\"\n"}},
+		}),
+	}
+
+	f := &Function{log: logging.NewNopLogger(), minTTL: 10 * time.Second}
+	rsp, err := f.RunFunction(context.Background(), req)
+	if err != nil {
+		t.Fatalf("f.RunFunction(...): %v", err)
+	}
+	if diff := cmp.Diff(48*time.Hour, rsp.GetMeta().GetTtl().AsDuration()); diff != "" {
+		t.Errorf("A TTL should not be lowered if the maximum TTL is zero\nf.RunFunction(...): -want TTL, +got TTL:\n%s", diff)
+	}
+	if len(rsp.GetResults()) > 0 {
+		t.Errorf("A TTL should not be lowered if the maximum TTL is zero\nf.RunFunction(...): want no results, got %v", rsp.GetResults())
+	}
+}
+
+func TestServeCmdValidateTTL(t *testing.T) {
+	cases := map[string]struct {
+		reason  string
+		minTTL  time.Duration
+		maxTTL  time.Duration
+		wantErr bool
+	}{
+		"Bounded": {
+			reason: "A maximum TTL longer than the minimum TTL should be valid",
+			minTTL: 10 * time.Second,
+			maxTTL: time.Hour,
+		},
+		"Unbounded": {
+			reason: "A maximum TTL of zero should leave the TTL unbounded, whatever the minimum TTL",
+			minTTL: 10 * time.Second,
+		},
+		"MaxShorterThanMin": {
+			reason:  "A maximum TTL shorter than the minimum TTL should be invalid",
+			minTTL:  time.Hour,
+			maxTTL:  10 * time.Second,
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			c := &serveCmd{MinTTL: tc.minTTL, MaxTTL: tc.maxTTL}
+			if err := c.Validate(); (err != nil) != tc.wantErr {
+				t.Errorf("%s\nc.Validate(): want error %t, got %v", tc.reason, tc.wantErr, err)
+			}
+		})
+	}
+}
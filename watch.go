@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"io/fs"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+	"github.com/crossplane/crossplane-runtime/pkg/logging"
+)
+
+// A libraryWatcher reloads the policy library whenever the content of a
+// directory changes.
+type libraryWatcher struct {
+	dir string
+	log logging.Logger
+
+	// load the policy library.
+	load func() (*library, error)
+
+	// debounce is how long to wait for changes to settle before reloading,
+	// given a single update usually triggers a burst of events.
+	debounce time.Duration
+
+	// activate is called with every successfully reloaded library, while
+	// fail is called with the error of every failed reload.
+	activate func(*library)
+	fail     func(error)
+}
+
+// watch the directory until the supplied context is done, reloading the policy
+// library whenever it changes.
+func (w *libraryWatcher) watch(ctx context.Context) error {
+	fw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return errors.Wrap(err, "cannot create filesystem watcher")
+	}
+	defer fw.Close() //nolint:errcheck // Nothing to do if we can't close it.
+
+	if err := addDirs(fw, w.dir); err != nil {
+		return err
+	}
+
+	reload := time.NewTimer(w.debounce)
+	reload.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case ev, ok := <-fw.Events:
+			if !ok {
+				return nil
+			}
+			w.log.Debug("Policy directory changed", "event", ev.String())
+			reload.Reset(w.debounce)
+		case err, ok := <-fw.Errors:
+			if !ok {
+				return nil
+			}
+			w.log.Info("Cannot watch policy directory", "dir", w.dir, "error", err)
+		case <-reload.C:
+			// Subdirectories might have been added since we last
+			// reloaded. Watching the same directory twice is a no-op.
+			if err := addDirs(fw, w.dir); err != nil {
+				w.log.Info("Cannot watch policy directory", "dir", w.dir, "error", err)
+			}
+			lib, err := w.load()
+			if err != nil {
+				libraryReloads.WithLabelValues("failure").Inc()
+				w.fail(err)
+				continue
+			}
+			libraryReloads.WithLabelValues("success").Inc()
+			w.activate(lib)
+		}
+	}
+}
+
+// addDirs watches the supplied directory and all its subdirectories, including
+// hidden ones so that ConfigMap volume updates are noticed.
+func addDirs(fw *fsnotify.Watcher, dir string) error {
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		return fw.Add(path)
+	})
+	return errors.Wrapf(err, "cannot watch policy directory %q", dir)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/crossplane/crossplane-runtime/pkg/errors"
+
+	"github.com/crossplane/function-sdk-go"
+)
+
+func TestLibraryWatcher(t *testing.T) {
+	log, err := function.NewLogger(true)
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+
+	dir := t.TempDir()
+	write := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, "main.rego"), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("package crossplane\n\ndeny[\"v1\"] { true }\n")
+
+	initial, err := loadLibrary(dir)
+	if err != nil {
+		t.Fatalf("loadLibrary(...): %v", err)
+	}
+
+	activated := make(chan *library, 10)
+	w := &libraryWatcher{
+		dir:      dir,
+		log:      log,
+		load:     func() (*library, error) { return loadLibrary(dir) },
+		debounce: 10 * time.Millisecond,
+		activate: func(l *library) { activated <- l },
+		fail:     func(error) {},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- w.watch(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("w.watch(...): %v", err)
+		}
+	})
+
+	// Give the watcher a chance to start watching.
+	time.Sleep(100 * time.Millisecond)
+
+	write("package crossplane\n\ndeny[ {\n")
+	select {
+	case l := <-activated:
+		t.Fatalf("w.watch(...): invalid library with revision %s was activated", l.revision)
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	write("package crossplane\n\ndeny[\"v2\"] { true }\n")
+	select {
+	case l := <-activated:
+		if l.revision == initial.revision {
+			t.Errorf("w.watch(...): want a new revision, got the initial revision %s", l.revision)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("w.watch(...): valid library was not activated")
+	}
+}
+
+func TestLibraryWatcherVerificationFailure(t *testing.T) {
+	log, err := function.NewLogger(true)
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+
+	vc, err := bundleVerification{Key: "s3cr3t", KeyID: "ci", Algorithm: "HS256"}.config()
+	if err != nil {
+		t.Fatalf("config(): %v", err)
+	}
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "bundle.tar.gz")
+	write := func(src string) {
+		t.Helper()
+		b, err := os.ReadFile(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, b, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(writeTestBundle(t, testBundleModule, "s3cr3t", ""))
+
+	load := func() (*library, error) { return loadBundle(path, vc) }
+	initial, err := load()
+	if err != nil {
+		t.Fatalf("loadBundle(...): %v", err)
+	}
+
+	f := &Function{log: log}
+	f.useLibrary(initial)
+
+	failed := make(chan error, 10)
+	w := &libraryWatcher{
+		dir:      dir,
+		log:      log,
+		load:     load,
+		debounce: 10 * time.Millisecond,
+		activate: f.useLibrary,
+		fail: func(err error) {
+			f.libraryFailed(err)
+			failed <- err
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- w.watch(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("w.watch(...): %v", err)
+		}
+	})
+
+	// Give the watcher a chance to start watching.
+	time.Sleep(100 * time.Millisecond)
+
+	before := testutil.ToFloat64(bundleVerificationFailures)
+	write(writeTestBundle(t, testBundleModule, "s3cr3t", "package crossplane\n"))
+
+	select {
+	case err := <-failed:
+		var ve *verificationError
+		if !errors.As(err, &ve) {
+			t.Errorf("w.watch(...): want a verification error, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("w.watch(...): tampered bundle was not refused")
+	}
+
+	if got := testutil.ToFloat64(bundleVerificationFailures) - before; got < 1 {
+		t.Errorf("w.watch(...): want verification failures to be counted, got %v more", got)
+	}
+	if got := f.library.Load(); got != initial {
+		t.Errorf("w.watch(...): want the initial library to stay active, got revision %s", got.revision)
+	}
+}